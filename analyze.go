@@ -0,0 +1,397 @@
+// Copyright (c) 2016 Bob Ziuchkovski
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package devo
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+const (
+	ptsClock         = 90000   // PES timestamp ticks per second
+	ptsWrap          = 1 << 33 // PES timestamps are 33 bits
+	ptsReorderWindow = ptsClock
+	sniffLimit       = 16 // PES packets examined per stream to identify the codec
+)
+
+// defaultGapThreshold is the AnalyzeOptions.GapThreshold used when unset
+const defaultGapThreshold = time.Second
+
+// Codec identifies the encoding of an elementary stream.
+type Codec int
+
+// Recognized codecs
+const (
+	CodecUnknown Codec = iota
+	CodecMPEG2Video
+	CodecH264Video
+	CodecMPEGAudio
+	CodecAC3Audio
+)
+
+func (c Codec) String() string {
+	switch c {
+	case CodecUnknown:
+		return "unknown"
+	case CodecMPEG2Video:
+		return "mpeg-2 video"
+	case CodecH264Video:
+		return "h.264 video"
+	case CodecMPEGAudio:
+		return "mpeg audio"
+	case CodecAC3Audio:
+		return "ac-3 audio"
+	default:
+		return fmt.Sprintf("Codec(%d)", int(c))
+	}
+}
+
+// AnalyzeOptions controls optional Analyze behavior.  A nil *AnalyzeOptions is
+// equivalent to the zero value.
+type AnalyzeOptions struct {
+	// GapThreshold is the smallest forward jump between the timestamps of
+	// consecutive PES packets in a stream that is reported as a gap.  If zero,
+	// one second is used.
+	GapThreshold time.Duration
+}
+
+// Analysis describes the elementary streams of plain mpeg-ps or mpeg-ts video.
+type Analysis struct {
+	Stream    StreamType
+	Bytes     int64         // Input bytes
+	Duration  time.Duration // Duration of the longest stream
+	Bitrate   float64       // Bits per second over Duration
+	Truncated bool          // The input ends mid-packet, or lacks an mpeg-ps program end
+	Streams   []StreamAnalysis
+}
+
+// StreamAnalysis describes a single elementary stream.  Timestamps are in 90kHz
+// units.  Video timestamps may run backwards briefly due to frame reordering,
+// which isn't treated as a discontinuity.
+type StreamAnalysis struct {
+	PID              int   // Packet ID carrying the stream, or -1 for mpeg-ps input
+	ID               uint8 // PES stream ID
+	Codec            Codec
+	Packets          int64         // PES packets
+	Bytes            int64         // Elementary stream bytes, excluding PES headers
+	FirstPTS         int64         // First timestamp, or -1 if none
+	LastPTS          int64         // Last timestamp, or -1 if none
+	Duration         time.Duration // Time spanned by the timestamps, excluding gaps and discontinuities
+	Bitrate          float64       // Bits per second over Duration
+	Discontinuities  int           // Timestamps jumping backwards
+	ContinuityErrors int           // Missing or out-of-order mpeg-ts packets
+	Gaps             []Gap
+}
+
+// Gap is a forward jump between the timestamps of consecutive PES packets in
+// a stream.
+type Gap struct {
+	Offset int64 // Byte offset of the packet following the gap
+	From   int64 // Timestamp before the gap
+	To     int64 // Timestamp after the gap
+}
+
+// Duration returns the length of the gap.
+func (g Gap) Duration() time.Duration {
+	return ptsDuration(ptsDelta(g.From, g.To))
+}
+
+// Analyze reads plain (decrypted) mpeg-ps or mpeg-ts video from src and reports
+// the codec, timing, and bitrate of each elementary stream, along with any
+// timestamp gaps and discontinuities.  Input ending mid-packet is reported via
+// Analysis.Truncated.  Corrupt packets are returned as a *PacketError.
+func Analyze(src io.Reader, opts *AnalyzeOptions) (*Analysis, error) {
+	if opts == nil {
+		opts = &AnalyzeOptions{}
+	}
+	threshold := opts.GapThreshold
+	if threshold <= 0 {
+		threshold = defaultGapThreshold
+	}
+
+	srcbuf := newSourceReader(src, 0)
+	stream, err := detectStream(srcbuf)
+	if err != nil {
+		return nil, err
+	}
+	a := &analyzer{
+		gap:      int64(threshold) * (ptsClock / 10000) / int64(time.Second/10000),
+		streams:  make(map[streamKey]*streamState),
+		pids:     make(map[packetID]*streamState),
+		counters: make(map[packetID]uint8),
+	}
+	result := &Analysis{Stream: stream}
+	if stream == StreamTS {
+		result.Truncated, err = a.analyzeTS(srcbuf)
+	} else {
+		result.Truncated, err = a.analyzePS(srcbuf)
+	}
+	if err != nil {
+		return nil, err
+	}
+	result.Bytes = srcbuf.offset()
+	a.finish(result)
+	return result, nil
+}
+
+type streamKey struct {
+	pid int
+	id  uint8
+}
+
+type streamState struct {
+	StreamAnalysis
+	span    int64 // Ticks counted toward Duration
+	maxPTS  int64 // Latest timestamp in presentation order
+	sniffed int   // PES packets examined for the codec
+}
+
+type analyzer struct {
+	gap      int64 // Gap threshold in 90kHz ticks
+	streams  map[streamKey]*streamState
+	pids     map[packetID]*streamState // mpeg-ts PID -> stream of the latest PES packet
+	counters map[packetID]uint8        // mpeg-ts PID -> latest continuity counter
+	programs *programScanner
+}
+
+// analyzePS walks the packets of an mpeg-ps stream
+func (a *analyzer) analyzePS(src *sourceReader) (truncated bool, err error) {
+	var packet psPacket
+	for count := int64(1); ; count++ {
+		start := src.offset()
+		err = readPSPacket(src, &packet)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return true, nil
+		}
+		if err != nil {
+			return false, &PacketError{Stream: StreamPS, Packet: count, Offset: start, PID: -1, Err: err}
+		}
+		if packet.id == psProgramEnd {
+			return false, nil
+		}
+		if packet.hasPESHeader() {
+			a.pes(a.stream(-1, packet.id), start, packet.pts(), packet.payload())
+		}
+	}
+}
+
+// analyzeTS walks the packets of an mpeg-ts stream
+func (a *analyzer) analyzeTS(src *sourceReader) (truncated bool, err error) {
+	var packet tsPacket
+	a.programs = newProgramScanner()
+	for count := int64(1); ; count++ {
+		start := src.offset()
+		_, err = src.Peek(1)
+		if err == io.EOF {
+			return false, nil
+		}
+		err = readTSPacket(src, &packet)
+		if err == io.ErrUnexpectedEOF {
+			return true, nil
+		}
+		if err != nil {
+			return false, &PacketError{Stream: StreamTS, Packet: count, Offset: start, PID: -1, Err: err}
+		}
+		a.programs.push(&packet)
+		a.tsPacket(&packet, start)
+	}
+}
+
+// tsPacket tracks the PES packets and continuity counters of elementary streams
+func (a *analyzer) tsPacket(p *tsPacket, offset int64) {
+	pid := p.id()
+	if pid == tsPatID || a.programs.pmtIDs[pid] || pid == tsIDMask {
+		return
+	}
+	continuous := a.continuity(p)
+
+	payload := p.payload()
+	s := a.pids[pid]
+	if p.payloadStart() && hasStartCode(payload, 0) && len(payload) >= 9 {
+		s = a.stream(int(pid), payload[3])
+		a.pids[pid] = s
+		hdrlen := 9 + int(payload[8])
+		if hdrlen > len(payload) {
+			hdrlen = len(payload)
+		}
+		a.pes(s, offset, p.pts(), payload[hdrlen:])
+	} else if s != nil {
+		s.Bytes += int64(len(payload))
+	}
+	if s != nil && !continuous {
+		s.ContinuityErrors++
+	}
+}
+
+// continuity updates the continuity counter for the packet's PID, reporting
+// whether the packet follows the previous packet without loss.  Duplicate
+// packets and signalled discontinuities are accepted.
+func (a *analyzer) continuity(p *tsPacket) bool {
+	pid := p.id()
+	last, seen := a.counters[pid]
+	counter := p.counter()
+	a.counters[pid] = counter
+	if !seen || (p.hasAdaptation() && p.content[4] != 0 && p.content[5]&0x80 != 0) {
+		return true
+	}
+	if !p.hasPayload() {
+		return counter == last
+	}
+	return counter == last || counter == (last+1)&0x0f
+}
+
+func (a *analyzer) stream(pid int, id uint8) *streamState {
+	key := streamKey{pid: pid, id: id}
+	s := a.streams[key]
+	if s == nil {
+		s = &streamState{StreamAnalysis: StreamAnalysis{PID: pid, ID: id, FirstPTS: -1, LastPTS: -1}}
+		a.streams[key] = s
+	}
+	return s
+}
+
+// pes records a PES packet starting at offset
+func (a *analyzer) pes(s *streamState, offset int64, pts int64, payload []byte) {
+	s.Packets++
+	s.Bytes += int64(len(payload))
+	if s.Codec == CodecUnknown && s.sniffed < sniffLimit {
+		s.sniffed++
+		s.Codec = sniffCodec(s.ID, payload)
+	}
+	if pts < 0 {
+		return
+	}
+	if s.FirstPTS < 0 {
+		s.FirstPTS, s.LastPTS, s.maxPTS = pts, pts, pts
+		return
+	}
+	s.LastPTS = pts
+
+	delta := ptsDelta(s.maxPTS, pts)
+	switch {
+	case delta > a.gap:
+		s.Gaps = append(s.Gaps, Gap{Offset: offset, From: s.maxPTS, To: pts})
+		s.maxPTS = pts
+	case delta > 0:
+		s.span += delta
+		s.maxPTS = pts
+	case delta < -ptsReorderWindow:
+		s.Discontinuities++
+		s.maxPTS = pts
+	}
+}
+
+// finish fills in result from the collected stream state
+func (a *analyzer) finish(result *Analysis) {
+	types := make(map[int]uint8)
+	if a.programs != nil {
+		for _, program := range a.programs.programs() {
+			for _, stream := range program.Streams {
+				types[stream.PID] = stream.Type
+			}
+		}
+	}
+
+	for _, s := range a.streams {
+		if codec := streamTypeCodec(types[s.PID]); codec != CodecUnknown {
+			s.Codec = codec
+		}
+		s.Duration = ptsDuration(s.span)
+		if s.Duration > 0 {
+			s.Bitrate = float64(s.Bytes*8) / s.Duration.Seconds()
+		}
+		if s.Duration > result.Duration {
+			result.Duration = s.Duration
+		}
+		result.Streams = append(result.Streams, s.StreamAnalysis)
+	}
+	if result.Duration > 0 {
+		result.Bitrate = float64(result.Bytes*8) / result.Duration.Seconds()
+	}
+	sort.Slice(result.Streams, func(i, j int) bool {
+		x, y := result.Streams[i], result.Streams[j]
+		return x.PID < y.PID || (x.PID == y.PID && x.ID < y.ID)
+	})
+}
+
+// sniffCodec identifies the codec of a stream from its PES stream ID and the
+// start of a PES payload
+func sniffCodec(id uint8, payload []byte) Codec {
+	switch {
+	case id >= psAudioStream && id < psVideoStreamMin:
+		return CodecMPEGAudio
+	case id >= psVideoStreamMin && id <= psVideoStreamMax:
+		for offset := 0; offset+4 <= len(payload); offset++ {
+			if !hasStartCode(payload, offset) {
+				continue
+			}
+			code := payload[offset+3]
+			switch {
+			case code == 0x00 || code == psSequenceHeader || code == psSequenceExtension || code == psGroupHeader:
+				// Picture, sequence, or group start
+				return CodecMPEG2Video
+			case code&0x80 == 0 && (code&0x1f == 7 || code&0x1f == 9):
+				// Sequence parameter set or access unit delimiter NAL unit
+				return CodecH264Video
+			}
+		}
+	case id == psPrivateStream1:
+		// AC-3 sync frames may be preceded by a DVD-style substream header
+		for offset := 0; offset+2 <= len(payload) && offset <= 4; offset++ {
+			if payload[offset] == 0x0b && payload[offset+1] == 0x77 {
+				return CodecAC3Audio
+			}
+		}
+	}
+	return CodecUnknown
+}
+
+// streamTypeCodec returns the codec for an mpeg-ts program map stream type
+func streamTypeCodec(streamType uint8) Codec {
+	switch streamType {
+	case 0x02:
+		return CodecMPEG2Video
+	case 0x1b:
+		return CodecH264Video
+	case 0x03, 0x04:
+		return CodecMPEGAudio
+	case 0x81:
+		return CodecAC3Audio
+	default:
+		return CodecUnknown
+	}
+}
+
+// ptsDelta returns the signed difference between two 33-bit timestamps,
+// accounting for wraparound
+func ptsDelta(from, to int64) int64 {
+	delta := (to - from) & (ptsWrap - 1)
+	if delta >= ptsWrap/2 {
+		delta -= ptsWrap
+	}
+	return delta
+}
+
+func ptsDuration(ticks int64) time.Duration {
+	return time.Duration(ticks) * (time.Second / 10000) / (ptsClock / 10000)
+}
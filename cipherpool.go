@@ -21,7 +21,9 @@
 package devo
 
 import (
+	"crypto/md5"
 	"crypto/sha1"
+	"encoding/hex"
 	"github.com/bobziuchkovski/turing"
 )
 
@@ -31,15 +33,13 @@ type cipherHandle struct {
 }
 
 type cipherPool struct {
-	mak     string // Media access key (MAK) from TiVo unit
-	iv      []byte // Initialization vector (IV) from file metadata
+	basekey [sha1.Size]byte // Digest of the media access key (MAK) and initialization vector (IV)
 	ciphers map[cipherHandle]*turing.Cipher
 }
 
 func newCipherPool(mak string, iv []byte) *cipherPool {
 	return &cipherPool{
-		mak:     mak,
-		iv:      iv,
+		basekey: sha1.Sum(append([]byte(mak), iv...)),
 		ciphers: make(map[cipherHandle]*turing.Cipher),
 	}
 }
@@ -48,7 +48,7 @@ func (pool *cipherPool) getCipher(id uint8, confounder [3]byte) *turing.Cipher {
 	handle := cipherHandle{id: id, confounder: confounder}
 	c, present := pool.ciphers[handle]
 	if !present {
-		basekey := sha1.Sum(append([]byte(pool.mak), pool.iv...))
+		basekey := pool.basekey // Copied, as the appends below write past basekey[:16]
 		derivedkey := sha1.Sum(append(basekey[:16], handle.id))
 		derivediv := sha1.Sum(append(basekey[:16], handle.id, handle.confounder[0], handle.confounder[1], handle.confounder[2]))
 
@@ -61,3 +61,11 @@ func (pool *cipherPool) getCipher(id uint8, confounder [3]byte) *turing.Cipher {
 	}
 	return c
 }
+
+// newMetadataCipher returns the cipher for encrypted metadata segments.  The
+// metadata key is derived from a hex-encoded md5 of the mak rather than the mak
+// itself, but is otherwise constructed the same as stream 0 of the video content.
+func newMetadataCipher(mak string, iv []byte) *turing.Cipher {
+	digest := md5.Sum([]byte("tivo:TiVo DVR:" + mak))
+	return newCipherPool(hex.EncodeToString(digest[:]), iv).getCipher(0, [3]byte{})
+}
@@ -0,0 +1,316 @@
+// Copyright (c) 2016 Bob Ziuchkovski
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package devo
+
+import (
+	"errors"
+	"io"
+	"math"
+	"sort"
+	"time"
+)
+
+// errClipEnd stops decryption once the end of a clip is reached
+var errClipEnd = errors.New("devo: end of clip")
+
+// forever is the end of a span that runs to the end of the video
+const forever = time.Duration(math.MaxInt64)
+
+// Cut is a span of video to drop from the output, such as a commercial break.
+// Times are measured from the first video timestamp.
+type Cut struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+// span is a span of video to keep
+type span struct {
+	from, to time.Duration
+}
+
+// keepSpans returns the spans of video from start to end, or to the end of the
+// video if end is zero, that aren't cut
+func keepSpans(start, end time.Duration, cuts []Cut) []span {
+	if end == 0 {
+		end = forever
+	}
+	sorted := append([]Cut(nil), cuts...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Start < sorted[j].Start })
+
+	var spans []span
+	from := start
+	for _, cut := range sorted {
+		if cut.Start >= end {
+			break
+		}
+		if cut.Start > from {
+			spans = append(spans, span{from, cut.Start})
+		}
+		if cut.End > from {
+			from = cut.End
+		}
+	}
+	if from < end {
+		spans = append(spans, span{from, end})
+	}
+	return spans
+}
+
+// Whether a clipper keeps the current GOP
+const (
+	keepUnknown = iota // Depends on where the GOP ends
+	keepGOP
+	dropGOP
+)
+
+// clipper writes the GOPs (groups of pictures) of decrypted video that overlap
+// the spans being kept, dropping the rest.  A GOP runs from the resync point
+// ahead of one keyframe to the resync point ahead of the next.  GOPs that start
+// outside the kept spans are held until the following keyframe shows whether
+// they overlap one.  Packets are written to the clipper as they're returned by
+// the indexer.
+type clipper struct {
+	dst      io.Writer
+	ix       *indexer
+	ts       *tsDecryptor // nil for mpeg-ps
+	spans    []span
+	keep     int           // Whether the current GOP is kept
+	gopStart time.Duration // Time of the current GOP's keyframe
+	leading  bool          // The current output precedes the first keyframe
+	held     []byte        // Output not yet written or dropped
+	heldOut  int64         // Output offset of held[0]
+	wrote    bool          // Output has been written
+	spliced  bool          // Output has been dropped since the last write
+
+	// mpeg-ts continuity counters are adjusted so that there are no gaps at splices
+	tables      map[packetID][]byte // Latest PAT and program map packets by PID
+	counters    map[packetID]uint8  // Counter of the latest payload written by PID
+	adjust      map[packetID]uint8  // Counter adjustment by PID
+	generations map[packetID]int    // Splice generation of each PID's adjustment
+	generation  int
+}
+
+func newClipper(dst io.Writer, ix *indexer, spans []span) *clipper {
+	c := &clipper{
+		dst:         dst,
+		ix:          ix,
+		spans:       spans,
+		leading:     true,
+		tables:      make(map[packetID][]byte),
+		counters:    make(map[packetID]uint8),
+		adjust:      make(map[packetID]uint8),
+		generations: make(map[packetID]int),
+	}
+	c.keep = c.startGOP(0)
+	c.ts, _ = ix.resumable.(*tsDecryptor)
+	return c
+}
+
+// Write takes the packet most recently returned by the indexer.  If the packet
+// shows a keyframe follows the pending resync point, the GOP preceding that point
+// is written or dropped first.  errClipEnd is returned once a keyframe past
+// the last kept span is reached.
+func (c *clipper) Write(packet []byte) (int, error) {
+	if c.ix.found && c.ix.foundPTS >= 0 && c.ix.basePTS >= 0 {
+		at := c.time(c.ix.foundPTS)
+		if c.keep == keepUnknown {
+			c.keep = c.endGOP(at)
+		}
+		err := c.flush(c.ix.foundOut - c.heldOut)
+		if err != nil {
+			return 0, err
+		}
+
+		c.leading = false
+		c.gopStart = at
+		c.keep = c.startGOP(at)
+		if c.keep == dropGOP {
+			return 0, errClipEnd
+		}
+	}
+
+	// The program end code is rewritten by close
+	if c.ts == nil && len(packet) == 4 && joinWord(packet) == psCode(psProgramEnd) {
+		return len(packet), nil
+	}
+	if c.ts != nil {
+		c.remember(packet)
+	}
+	c.held = append(c.held, packet...)
+
+	// Kept output is written up to the pending resync point, which may yet turn
+	// out to start a GOP that's dropped
+	if c.keep == keepGOP {
+		n := int64(len(c.held))
+		if c.ix.hasPending {
+			n = c.ix.pendingOut - c.heldOut
+		}
+		err := c.flush(n)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(packet), nil
+}
+
+// close writes or drops the remaining output, then ends mpeg-ps output with a
+// program end code
+func (c *clipper) close() error {
+	if c.keep == keepUnknown {
+		c.keep = c.endGOP(forever)
+	}
+	err := c.flush(int64(len(c.held)))
+	if err != nil || c.ts != nil || !c.wrote {
+		return err
+	}
+	_, err = c.dst.Write([]byte{psPrefix >> 16, psPrefix >> 8 & 0xff, psPrefix & 0xff, psProgramEnd})
+	return err
+}
+
+// startGOP returns whether the GOP with a keyframe at time at is kept, so far as
+// is known.  dropGOP is only returned past the last kept span, as nothing more
+// is kept.
+func (c *clipper) startGOP(at time.Duration) int {
+	for _, s := range c.spans {
+		if at < s.from {
+			return keepUnknown
+		}
+		if at < s.to {
+			return keepGOP
+		}
+	}
+	return dropGOP
+}
+
+// endGOP returns whether the current GOP, which ends at time to, is kept
+func (c *clipper) endGOP(to time.Duration) int {
+	for _, s := range c.spans {
+		if s.from < to && c.gopStart < s.to {
+			return keepGOP
+		}
+	}
+	return dropGOP
+}
+
+// time returns the time of pts from the first video timestamp
+func (c *clipper) time(pts int64) time.Duration {
+	delta := ptsDelta(c.ix.basePTS, pts)
+	if delta < 0 {
+		return 0
+	}
+	return ptsDuration(delta)
+}
+
+// flush writes or drops the first n bytes of held output, according to whether
+// the current GOP is kept
+func (c *clipper) flush(n int64) error {
+	if n <= 0 {
+		return nil
+	}
+	data := c.held[:n]
+	c.held = c.held[n:]
+	c.heldOut += n
+	defer func() {
+		if len(c.held) == 0 {
+			c.held = data[:0]
+		}
+	}()
+
+	if c.keep != keepGOP {
+		c.spliced = c.wrote
+		return nil
+	}
+	if c.ts == nil {
+		c.wrote = true
+		_, err := c.dst.Write(data)
+		return err
+	}
+
+	// Output that doesn't start with the leading program tables gets a copy
+	if !c.wrote && !c.leading {
+		err := c.writeTS(c.latestTables())
+		if err != nil {
+			return err
+		}
+		c.spliced = true
+	}
+	if c.spliced {
+		c.generation++
+		c.spliced = false
+	}
+	c.wrote = true
+	return c.writeTS(data)
+}
+
+// remember records packet if it carries the PAT or a program map
+func (c *clipper) remember(packet []byte) {
+	pid := extractPacketID(packet[1:3])
+	if pid != tsPatID && !c.ts.pmtIDs[pid] {
+		return
+	}
+	if packet[1]&(1<<6) != 0 {
+		c.tables[pid] = c.tables[pid][:0]
+	}
+	c.tables[pid] = append(c.tables[pid], packet...)
+}
+
+// latestTables returns the latest PAT packets followed by those of each program map
+func (c *clipper) latestTables() []byte {
+	var pids []packetID
+	for pid := range c.tables {
+		pids = append(pids, pid)
+	}
+	sort.Slice(pids, func(i, j int) bool { return pids[i] < pids[j] })
+	var tables []byte
+	for _, pid := range pids {
+		tables = append(tables, c.tables[pid]...)
+	}
+	return tables
+}
+
+// writeTS writes mpeg-ts packets, adjusting their continuity counters to follow
+// on from those already written when the packets follow a splice
+func (c *clipper) writeTS(packets []byte) error {
+	for offset := 0; offset+tsPacketSize <= len(packets); offset += tsPacketSize {
+		packet := packets[offset : offset+tsPacketSize]
+		pid := extractPacketID(packet[1:3])
+		if pid == tsNullID {
+			// Null packet counters are undefined, so they're written as is
+			continue
+		}
+		counter := packet[3] & 0x0f
+		hasPayload := packet[3]&0x10 != 0
+		if hasPayload {
+			last, seen := c.counters[pid]
+			if seen && c.generations[pid] != c.generation {
+				c.adjust[pid] = (last + 1 - counter) & 0x0f
+			}
+			c.generations[pid] = c.generation
+		}
+		counter = (counter + c.adjust[pid]) & 0x0f
+		packet[3] = packet[3]&0xf0 | counter
+		if hasPayload {
+			c.counters[pid] = counter
+		}
+	}
+	_, err := c.dst.Write(packets)
+	return err
+}
@@ -0,0 +1,236 @@
+// Copyright (c) 2016 Bob Ziuchkovski
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/bobziuchkovski/devo"
+	"github.com/bobziuchkovski/writ"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+const analyzeUsage = "Usage: devo analyze [OPTION]... FILE"
+
+// analyzeProblemStatus is the exit status when the analysis finds problems
+const analyzeProblemStatus = 2
+
+type analyzeConfig struct {
+	AccessKey string `option:"m, mak" placeholder:"MAK" description:"Decrypt a TiVo file using this media access key before analyzing"`
+	Gap       string `option:"gap" placeholder:"DURATION" description:"Report timestamp jumps of at least DURATION as gaps (default 1s)"`
+	JSON      bool   `flag:"json" description:"Display the report as json"`
+	HelpFlag  bool   `flag:"h, help" description:"Display this help text and exit"`
+}
+
+type analyzeReport struct {
+	File      string          `json:"file"`
+	Format    string          `json:"format"`
+	Bytes     int64           `json:"bytes"`
+	Duration  float64         `json:"duration"` // Seconds
+	Bitrate   float64         `json:"bitrate"`  // Bits per second
+	Truncated bool            `json:"truncated"`
+	Streams   []analyzeStream `json:"streams"`
+}
+
+type analyzeStream struct {
+	PID              int          `json:"pid,omitempty"`
+	ID               uint8        `json:"streamId"`
+	Codec            string       `json:"codec"`
+	Packets          int64        `json:"packets"`
+	Bytes            int64        `json:"bytes"`
+	FirstPTS         int64        `json:"firstPts"`
+	LastPTS          int64        `json:"lastPts"`
+	Duration         float64      `json:"duration"` // Seconds
+	Bitrate          float64      `json:"bitrate"`  // Bits per second
+	Discontinuities  int          `json:"discontinuities"`
+	ContinuityErrors int          `json:"continuityErrors"`
+	Gaps             []analyzeGap `json:"gaps"`
+}
+
+type analyzeGap struct {
+	Offset   int64   `json:"offset"`
+	From     int64   `json:"fromPts"`
+	To       int64   `json:"toPts"`
+	Duration float64 `json:"duration"` // Seconds
+}
+
+func (cfg *analyzeConfig) validate(positional []string) error {
+	if len(positional) != 1 {
+		return fmt.Errorf("exactly one input file must be specified")
+	}
+	if cfg.AccessKey != "" {
+		err := validateAccessKey(cfg.AccessKey)
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.Gap != "" {
+		gap, err := time.ParseDuration(cfg.Gap)
+		if err != nil || gap <= 0 {
+			return fmt.Errorf("--gap must be a positive duration, such as 500ms")
+		}
+	}
+	return nil
+}
+
+func runAnalyze(cmd *writ.Command, cfg *analyzeConfig, positional []string) {
+	if cfg.HelpFlag {
+		cmd.ExitHelp(nil)
+	}
+	err := cfg.validate(positional)
+	if err != nil {
+		cmd.ExitHelp(err)
+	}
+
+	file, err := os.Open(positional[0])
+	check(err)
+	defer file.Close()
+
+	// TiVo files are decrypted on the fly
+	var input io.Reader = bufio.NewReader(file)
+	magic, _ := input.(*bufio.Reader).Peek(4)
+	if string(magic) == "TiVo" {
+		if cfg.AccessKey == "" {
+			cmd.ExitHelp(fmt.Errorf("-m/--mak is required to analyze a TiVo file"))
+		}
+		decrypted, err := devo.NewReader(input, cfg.AccessKey)
+		check(err)
+		defer decrypted.Close()
+		input = decrypted
+	}
+
+	opts := &devo.AnalyzeOptions{}
+	if cfg.Gap != "" {
+		opts.GapThreshold, _ = time.ParseDuration(cfg.Gap)
+	}
+	analysis, err := devo.Analyze(input, opts)
+	check(err)
+
+	report := newAnalyzeReport(positional[0], analysis)
+	if cfg.JSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		check(enc.Encode(report))
+	} else {
+		check(writeAnalyzeText(os.Stdout, report))
+	}
+	if hasProblems(analysis) {
+		os.Exit(analyzeProblemStatus)
+	}
+}
+
+// hasProblems reports whether the analysis indicates a truncated or glitched recording
+func hasProblems(analysis *devo.Analysis) bool {
+	if analysis.Truncated {
+		return true
+	}
+	for _, stream := range analysis.Streams {
+		if len(stream.Gaps) != 0 || stream.Discontinuities != 0 || stream.ContinuityErrors != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func newAnalyzeReport(file string, analysis *devo.Analysis) analyzeReport {
+	report := analyzeReport{
+		File:      file,
+		Format:    analysis.Stream.String(),
+		Bytes:     analysis.Bytes,
+		Duration:  analysis.Duration.Seconds(),
+		Bitrate:   analysis.Bitrate,
+		Truncated: analysis.Truncated,
+		Streams:   []analyzeStream{},
+	}
+	for _, stream := range analysis.Streams {
+		s := analyzeStream{
+			ID:               stream.ID,
+			Codec:            stream.Codec.String(),
+			Packets:          stream.Packets,
+			Bytes:            stream.Bytes,
+			FirstPTS:         stream.FirstPTS,
+			LastPTS:          stream.LastPTS,
+			Duration:         stream.Duration.Seconds(),
+			Bitrate:          stream.Bitrate,
+			Discontinuities:  stream.Discontinuities,
+			ContinuityErrors: stream.ContinuityErrors,
+			Gaps:             []analyzeGap{},
+		}
+		if stream.PID >= 0 {
+			s.PID = stream.PID
+		}
+		for _, gap := range stream.Gaps {
+			s.Gaps = append(s.Gaps, analyzeGap{Offset: gap.Offset, From: gap.From, To: gap.To, Duration: gap.Duration().Seconds()})
+		}
+		report.Streams = append(report.Streams, s)
+	}
+	return report
+}
+
+func writeAnalyzeText(w io.Writer, report analyzeReport) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "File:\t%s\n", report.File)
+	fmt.Fprintf(tw, "Format:\t%s\n", report.Format)
+	fmt.Fprintf(tw, "Size:\t%d bytes\n", report.Bytes)
+	fmt.Fprintf(tw, "Duration:\t%s\n", formatSeconds(report.Duration))
+	fmt.Fprintf(tw, "Bitrate:\t%s\n", formatBitrate(report.Bitrate))
+	fmt.Fprintf(tw, "Truncated:\t%t\n", report.Truncated)
+
+	fmt.Fprintf(tw, "\nStreams:\n")
+	fmt.Fprintf(tw, "  PID\tID\tCodec\tPackets\tDuration\tBitrate\tDiscontinuities\tCC errors\tGaps\n")
+	for _, stream := range report.Streams {
+		pid := "-"
+		if report.Format == devo.StreamTS.String() {
+			pid = formatPID(stream.PID)
+		}
+		fmt.Fprintf(tw, "  %s\t0x%02x\t%s\t%d\t%s\t%s\t%d\t%d\t%d\n", pid, stream.ID, stream.Codec, stream.Packets,
+			formatSeconds(stream.Duration), formatBitrate(stream.Bitrate), stream.Discontinuities, stream.ContinuityErrors, len(stream.Gaps))
+	}
+
+	err := tw.Flush()
+	if err != nil {
+		return err
+	}
+
+	heading := "\nGaps:\n"
+	for _, stream := range report.Streams {
+		for _, gap := range stream.Gaps {
+			_, err = fmt.Fprintf(w, "%s  Stream 0x%02x: %s at offset 0x%08x (PTS %d to %d)\n", heading, stream.ID, formatSeconds(gap.Duration), gap.Offset, gap.From, gap.To)
+			if err != nil {
+				return err
+			}
+			heading = ""
+		}
+	}
+	return nil
+}
+
+func formatSeconds(seconds float64) string {
+	return time.Duration(seconds * float64(time.Second)).Round(time.Millisecond).String()
+}
+
+func formatBitrate(bitrate float64) string {
+	return fmt.Sprintf("%.2f Mbit/s", bitrate/1e6)
+}
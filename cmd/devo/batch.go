@@ -0,0 +1,218 @@
+// Copyright (c) 2016 Bob Ziuchkovski
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/bobziuchkovski/writ"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	batchUsage       = "Usage: devo batch [OPTION]..."
+	defaultBatchJobs = 2
+)
+
+type batchConfig struct {
+	AccessKey  string `option:"m, mak" placeholder:"MAK" description:"The 10-digit media access key (MAK) from your TiVo"`
+	InputDir   string `option:"in-dir" placeholder:"DIR" description:"Directory containing the encrypted .TiVo files"`
+	OutputDir  string `option:"out-dir" placeholder:"DIR" description:"Directory for the decrypted output"`
+	Name       string `option:"name" placeholder:"TEMPLATE" description:"Output path template, relative to the output directory (default {{.Base}}{{.Ext}})"`
+	Jobs       int    `option:"j, jobs" placeholder:"N" description:"Decrypt N files concurrently (default 2)"`
+	State      string `option:"state" placeholder:"FILE" description:"Track completed files in FILE (default OUT-DIR/.devo-state.json)"`
+	Force      bool   `flag:"force" description:"Decrypt files even if they were completed previously"`
+	MetaFormat string `option:"metadata-format" placeholder:"FORMAT" description:"Write show metadata sidecars next to each output (txt, nfo, json, or a comma-separated list)"`
+	Lenient    bool   `flag:"lenient" description:"Skip past corrupt or truncated input rather than failing"`
+	HelpFlag   bool   `flag:"h, help" description:"Display this help text and exit"`
+}
+
+func (cfg *batchConfig) validate(positional []string) error {
+	if len(positional) != 0 {
+		return fmt.Errorf("too many arguments provided")
+	}
+	if cfg.Jobs < 0 {
+		return fmt.Errorf("-j/--jobs must not be negative")
+	}
+	return validateDirOptions(cfg.AccessKey, cfg.InputDir, cfg.OutputDir, cfg.Name, cfg.MetaFormat)
+}
+
+// validateDirOptions checks the options shared by the directory-based commands
+func validateDirOptions(mak, inDir, outDir, name, metaFormat string) error {
+	if inDir == "" {
+		return fmt.Errorf("--in-dir must be specified")
+	}
+	if outDir == "" {
+		return fmt.Errorf("--out-dir must be specified")
+	}
+	if mak == "" {
+		return fmt.Errorf("-m/--mak is required")
+	}
+	err := validateAccessKey(mak)
+	if err != nil {
+		return err
+	}
+	_, err = parseNameTemplate(name)
+	if err != nil {
+		return fmt.Errorf("--name: %s", err)
+	}
+	_, err = parseMetadataFormats(metaFormat)
+	if err != nil {
+		return fmt.Errorf("--metadata-format: %s", err)
+	}
+	return nil
+}
+
+// batchResult is the outcome of decrypting a single file
+type batchResult struct {
+	input   string
+	status  string
+	output  string
+	size    int64
+	elapsed time.Duration
+	err     error
+}
+
+func runBatch(cmd *writ.Command, cfg *batchConfig, positional []string) {
+	if cfg.HelpFlag {
+		cmd.ExitHelp(nil)
+	}
+	err := cfg.validate(positional)
+	if err != nil {
+		cmd.ExitHelp(err)
+	}
+
+	dec, err := newFileDecryptor(cfg.AccessKey, cfg.OutputDir, cfg.Name, cfg.MetaFormat, cfg.Lenient)
+	check(err)
+	statePath := cfg.State
+	if statePath == "" {
+		statePath = filepath.Join(cfg.OutputDir, defaultStateFile)
+	}
+	state, err := loadState(statePath)
+	check(err)
+	inputs, err := listTiVoFiles(cfg.InputDir)
+	check(err)
+
+	jobs := cfg.Jobs
+	if jobs == 0 {
+		jobs = defaultBatchJobs
+	}
+	results := make([]batchResult, len(inputs))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexes {
+				results[index] = batchFile(dec, state, inputs[index], cfg.Force)
+			}
+		}()
+	}
+	for i := range inputs {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	failed := writeBatchSummary(os.Stdout, results)
+	if failed != 0 {
+		os.Exit(1)
+	}
+}
+
+// batchFile decrypts input unless the state shows it was completed previously
+func batchFile(dec *fileDecryptor, state *stateFile, input string, force bool) batchResult {
+	result := batchResult{input: input}
+	info, err := os.Stat(input)
+	if err != nil {
+		result.status, result.err = "failed", err
+		return result
+	}
+	if output, ok := state.completed(input, info); ok && !force {
+		result.status, result.output = "skipped", output
+		return result
+	}
+
+	start := time.Now()
+	result.output, err = dec.decrypt(context.Background(), input)
+	result.elapsed = time.Since(start)
+	if err == nil {
+		err = state.record(input, info, result.output)
+	}
+	if err != nil {
+		result.status, result.err = "failed", err
+		return result
+	}
+	result.status = "decrypted"
+	if out, err := os.Stat(result.output); err == nil {
+		result.size = out.Size()
+	}
+	return result
+}
+
+// listTiVoFiles returns the paths of the .TiVo files in dir, matching the
+// extension case-insensitively
+func listTiVoFiles(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, entry := range entries {
+		if entry.Mode().IsRegular() && strings.EqualFold(filepath.Ext(entry.Name()), ".tivo") {
+			paths = append(paths, filepath.Join(dir, entry.Name()))
+		}
+	}
+	return paths, nil
+}
+
+// writeBatchSummary writes a table of results to w, returning the number of failures
+func writeBatchSummary(w io.Writer, results []batchResult) (failed int) {
+	var decrypted, skipped int
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "File\tStatus\tOutput\tSize\tTime\n")
+	for _, result := range results {
+		output, size, elapsed := result.output, "-", "-"
+		switch result.status {
+		case "decrypted":
+			decrypted++
+			size = fmt.Sprintf("%.1f MB", float64(result.size)/1e6)
+			elapsed = result.elapsed.Round(time.Second / 10).String()
+		case "skipped":
+			skipped++
+		case "failed":
+			failed++
+			output = result.err.Error()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", filepath.Base(result.input), result.status, output, size, elapsed)
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "\n%d decrypted, %d skipped, %d failed\n", decrypted, skipped, failed)
+	return failed
+}
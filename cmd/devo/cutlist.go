@@ -0,0 +1,138 @@
+// Copyright (c) 2016 Bob Ziuchkovski
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/bobziuchkovski/devo"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Comskip EDL action types that drop video: 0 cuts, 3 is a commercial break
+const (
+	edlCut        = 0
+	edlCommercial = 3
+)
+
+// readCutList reads the --cut-list file at path, either a comskip .edl file or
+// a json array of {"start": ..., "end": ...} objects.  An empty path is no cuts.
+func readCutList(path string) ([]devo.Cut, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	trimmed := bytes.TrimSpace(data)
+	if strings.EqualFold(filepath.Ext(path), ".json") || bytes.HasPrefix(trimmed, []byte("[")) {
+		return parseJSONCuts(trimmed)
+	}
+	return parseEDLCuts(data)
+}
+
+// parseEDLCuts parses comskip EDL lines of the form "START END [TYPE]", with times
+// in seconds.  Lines with a type other than a cut or commercial break are skipped.
+func parseEDLCuts(data []byte) ([]devo.Cut, error) {
+	var cuts []devo.Cut
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("line %d: expected START END [TYPE]", line)
+		}
+		if len(fields) == 3 {
+			action, err := strconv.Atoi(fields[2])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid type %q", line, fields[2])
+			}
+			if action != edlCut && action != edlCommercial {
+				continue
+			}
+		}
+		cut, err := parseCut(fields[0], fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err)
+		}
+		cuts = append(cuts, cut)
+	}
+	return cuts, scanner.Err()
+}
+
+// parseJSONCuts parses a json array of cuts.  Times are given in seconds or as
+// strings accepted by --start and --end.
+func parseJSONCuts(data []byte) ([]devo.Cut, error) {
+	var entries []struct {
+		Start json.RawMessage `json:"start"`
+		End   json.RawMessage `json:"end"`
+	}
+	err := json.Unmarshal(data, &entries)
+	if err != nil {
+		return nil, err
+	}
+	var cuts []devo.Cut
+	for i, entry := range entries {
+		if entry.Start == nil || entry.End == nil {
+			return nil, fmt.Errorf("cut %d: start and end are required", i+1)
+		}
+		cut, err := parseCut(jsonTime(entry.Start), jsonTime(entry.End))
+		if err != nil {
+			return nil, fmt.Errorf("cut %d: %s", i+1, err)
+		}
+		cuts = append(cuts, cut)
+	}
+	return cuts, nil
+}
+
+// jsonTime returns the text of a json number or string time
+func jsonTime(raw json.RawMessage) string {
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s
+	}
+	return string(raw)
+}
+
+func parseCut(start, end string) (devo.Cut, error) {
+	var cut devo.Cut
+	var err error
+	cut.Start, err = parseTimestamp(start)
+	if err != nil {
+		return cut, err
+	}
+	cut.End, err = parseTimestamp(end)
+	if err != nil {
+		return cut, err
+	}
+	if cut.End <= cut.Start {
+		return cut, fmt.Errorf("cut end %s must be after start %s", cut.End, cut.Start)
+	}
+	return cut, nil
+}
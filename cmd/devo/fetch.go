@@ -0,0 +1,249 @@
+// Copyright (c) 2016 Bob Ziuchkovski
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/bobziuchkovski/devo"
+	"github.com/bobziuchkovski/devo/tivo"
+	"github.com/bobziuchkovski/writ"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+const fetchUsage = "Usage: devo fetch [OPTION]... HOST [ID]"
+
+type fetchConfig struct {
+	AccessKey  string `option:"m, mak" placeholder:"MAK" description:"The 10-digit media access key (MAK) from your TiVo"`
+	Output     string `option:"o, output" placeholder:"FILE" description:"The decrypted output video file"`
+	TS         bool   `flag:"ts" description:"Download in mpeg-ts rather than mpeg-ps format"`
+	JSON       bool   `flag:"json" description:"Display the recording list as json"`
+	MetaFormat string `option:"metadata-format" placeholder:"FORMAT" description:"Write show metadata sidecars next to the output (txt, nfo, json, or a comma-separated list)"`
+	Lenient    bool   `flag:"lenient" description:"Skip past corrupt or truncated input rather than failing"`
+	HelpFlag   bool   `flag:"h, help" description:"Display this help text and exit"`
+}
+
+type fetchRecording struct {
+	ID            string  `json:"id"`
+	Title         string  `json:"title"`
+	EpisodeTitle  string  `json:"episodeTitle,omitempty"`
+	Description   string  `json:"description,omitempty"`
+	Channel       string  `json:"channel,omitempty"`
+	Station       string  `json:"station,omitempty"`
+	Captured      string  `json:"captured,omitempty"`
+	Duration      float64 `json:"duration"` // Seconds
+	Size          int64   `json:"size"`
+	InProgress    bool    `json:"inProgress"`
+	CopyProtected bool    `json:"copyProtected"`
+	URL           string  `json:"url"`
+}
+
+func (cfg *fetchConfig) validate(positional []string) error {
+	if len(positional) == 0 {
+		return fmt.Errorf("a TiVo host must be specified")
+	}
+	if len(positional) > 2 {
+		return fmt.Errorf("too many arguments provided")
+	}
+	if cfg.AccessKey == "" {
+		return fmt.Errorf("-m/--mak is required")
+	}
+	err := validateAccessKey(cfg.AccessKey)
+	if err != nil {
+		return err
+	}
+	if len(positional) == 1 {
+		if cfg.Output != "" || cfg.MetaFormat != "" {
+			return fmt.Errorf("-o/--output and --metadata-format require a recording ID")
+		}
+		return nil
+	}
+	if cfg.Output == "" {
+		return fmt.Errorf("-o/--output must be specified")
+	}
+	formats, err := parseMetadataFormats(cfg.MetaFormat)
+	if err != nil {
+		return fmt.Errorf("--metadata-format: %s", err)
+	}
+	if len(formats) != 0 && cfg.Output == "-" {
+		return fmt.Errorf("--metadata-format requires an output file")
+	}
+	return nil
+}
+
+func runFetch(cmd *writ.Command, cfg *fetchConfig, positional []string) {
+	if cfg.HelpFlag {
+		cmd.ExitHelp(nil)
+	}
+	err := cfg.validate(positional)
+	if err != nil {
+		cmd.ExitHelp(err)
+	}
+
+	ctx := context.Background()
+	client := tivo.NewClient(positional[0], cfg.AccessKey)
+	client.TransportStream = cfg.TS
+	recordings, err := client.NowPlaying(ctx)
+	check(err)
+	if len(positional) == 1 {
+		if cfg.JSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			check(enc.Encode(newFetchRecordings(recordings)))
+		} else {
+			check(writeRecordings(os.Stdout, recordings))
+		}
+		return
+	}
+
+	var rec *tivo.Recording
+	for i := range recordings {
+		if recordings[i].ID == positional[1] {
+			rec = &recordings[i]
+		}
+	}
+	if rec == nil {
+		check(fmt.Errorf("no recording with ID %s", positional[1]))
+	}
+	if rec.CopyProtected {
+		check(fmt.Errorf("%s is copy protected and can't be downloaded", rec.Title))
+	}
+	if rec.InProgress {
+		fmt.Fprintf(os.Stderr, "Warning: %s is still recording; the download will be incomplete\n", rec.Title)
+	}
+	check(downloadRecording(ctx, client, rec, cfg))
+}
+
+// downloadRecording downloads rec and decrypts it as it arrives.  File output is
+// written to a partial file that's renamed into place once complete.
+func downloadRecording(ctx context.Context, client *tivo.Client, rec *tivo.Recording, cfg *fetchConfig) (err error) {
+	body, err := client.Download(ctx, rec.URL)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	// The header is buffered while reading metadata so that it can be replayed for decryption
+	var input io.Reader = body
+	formats, _ := parseMetadataFormats(cfg.MetaFormat)
+	var meta *devo.Metadata
+	if len(formats) != 0 {
+		header := &bytes.Buffer{}
+		meta, err = devo.ReadMetadata(io.TeeReader(body, header), cfg.AccessKey)
+		if err != nil {
+			return err
+		}
+		input = io.MultiReader(header, body)
+	}
+
+	output := os.Stdout
+	if cfg.Output != "-" {
+		output, err = os.Create(partialPath(cfg.Output))
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				os.Remove(output.Name())
+			}
+		}()
+	}
+
+	var stats devo.Stats
+	opts := &devo.Options{
+		Lenient:  cfg.Lenient,
+		Progress: func(s devo.Stats) { stats = s },
+	}
+	err = devo.DecryptContext(ctx, output, input, cfg.AccessKey, opts)
+	if cfg.Output == "-" {
+		return err
+	}
+	if cerr := output.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(output.Name(), cfg.Output)
+	}
+	if err != nil {
+		return err
+	}
+	if stats.Dropped != 0 {
+		fmt.Fprintf(os.Stderr, "Warning: skipped %d bytes of corrupt input\n", stats.Dropped)
+	}
+	if stats.BadTables != 0 {
+		fmt.Fprintf(os.Stderr, "Warning: discarded %d damaged mpeg-ts tables\n", stats.BadTables)
+	}
+	if meta != nil {
+		return writeSidecars(cfg.Output, meta.Details, formats)
+	}
+	return nil
+}
+
+func newFetchRecordings(recordings []tivo.Recording) []fetchRecording {
+	list := []fetchRecording{}
+	for _, rec := range recordings {
+		r := fetchRecording{
+			ID:            rec.ID,
+			Title:         rec.Title,
+			EpisodeTitle:  rec.EpisodeTitle,
+			Description:   rec.Description,
+			Channel:       rec.Channel,
+			Station:       rec.Station,
+			Duration:      rec.Duration.Seconds(),
+			Size:          rec.Size,
+			InProgress:    rec.InProgress,
+			CopyProtected: rec.CopyProtected,
+			URL:           rec.URL,
+		}
+		if !rec.Captured.IsZero() {
+			r.Captured = rec.Captured.Format(time.RFC3339)
+		}
+		list = append(list, r)
+	}
+	return list
+}
+
+func writeRecordings(w io.Writer, recordings []tivo.Recording) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "ID\tRecorded\tDuration\tSize\tTitle\n")
+	for _, rec := range recordings {
+		title := rec.Title
+		if rec.EpisodeTitle != "" {
+			title += " - " + rec.EpisodeTitle
+		}
+		if rec.CopyProtected {
+			title += " (copy protected)"
+		} else if rec.InProgress {
+			title += " (recording)"
+		}
+		recorded := "-"
+		if !rec.Captured.IsZero() {
+			recorded = rec.Captured.Local().Format("2006-01-02 15:04")
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%.1f GB\t%s\n", rec.ID, recorded, rec.Duration.Round(time.Minute), float64(rec.Size)/1e9, title)
+	}
+	return tw.Flush()
+}
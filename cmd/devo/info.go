@@ -0,0 +1,224 @@
+// Copyright (c) 2016 Bob Ziuchkovski
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/bobziuchkovski/devo"
+	"github.com/bobziuchkovski/writ"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const infoUsage = "Usage: devo info [OPTION]... FILE"
+
+type infoConfig struct {
+	AccessKey string `option:"m, mak" placeholder:"MAK" description:"Decrypt and display the show metadata using this media access key"`
+	JSON      bool   `flag:"json" description:"Display the report as json"`
+	HelpFlag  bool   `flag:"h, help" description:"Display this help text and exit"`
+}
+
+// Descriptions of common mpeg-ts stream types, keyed by program map stream type
+var streamTypes = map[uint8]string{
+	0x01: "mpeg-1 video",
+	0x02: "mpeg-2 video",
+	0x03: "mpeg-1 audio",
+	0x04: "mpeg-2 audio",
+	0x06: "private PES data",
+	0x0f: "aac audio",
+	0x1b: "h.264 video",
+	0x24: "h.265 video",
+	0x81: "ac-3 audio",
+	0x87: "e-ac-3 audio",
+	0x97: "tivo private data",
+}
+
+func streamTypeName(streamType uint8) string {
+	name, ok := streamTypes[streamType]
+	if !ok {
+		return "unknown"
+	}
+	return name
+}
+
+type infoReport struct {
+	File        string        `json:"file"`
+	Format      string        `json:"format"`
+	Flags       uint16        `json:"flags"`
+	VideoOffset int64         `json:"videoOffset"`
+	Chunks      []infoChunk   `json:"chunks"`
+	Programs    []infoProgram `json:"programs,omitempty"`
+	Details     *jsonDetails  `json:"details,omitempty"`
+}
+
+type infoChunk struct {
+	ID   uint16 `json:"id"`
+	Type string `json:"type"`
+	Size int    `json:"size"`
+}
+
+type infoProgram struct {
+	Number     uint16       `json:"number"`
+	PMTPID     int          `json:"pmtPid"`
+	PCRPID     int          `json:"pcrPid"`
+	PrivatePID int          `json:"privatePid"`
+	Streams    []infoStream `json:"streams"`
+}
+
+type infoStream struct {
+	PID         int    `json:"pid"`
+	Type        uint8  `json:"type"`
+	Description string `json:"description"`
+}
+
+func (cfg *infoConfig) validate(positional []string) error {
+	if len(positional) != 1 {
+		return fmt.Errorf("exactly one input file must be specified")
+	}
+	if cfg.AccessKey != "" {
+		return validateAccessKey(cfg.AccessKey)
+	}
+	return nil
+}
+
+func runInfo(cmd *writ.Command, cfg *infoConfig, positional []string) {
+	if cfg.HelpFlag {
+		cmd.ExitHelp(nil)
+	}
+	err := cfg.validate(positional)
+	if err != nil {
+		cmd.ExitHelp(err)
+	}
+
+	input, err := os.Open(positional[0])
+	check(err)
+	defer input.Close()
+	info, err := devo.Inspect(bufio.NewReader(input), cfg.AccessKey)
+	check(err)
+
+	report := newInfoReport(positional[0], info)
+	if cfg.JSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		check(enc.Encode(report))
+		return
+	}
+	check(writeInfoText(os.Stdout, report))
+}
+
+func newInfoReport(file string, info *devo.FileInfo) infoReport {
+	report := infoReport{
+		File:        file,
+		Format:      info.Stream.String(),
+		Flags:       info.Flags,
+		VideoOffset: info.VideoOffset,
+		Chunks:      []infoChunk{},
+	}
+	for _, chunk := range info.Chunks {
+		kind := fmt.Sprintf("unknown (%d)", chunk.Type)
+		switch chunk.Type {
+		case 1:
+			kind = "plaintext"
+		case 2:
+			kind = "encrypted"
+		}
+		report.Chunks = append(report.Chunks, infoChunk{ID: chunk.ID, Type: kind, Size: chunk.Size})
+	}
+	for _, program := range info.Programs {
+		p := infoProgram{
+			Number:     program.Number,
+			PMTPID:     program.PMTPID,
+			PCRPID:     program.PCRPID,
+			PrivatePID: program.PrivatePID,
+			Streams:    []infoStream{},
+		}
+		for _, stream := range program.Streams {
+			p.Streams = append(p.Streams, infoStream{PID: stream.PID, Type: stream.Type, Description: streamTypeName(stream.Type)})
+		}
+		report.Programs = append(report.Programs, p)
+	}
+	if info.Metadata != nil {
+		details := newJSONDetails(info.Metadata.Details)
+		report.Details = &details
+	}
+	return report
+}
+
+func writeInfoText(w io.Writer, report infoReport) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "File:\t%s\n", report.File)
+	fmt.Fprintf(tw, "Format:\t%s\n", report.Format)
+	fmt.Fprintf(tw, "Flags:\t0x%04x\n", report.Flags)
+	fmt.Fprintf(tw, "Video offset:\t0x%08x (%d)\n", report.VideoOffset, report.VideoOffset)
+
+	fmt.Fprintf(tw, "\nMetadata chunks:\n")
+	fmt.Fprintf(tw, "  ID\tType\tSize\n")
+	for _, chunk := range report.Chunks {
+		fmt.Fprintf(tw, "  %d\t%s\t%d\n", chunk.ID, chunk.Type, chunk.Size)
+	}
+
+	for _, program := range report.Programs {
+		fmt.Fprintf(tw, "\nProgram %d:\n", program.Number)
+		fmt.Fprintf(tw, "  PMT PID:\t%s\n", formatPID(program.PMTPID))
+		fmt.Fprintf(tw, "  PCR PID:\t%s\n", formatPID(program.PCRPID))
+		fmt.Fprintf(tw, "  Private data PID:\t%s\n", formatPID(program.PrivatePID))
+		fmt.Fprintf(tw, "  Streams:\n")
+		fmt.Fprintf(tw, "    PID\tType\tDescription\n")
+		for _, stream := range program.Streams {
+			fmt.Fprintf(tw, "    %s\t0x%02x\t%s\n", formatPID(stream.PID), stream.Type, stream.Description)
+		}
+	}
+
+	if report.Details != nil {
+		details := report.Details
+		fmt.Fprintf(tw, "\nShow:\n")
+		fields := [][2]string{
+			{"Title", details.Title},
+			{"Episode", details.EpisodeTitle},
+			{"Series ID", details.SeriesID},
+			{"Channel", strings.TrimSpace(details.Channel + " " + details.Callsign)},
+		}
+		for _, field := range fields {
+			if field[1] != "" {
+				fmt.Fprintf(tw, "  %s:\t%s\n", field[0], field[1])
+			}
+		}
+		if !details.RecordDate.IsZero() {
+			fmt.Fprintf(tw, "  Recorded:\t%s\n", details.RecordDate.Format("2006-01-02 15:04:05 MST"))
+		}
+		if details.Duration != 0 {
+			fmt.Fprintf(tw, "  Duration:\t%s\n", time.Duration(details.Duration*float64(time.Second)))
+		}
+	}
+	return tw.Flush()
+}
+
+func formatPID(pid int) string {
+	if pid < 0 {
+		return "none"
+	}
+	return fmt.Sprintf("0x%04x", pid)
+}
@@ -1,5 +1,3 @@
-// +build go1.5
-
 // Copyright (c) 2016 Bob Ziuchkovski
 //
 // Permission is hereby granted, free of charge, to any person obtaining a copy
@@ -23,19 +21,26 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"github.com/bobziuchkovski/devo"
 	"github.com/bobziuchkovski/writ"
 	"io"
+	"io/ioutil"
 	"os"
 	"regexp"
 	"runtime"
 	"runtime/pprof"
 	"runtime/trace"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
 )
 
 const (
-	usage  = "Usage: devo [OPTION]..."
+	usage  = "Usage: devo [OPTION]...\n   or: devo COMMAND [OPTION]... [ARG]..."
 	header = `
 DeVo decrypts TiVo recordings.  It is intended for personal/educational use only.
 Decrypted files must NOT be distributed.  Piracy is NOT condoned!`
@@ -44,25 +49,111 @@ Decrypted files must NOT be distributed.  Piracy is NOT condoned!`
 
 type config struct {
 	Input         io.Reader      `option:"i, input" placeholder:"FILE" description:"The encrypted input TiVo file"`
-	Output        io.WriteCloser `option:"o, output" placeholder:"FILE" description:"The decrypted output video file"`
+	Output        string         `option:"o, output" placeholder:"FILE" description:"The decrypted output video file"`
 	TraceOutput   io.WriteCloser `option:"t, trace"`
 	ProfileOutput io.WriteCloser `option:"p, profile"`
 	AccessKey     string         `option:"m, mak" placeholder:"MAK" description:"The 10-digit media access key (MAK) from your TiVo"`
+	MetaFormat    string         `option:"metadata-format" placeholder:"FORMAT" description:"Write show metadata sidecars next to the output (txt, nfo, json, or a comma-separated list)"`
+	Index         bool           `flag:"index" description:"Write a .devoidx seek index sidecar next to the output"`
+	Start         string         `option:"start" placeholder:"TIME" description:"Start the output at the keyframe at or before TIME, e.g. 00:12:30"`
+	End           string         `option:"end" placeholder:"TIME" description:"End the output ahead of the first keyframe at or after TIME"`
+	CutList       string         `option:"cut-list" placeholder:"FILE" description:"Drop the segments listed in FILE, a comskip .edl or json cut list"`
+	Lenient       bool           `flag:"lenient" description:"Skip past corrupt or truncated input rather than failing"`
+	Parallel      int            `option:"parallel" placeholder:"N" description:"Decrypt mpeg-ts input using N goroutines"`
 	HelpFlag      bool           `flag:"h, help" description:"Display this help text and exit"`
 	VersionFlag   bool           `flag:"version" description:"Display version information and exit"`
+
+	Info    infoConfig    `command:"info" description:"Describe the layout and metadata of a TiVo file"`
+	Analyze analyzeConfig `command:"analyze" description:"Report the codecs, timing, and glitches of each stream in a video"`
+	Batch   batchConfig   `command:"batch" description:"Decrypt every TiVo file in a directory"`
+	Watch   watchConfig   `command:"watch" description:"Watch a directory and decrypt new TiVo files as they finish downloading"`
+	Serve   serveConfig   `command:"serve" description:"Stream decrypted video over HTTP"`
+	Fetch   fetchConfig   `command:"fetch" description:"List the recordings on a TiVo or download and decrypt one"`
 }
 
 func (cfg config) validate() error {
 	if cfg.Input == nil {
 		return fmt.Errorf("-i/--input must be specified")
 	}
-	if cfg.Output == nil {
+	if cfg.Output == "" {
 		return fmt.Errorf("-o/--output must be specified")
 	}
 	if cfg.AccessKey == "" {
 		return fmt.Errorf("-m/--mak is required")
 	}
-	if !regexp.MustCompile("^\\d{10}$").MatchString(cfg.AccessKey) {
+	err := validateAccessKey(cfg.AccessKey)
+	if err != nil {
+		return err
+	}
+	formats, err := parseMetadataFormats(cfg.MetaFormat)
+	if err != nil {
+		return fmt.Errorf("--metadata-format: %s", err)
+	}
+	if len(formats) != 0 && cfg.Output == "-" {
+		return fmt.Errorf("--metadata-format requires an output file")
+	}
+	if cfg.Index && cfg.Output == "-" {
+		return fmt.Errorf("--index requires an output file")
+	}
+	if cfg.Parallel < 0 {
+		return fmt.Errorf("--parallel must not be negative")
+	}
+	start, err := parseTimestamp(cfg.Start)
+	if err != nil {
+		return fmt.Errorf("--start: %s", err)
+	}
+	end, err := parseTimestamp(cfg.End)
+	if err != nil {
+		return fmt.Errorf("--end: %s", err)
+	}
+	if end != 0 && end <= start {
+		return fmt.Errorf("--end must be after --start")
+	}
+	if cfg.Index && (start != 0 || end != 0) {
+		return fmt.Errorf("--index can't be combined with --start or --end")
+	}
+	if cfg.Index && cfg.CutList != "" {
+		return fmt.Errorf("--index can't be combined with --cut-list")
+	}
+	return nil
+}
+
+// parseTimestamp parses a --start or --end value, given as [[HH:]MM:]SS[.FRAC]
+// or as a duration such as 90s.  An empty value is zero.
+func parseTimestamp(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	if strings.IndexFunc(value, unicode.IsLetter) >= 0 {
+		d, err := time.ParseDuration(value)
+		if err == nil && d < 0 {
+			err = fmt.Errorf("negative time %q", value)
+		}
+		return d, err
+	}
+
+	fields := strings.Split(value, ":")
+	if len(fields) > 3 {
+		return 0, fmt.Errorf("invalid time %q (expected HH:MM:SS)", value)
+	}
+	seconds, err := strconv.ParseFloat(fields[len(fields)-1], 64)
+	if err != nil || seconds < 0 || (len(fields) > 1 && seconds >= 60) {
+		return 0, fmt.Errorf("invalid time %q (expected HH:MM:SS)", value)
+	}
+	d := time.Duration(seconds * float64(time.Second))
+	for i, unit := range []time.Duration{time.Minute, time.Hour}[:len(fields)-1] {
+		n, err := strconv.Atoi(fields[len(fields)-2-i])
+		if err != nil || n < 0 || (unit == time.Minute && len(fields) == 3 && n >= 60) {
+			return 0, fmt.Errorf("invalid time %q (expected HH:MM:SS)", value)
+		}
+		d += time.Duration(n) * unit
+	}
+	return d, nil
+}
+
+// validateAccessKey checks the format of a --mak value
+func validateAccessKey(mak string) error {
+	if !regexp.MustCompile("^\\d{10}$").MatchString(mak) {
 		return fmt.Errorf("-m/--mak must be a 10 digit value")
 	}
 	return nil
@@ -74,10 +165,38 @@ func main() {
 	cmd.Help.Usage = usage
 	cmd.Help.Header = header
 	cmd.Help.Footer = footer
-	_, positional, err := cmd.Decode(os.Args[1:])
+	cmd.Subcommand("info").Help.Usage = infoUsage
+	cmd.Subcommand("analyze").Help.Usage = analyzeUsage
+	cmd.Subcommand("batch").Help.Usage = batchUsage
+	cmd.Subcommand("watch").Help.Usage = watchUsage
+	cmd.Subcommand("serve").Help.Usage = serveUsage
+	cmd.Subcommand("fetch").Help.Usage = fetchUsage
+	path, positional, err := cmd.Decode(os.Args[1:])
+	if err != nil {
+		path.Last().ExitHelp(err)
+	}
 
-	if err != nil || cfg.HelpFlag {
-		cmd.ExitHelp(err)
+	switch path.String() {
+	case "devo info":
+		runInfo(path.Last(), &cfg.Info, positional)
+	case "devo analyze":
+		runAnalyze(path.Last(), &cfg.Analyze, positional)
+	case "devo batch":
+		runBatch(path.Last(), &cfg.Batch, positional)
+	case "devo watch":
+		runWatch(path.Last(), &cfg.Watch, positional)
+	case "devo serve":
+		runServe(path.Last(), &cfg.Serve, positional)
+	case "devo fetch":
+		runFetch(path.Last(), &cfg.Fetch, positional)
+	default:
+		runDecrypt(cmd, cfg, positional)
+	}
+}
+
+func runDecrypt(cmd *writ.Command, cfg *config, positional []string) {
+	if cfg.HelpFlag {
+		cmd.ExitHelp(nil)
 	}
 	if cfg.VersionFlag {
 		fmt.Fprintf(os.Stdout, "DeVo version %d.%d.%d\nCompiled with %s\n", devo.Version.Major, devo.Version.Minor, devo.Version.Patch, runtime.Version())
@@ -86,10 +205,14 @@ func main() {
 	if len(positional) != 0 {
 		cmd.ExitHelp(fmt.Errorf("too many arguments provided"))
 	}
-	err = cfg.validate()
+	err := cfg.validate()
 	if err != nil {
 		cmd.ExitHelp(err)
 	}
+	cuts, err := readCutList(cfg.CutList)
+	if err != nil {
+		cmd.ExitHelp(fmt.Errorf("--cut-list: %s", err))
+	}
 
 	if cfg.TraceOutput != nil {
 		defer cfg.TraceOutput.Close()
@@ -105,8 +228,50 @@ func main() {
 		defer pprof.StopCPUProfile()
 	}
 
-	defer cfg.Output.Close()
-	check(devo.Decrypt(cfg.Output, cfg.Input, cfg.AccessKey))
+	output := os.Stdout
+	if cfg.Output != "-" {
+		output, err = os.Create(cfg.Output)
+		check(err)
+	}
+	defer output.Close()
+
+	// The header is buffered while reading metadata so that it can be replayed for decryption
+	input := cfg.Input
+	formats, _ := parseMetadataFormats(cfg.MetaFormat)
+	var meta *devo.Metadata
+	if len(formats) != 0 {
+		header := &bytes.Buffer{}
+		meta, err = devo.ReadMetadata(io.TeeReader(cfg.Input, header), cfg.AccessKey)
+		check(err)
+		input = io.MultiReader(header, cfg.Input)
+	}
+
+	var stats devo.Stats
+	opts := &devo.Options{
+		Lenient:  cfg.Lenient,
+		Parallel: cfg.Parallel,
+		Progress: func(s devo.Stats) { stats = s },
+	}
+	var index bytes.Buffer
+	if cfg.Index {
+		opts.Index = &index
+	}
+	opts.Start, _ = parseTimestamp(cfg.Start)
+	opts.End, _ = parseTimestamp(cfg.End)
+	opts.Cuts = cuts
+	check(devo.DecryptContext(context.Background(), output, input, cfg.AccessKey, opts))
+	if stats.Dropped != 0 {
+		fmt.Fprintf(os.Stderr, "Warning: skipped %d bytes of corrupt input\n", stats.Dropped)
+	}
+	if stats.BadTables != 0 {
+		fmt.Fprintf(os.Stderr, "Warning: discarded %d damaged mpeg-ts tables\n", stats.BadTables)
+	}
+	if meta != nil {
+		check(writeSidecars(cfg.Output, meta.Details, formats))
+	}
+	if cfg.Index {
+		check(ioutil.WriteFile(indexSidecarPath(cfg.Output), index.Bytes(), 0644))
+	}
 }
 
 func check(err error) {
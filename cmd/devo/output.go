@@ -0,0 +1,310 @@
+// Copyright (c) 2016 Bob Ziuchkovski
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/bobziuchkovski/devo"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	defaultNameTemplate = "{{.Base}}{{.Ext}}"
+	defaultStateFile    = ".devo-state.json"
+)
+
+// outputName holds the fields available to output path templates
+type outputName struct {
+	devo.VideoDetails
+	Base string // Input file name without its extension
+	Ext  string // ".mpg" for mpeg-ps video or ".ts" for mpeg-ts video
+}
+
+func parseNameTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		text = defaultNameTemplate
+	}
+	return template.New("name").Parse(text)
+}
+
+// fileDecryptor decrypts TiVo files into an output directory, naming the output
+// from a template.  It's safe for concurrent use.
+type fileDecryptor struct {
+	mak     string
+	outDir  string
+	name    *template.Template
+	formats []string
+	lenient bool
+
+	mu      sync.Mutex
+	claimed map[string]string // Output path -> input path, for outputs in progress
+}
+
+func newFileDecryptor(mak, outDir, name, metaFormat string, lenient bool) (*fileDecryptor, error) {
+	tmpl, err := parseNameTemplate(name)
+	if err != nil {
+		return nil, err
+	}
+	formats, err := parseMetadataFormats(metaFormat)
+	if err != nil {
+		return nil, err
+	}
+	return &fileDecryptor{
+		mak:     mak,
+		outDir:  outDir,
+		name:    tmpl,
+		formats: formats,
+		lenient: lenient,
+		claimed: make(map[string]string),
+	}, nil
+}
+
+// decrypt decrypts input, returning the output path.  Output is written to a
+// hidden partial file that's renamed into place once decryption succeeds, so
+// partial output is never left under the final name.  The partial file name is
+// fixed, so output left behind by an interrupted run is replaced on the next.
+func (d *fileDecryptor) decrypt(ctx context.Context, input string) (output string, err error) {
+	file, err := os.Open(input)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	info, err := devo.Inspect(bufio.NewReader(file), d.mak)
+	if err != nil {
+		return "", err
+	}
+	output, err = d.outputPath(input, info)
+	if err != nil {
+		return "", err
+	}
+	err = d.claim(output, input)
+	if err != nil {
+		return "", err
+	}
+	defer d.release(output)
+
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+	err = os.MkdirAll(filepath.Dir(output), 0755)
+	if err != nil {
+		return "", err
+	}
+	tmp, err := os.Create(partialPath(output))
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	err = devo.DecryptContext(ctx, tmp, file, d.mak, &devo.Options{Lenient: d.lenient})
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), output)
+	}
+	if err == nil && len(d.formats) != 0 {
+		err = writeSidecars(output, info.Metadata.Details, d.formats)
+	}
+	if err != nil {
+		return "", err
+	}
+	return output, nil
+}
+
+// outputPath expands the name template for input.  Each element of the expanded
+// path is sanitized, so the output can't escape the output directory.
+func (d *fileDecryptor) outputPath(input string, info *devo.FileInfo) (string, error) {
+	base := filepath.Base(input)
+	name := outputName{Base: strings.TrimSuffix(base, filepath.Ext(base)), Ext: ".mpg"}
+	if info.Stream == devo.StreamTS {
+		name.Ext = ".ts"
+	}
+	if info.Metadata != nil {
+		name.VideoDetails = info.Metadata.Details
+	}
+
+	// Path separators within field values would otherwise create directories
+	for _, field := range []*string{&name.Base, &name.Title, &name.EpisodeTitle, &name.SeriesID, &name.Channel, &name.Callsign, &name.Description} {
+		*field = strings.NewReplacer("/", "-", "\\", "-").Replace(*field)
+	}
+
+	var buf bytes.Buffer
+	err := d.name.Execute(&buf, name)
+	if err != nil {
+		return "", err
+	}
+	var elements []string
+	for _, element := range strings.Split(filepath.ToSlash(buf.String()), "/") {
+		element = sanitizePathElement(element)
+		if element != "" {
+			elements = append(elements, element)
+		}
+	}
+	if len(elements) == 0 {
+		elements = []string{name.Base + name.Ext}
+	}
+	return filepath.Join(append([]string{d.outDir}, elements...)...), nil
+}
+
+// partialPath returns the path used for output while it's being written
+func partialPath(output string) string {
+	return filepath.Join(filepath.Dir(output), "."+filepath.Base(output)+".partial")
+}
+
+// sanitizePathElement replaces characters that are invalid in file names on
+// common filesystems and strips leading/trailing dots and spaces
+func sanitizePathElement(element string) string {
+	element = strings.Map(func(r rune) rune {
+		if r < 0x20 || strings.ContainsRune(`<>:"\|?*`, r) {
+			return '_'
+		}
+		return r
+	}, element)
+	return strings.Trim(element, ". ")
+}
+
+func (d *fileDecryptor) claim(output, input string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if other, ok := d.claimed[output]; ok {
+		return fmt.Errorf("output %s is already being written for %s", output, filepath.Base(other))
+	}
+	d.claimed[output] = input
+	return nil
+}
+
+func (d *fileDecryptor) release(output string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.claimed, output)
+}
+
+// stateFile records the input files that have been decrypted.  Files are
+// identified by absolute path, size, and modification time, so a replaced or
+// re-downloaded file is decrypted again.  It's safe for concurrent use.
+type stateFile struct {
+	path  string
+	mu    sync.Mutex
+	Files map[string]stateEntry `json:"files"`
+}
+
+type stateEntry struct {
+	Size      int64     `json:"size"`
+	ModTime   time.Time `json:"modTime"`
+	Output    string    `json:"output"`
+	Completed time.Time `json:"completed"`
+}
+
+// loadState reads the state from path.  A missing file yields an empty state.
+func loadState(path string) (*stateFile, error) {
+	state := &stateFile{path: path, Files: make(map[string]stateEntry)}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, state)
+	if err != nil {
+		return nil, fmt.Errorf("corrupt state file %s: %s", path, err)
+	}
+	if state.Files == nil {
+		state.Files = make(map[string]stateEntry)
+	}
+	return state, nil
+}
+
+// completed reports whether input was decrypted previously and its output
+// still exists, returning the output path
+func (s *stateFile) completed(input string, info os.FileInfo) (string, bool) {
+	key, err := filepath.Abs(input)
+	if err != nil {
+		return "", false
+	}
+	s.mu.Lock()
+	entry, ok := s.Files[key]
+	s.mu.Unlock()
+	if !ok || entry.Size != info.Size() || !entry.ModTime.Equal(info.ModTime()) {
+		return "", false
+	}
+	if _, err := os.Stat(entry.Output); err != nil {
+		return "", false
+	}
+	return entry.Output, true
+}
+
+// record marks input as decrypted to output and saves the state
+func (s *stateFile) record(input string, info os.FileInfo, output string) error {
+	key, err := filepath.Abs(input)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Files[key] = stateEntry{Size: info.Size(), ModTime: info.ModTime(), Output: output, Completed: time.Now()}
+	return s.save()
+}
+
+// save writes the state to a temporary file and renames it into place, so a
+// crash never leaves a partially written state file.  s.mu must be held.
+func (s *stateFile) save() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(s.path), 0755)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), "."+filepath.Base(s.path)+".")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
@@ -0,0 +1,454 @@
+// Copyright (c) 2016 Bob Ziuchkovski
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/bobziuchkovski/devo"
+	"github.com/bobziuchkovski/devo/tivo"
+	"github.com/bobziuchkovski/writ"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	serveUsage          = "Usage: devo serve [OPTION]..."
+	defaultListenAddr   = "localhost:8080"
+	defaultServeSession = 4
+)
+
+type serveConfig struct {
+	Listen      string            `option:"listen" placeholder:"ADDR" description:"Listen for HTTP requests on ADDR (default localhost:8080)"`
+	AccessKey   string            `option:"m, mak" placeholder:"MAK" description:"The media access key (MAK) for local files"`
+	Devices     map[string]string `option:"device" placeholder:"HOST=MAK" description:"Allow streaming from the upstream device HOST, using its media access key; may be repeated"`
+	Root        string            `option:"root" placeholder:"DIR" description:"Serve local TiVo files from DIR"`
+	IndexDir    string            `option:"index-dir" placeholder:"DIR" description:"Cache the seek indexes of local files in DIR (default: a devo directory in the user cache directory)"`
+	MaxSessions int               `option:"max-sessions" placeholder:"N" description:"Decrypt at most N streams at once (default 4)"`
+	Lenient     bool              `flag:"lenient" description:"Skip past corrupt or truncated input rather than failing; disables seeking in local files"`
+	HelpFlag    bool              `flag:"h, help" description:"Display this help text and exit"`
+}
+
+func (cfg *serveConfig) validate(positional []string) error {
+	if len(positional) != 0 {
+		return fmt.Errorf("too many arguments provided")
+	}
+	if cfg.AccessKey == "" && len(cfg.Devices) == 0 {
+		return fmt.Errorf("-m/--mak or --device is required")
+	}
+	if cfg.AccessKey != "" {
+		err := validateAccessKey(cfg.AccessKey)
+		if err != nil {
+			return err
+		}
+	}
+	for host, mak := range cfg.Devices {
+		if host == "" || validateAccessKey(mak) != nil {
+			return fmt.Errorf("--device must be of the form HOST=MAK, with a 10 digit MAK")
+		}
+	}
+	if cfg.Root != "" && cfg.AccessKey == "" {
+		return fmt.Errorf("--root requires -m/--mak")
+	}
+	if cfg.MaxSessions < 0 {
+		return fmt.Errorf("--max-sessions must not be negative")
+	}
+	return nil
+}
+
+func runServe(cmd *writ.Command, cfg *serveConfig, positional []string) {
+	if cfg.HelpFlag {
+		cmd.ExitHelp(nil)
+	}
+	err := cfg.validate(positional)
+	if err != nil {
+		cmd.ExitHelp(err)
+	}
+
+	addr := cfg.Listen
+	if addr == "" {
+		addr = defaultListenAddr
+	}
+	sessions := cfg.MaxSessions
+	if sessions == 0 {
+		sessions = defaultServeSession
+	}
+	indexDir := cfg.IndexDir
+	if indexDir == "" {
+		if cacheDir, err := os.UserCacheDir(); err == nil {
+			indexDir = filepath.Join(cacheDir, "devo")
+		}
+	}
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+	srv := &server{
+		mak:      cfg.AccessKey,
+		devices:  cfg.Devices,
+		root:     cfg.Root,
+		indexDir: indexDir,
+		lenient:  cfg.Lenient,
+		clients:  make(map[string]*tivo.Client),
+		indexes:  &indexCache{entries: make(map[string]*indexEntry)},
+		sessions: make(chan struct{}, sessions),
+		log:      logger,
+	}
+	logger.Printf("Listening on %s", addr)
+	check(http.ListenAndServe(addr, srv))
+}
+
+// server decrypts TiVo files on request.  GET /decrypt?src=SRC streams the
+// decrypted video for SRC, which is either an http(s) URL on a listed upstream
+// device or a path relative to the root directory.  Local files support Range
+// requests, so players can seek.
+type server struct {
+	mak      string
+	devices  map[string]string // Upstream host -> mak
+	root     string
+	indexDir string      // Directory caching the seek indexes of local files, or ""
+	indexes  *indexCache // Seek indexes of local files held in memory
+	lenient  bool
+	sessions chan struct{} // Semaphore bounding concurrent decryption
+	log      *log.Logger
+
+	mu      sync.Mutex
+	clients map[string]*tivo.Client // Upstream url scheme and host -> client
+}
+
+// statusError is an error with a corresponding HTTP status
+type statusError struct {
+	status int
+	err    error
+}
+
+func (e *statusError) Error() string {
+	return e.err.Error()
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/decrypt" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	src := r.URL.Query().Get("src")
+	if src == "" {
+		http.Error(w, "missing src parameter", http.StatusBadRequest)
+		return
+	}
+
+	select {
+	case s.sessions <- struct{}{}:
+		defer func() { <-s.sessions }()
+	default:
+		w.Header().Set("Retry-After", "10")
+		http.Error(w, "too many sessions", http.StatusServiceUnavailable)
+		return
+	}
+
+	u, err := url.Parse(src)
+	if err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		err = s.streamURL(w, r, src, u)
+	} else if s.lenient {
+		err = s.streamFile(w, r, src)
+	} else {
+		err = s.serveFile(w, r, src)
+	}
+	if err != nil {
+		status := http.StatusInternalServerError
+		var serr *statusError
+		switch {
+		case errors.As(err, &serr):
+			status = serr.status
+		case errors.Is(err, devo.ErrBadAccessKey):
+			status = http.StatusForbidden
+		case errors.Is(err, devo.ErrNotTiVo), errors.Is(err, devo.ErrCorrupt), errors.Is(err, devo.ErrUnsupported):
+			status = http.StatusUnprocessableEntity
+		}
+		s.log.Printf("Failed to stream %s to %s: %s", src, r.RemoteAddr, err)
+		http.Error(w, err.Error(), status)
+	}
+}
+
+// serveFile serves the decrypted video of a local file, including Range requests.
+// Errors are only returned if nothing has been sent.
+func (s *server) serveFile(w http.ResponseWriter, r *http.Request, src string) error {
+	name, err := s.localPath(src)
+	if err != nil {
+		return err
+	}
+	file, err := openLocal(name, src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	// Indexes are kept in memory, as each request has its own Seeker.  Failing
+	// that, an index sidecar written alongside a decrypted copy saves building one.
+	opts := &devo.SeekerOptions{
+		IndexPath: s.indexPath(name),
+		IndexFunc: func(load func() (*devo.Index, error)) (*devo.Index, error) {
+			return s.indexes.load(r.Context(), name, info, load)
+		},
+	}
+	if idx, err := devo.LoadIndex(indexSidecarPath(name)); err == nil {
+		opts.Index = idx
+	}
+	seeker, err := devo.NewSeeker(&contextFile{File: file, ctx: r.Context()}, s.mak, opts)
+	if err != nil {
+		return err
+	}
+
+	s.log.Printf("Serving %s to %s", src, r.RemoteAddr)
+	w.Header().Set("Content-Type", contentType(seeker.Stream()))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, "", info.ModTime(), seeker)
+	return nil
+}
+
+// streamFile streams the decrypted video of a local file from start to finish.
+// Errors are only returned if nothing has been sent.
+func (s *server) streamFile(w http.ResponseWriter, r *http.Request, src string) error {
+	name, err := s.localPath(src)
+	if err != nil {
+		return err
+	}
+	file, err := openLocal(name, src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return s.stream(w, r, src, file, s.mak)
+}
+
+// streamURL streams the decrypted video downloaded from u.  Errors are only
+// returned if nothing has been sent.
+func (s *server) streamURL(w http.ResponseWriter, r *http.Request, src string, u *url.URL) error {
+	body, mak, err := s.openURL(r, u)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	return s.stream(w, r, src, body, mak)
+}
+
+func (s *server) stream(w http.ResponseWriter, r *http.Request, src string, input io.Reader, mak string) error {
+	s.log.Printf("Streaming %s to %s", src, r.RemoteAddr)
+	out := &streamWriter{w: w}
+	err := devo.DecryptContext(r.Context(), out, bufio.NewReader(input), mak, &devo.Options{Lenient: s.lenient})
+	if out.started {
+		// The status has been sent, so all that's left is to log the outcome
+		if err != nil {
+			s.log.Printf("Stopped streaming %s to %s: %s", src, r.RemoteAddr, err)
+		}
+		return nil
+	}
+	return err
+}
+
+// localPath returns the path of src within the root directory
+func (s *server) localPath(src string) (string, error) {
+	if s.root == "" {
+		return "", &statusError{http.StatusBadRequest, fmt.Errorf("src must be an http(s) url")}
+	}
+
+	// Cleaning the path relative to "/" prevents escaping the root directory
+	name := filepath.Join(s.root, filepath.FromSlash(path.Clean("/"+src)))
+	if !strings.EqualFold(filepath.Ext(name), ".tivo") {
+		return "", &statusError{http.StatusBadRequest, fmt.Errorf("src must be a .TiVo file")}
+	}
+	return name, nil
+}
+
+func openLocal(name, src string) (*os.File, error) {
+	file, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil, &statusError{http.StatusNotFound, fmt.Errorf("%s not found", src)}
+	}
+	return file, err
+}
+
+// indexPath returns the path of the cached seek index for the local file name,
+// or "" if indexes aren't cached
+func (s *server) indexPath(name string) string {
+	if s.indexDir == "" {
+		return ""
+	}
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return ""
+	}
+	sum := sha1.Sum([]byte(abs))
+	return filepath.Join(s.indexDir, hex.EncodeToString(sum[:])+".devoidx")
+}
+
+// contextFile fails reads once ctx is done, so that decryption on behalf of a
+// request, including building a seek index, stops when the client goes away
+type contextFile struct {
+	*os.File
+	ctx context.Context
+}
+
+func (f *contextFile) Read(p []byte) (int, error) {
+	err := f.ctx.Err()
+	if err != nil {
+		return 0, err
+	}
+	return f.File.Read(p)
+}
+
+// indexCache holds the seek indexes of local files in memory.  Each index is
+// loaded or built once while its file is unchanged, with concurrent requests for
+// the same file waiting on the first.  If the request building an index goes
+// away, a waiting request takes over.
+type indexCache struct {
+	mu      sync.Mutex
+	entries map[string]*indexEntry // Local path -> latest index
+}
+
+type indexEntry struct {
+	modTime time.Time
+	size    int64
+	done    chan struct{} // Closed once index and err are set
+	index   *devo.Index
+	err     error
+	gone    bool // The request building the index went away
+}
+
+// load returns the index of the local file name, calling load if it isn't held
+// or the file has changed since.  load is expected to stop once ctx is done.
+func (c *indexCache) load(ctx context.Context, name string, info os.FileInfo, load func() (*devo.Index, error)) (*devo.Index, error) {
+	c.mu.Lock()
+	for {
+		entry := c.entries[name]
+		if entry == nil || !entry.modTime.Equal(info.ModTime()) || entry.size != info.Size() {
+			break
+		}
+		c.mu.Unlock()
+		select {
+		case <-entry.done:
+			if !entry.gone {
+				return entry.index, entry.err
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		c.mu.Lock()
+	}
+	entry := &indexEntry{modTime: info.ModTime(), size: info.Size(), done: make(chan struct{})}
+	c.entries[name] = entry
+	c.mu.Unlock()
+
+	entry.index, entry.err = load()
+	if entry.err != nil {
+		// Failures aren't kept, so later requests try again.  Requests waiting
+		// on one that went away try straight away.
+		entry.gone = ctx.Err() != nil
+		c.mu.Lock()
+		if c.entries[name] == entry {
+			delete(c.entries, name)
+		}
+		c.mu.Unlock()
+	}
+	close(entry.done)
+	return entry.index, entry.err
+}
+
+func contentType(stream devo.StreamType) string {
+	if stream == devo.StreamTS {
+		return "video/mp2t"
+	}
+	return "video/mpeg"
+}
+
+// openURL requests u from its upstream device, authenticating as a TiVo would
+// expect.  Only devices listed with --device are contacted: the digest response
+// sent to a host reveals enough to recover the mak by brute force, so neither it
+// nor the --mak for local files may be offered to arbitrary hosts.
+func (s *server) openURL(r *http.Request, u *url.URL) (io.ReadCloser, string, error) {
+	mak, ok := s.devices[u.Host]
+	if !ok {
+		mak, ok = s.devices[u.Hostname()]
+	}
+	if !ok {
+		return nil, "", &statusError{http.StatusForbidden, fmt.Errorf("%s is not a listed upstream device", u.Host)}
+	}
+
+	body, err := s.client(u, mak).Download(r.Context(), u.String())
+	if err != nil {
+		return nil, "", &statusError{http.StatusBadGateway, err}
+	}
+	return body, mak, nil
+}
+
+// client returns the TiVo client for the upstream device serving u.  Clients are
+// reused so that each device's session cookie and digest challenge are retained.
+func (s *server) client(u *url.URL, mak string) *tivo.Client {
+	base := u.Scheme + "://" + u.Host
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	client, ok := s.clients[base]
+	if !ok {
+		client = tivo.NewClient(base, mak)
+		s.clients[base] = client
+	}
+	return client
+}
+
+// streamWriter sends decrypted video to an HTTP client.  The response status
+// and content type are sent with the first write, so errors that occur before
+// any video is decrypted, such as an incorrect mak, can still be reported.  The
+// response has no length, so it's sent with chunked transfer encoding.
+type streamWriter struct {
+	w       http.ResponseWriter
+	started bool
+}
+
+func (sw *streamWriter) Write(p []byte) (int, error) {
+	if !sw.started {
+		sw.started = true
+		stream := devo.StreamPS
+		if len(p) != 0 && p[0] == 0x47 {
+			stream = devo.StreamTS
+		}
+		sw.w.Header().Set("Content-Type", contentType(stream))
+		sw.w.Header().Set("X-Content-Type-Options", "nosniff")
+		sw.w.WriteHeader(http.StatusOK)
+	}
+	return sw.w.Write(p)
+}
@@ -0,0 +1,198 @@
+// Copyright (c) 2016 Bob Ziuchkovski
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/bobziuchkovski/devo"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Sidecar writers keyed by --metadata-format value
+var sidecarFormats = map[string]struct {
+	path  func(video string) string
+	write func(w io.Writer, details devo.VideoDetails) error
+}{
+	"txt":  {path: func(video string) string { return video + ".txt" }, write: writePyTivo},
+	"nfo":  {path: func(video string) string { return trimExt(video) + ".nfo" }, write: writeNFO},
+	"json": {path: func(video string) string { return trimExt(video) + ".json" }, write: writeJSON},
+}
+
+func parseMetadataFormats(value string) ([]string, error) {
+	if value == "" {
+		return nil, nil
+	}
+	var formats []string
+	for _, format := range strings.Split(value, ",") {
+		format = strings.TrimSpace(strings.ToLower(format))
+		if _, ok := sidecarFormats[format]; !ok {
+			return nil, fmt.Errorf("unknown metadata format %q (expected txt, nfo, or json)", format)
+		}
+		formats = append(formats, format)
+	}
+	return formats, nil
+}
+
+func writeSidecars(video string, details devo.VideoDetails, formats []string) error {
+	for _, format := range formats {
+		sidecar := sidecarFormats[format]
+		var buf bytes.Buffer
+		err := sidecar.write(&buf, details)
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(sidecar.path(video), buf.Bytes(), 0644)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexSidecarPath returns the path of the .devoidx index sidecar for video
+func indexSidecarPath(video string) string {
+	return trimExt(video) + ".devoidx"
+}
+
+func trimExt(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path))
+}
+
+// writePyTivo writes pyTivo-style "key : value" metadata
+func writePyTivo(w io.Writer, details devo.VideoDetails) error {
+	lines := [][2]string{
+		{"title", details.Title},
+		{"seriesTitle", details.Title},
+		{"episodeTitle", details.EpisodeTitle},
+		{"description", details.Description},
+		{"isEpisode", fmt.Sprint(details.EpisodeTitle != "")},
+		{"seriesId", details.SeriesID},
+		{"callsign", details.Callsign},
+	}
+	if details.Channel != "" {
+		major := strings.SplitN(details.Channel, "-", 2)
+		lines = append(lines, [2]string{"displayMajorNumber", major[0]})
+	}
+	if !details.RecordDate.IsZero() {
+		lines = append(lines, [2]string{"time", details.RecordDate.UTC().Format(time.RFC3339)})
+	}
+	if details.Duration != 0 {
+		lines = append(lines, [2]string{"iso_duration", devo.FormatISODuration(details.Duration)})
+	}
+
+	for _, line := range lines {
+		if line[1] == "" {
+			continue
+		}
+		// pyTivo metadata is line-oriented, so embedded newlines must be flattened
+		value := strings.Join(strings.Fields(line[1]), " ")
+		_, err := fmt.Fprintf(w, "%s : %s\n", line[0], value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type nfoUniqueID struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+type nfoEpisode struct {
+	XMLName   xml.Name     `xml:"episodedetails"`
+	Title     string       `xml:"title"`
+	ShowTitle string       `xml:"showtitle"`
+	Plot      string       `xml:"plot,omitempty"`
+	Aired     string       `xml:"aired,omitempty"`
+	Runtime   int          `xml:"runtime,omitempty"`
+	Studio    string       `xml:"studio,omitempty"`
+	UniqueID  *nfoUniqueID `xml:"uniqueid,omitempty"`
+}
+
+// writeNFO writes Kodi/Plex-style episodedetails metadata
+func writeNFO(w io.Writer, details devo.VideoDetails) error {
+	episode := nfoEpisode{
+		Title:     details.EpisodeTitle,
+		ShowTitle: details.Title,
+		Plot:      details.Description,
+		Runtime:   int(details.Duration / time.Minute),
+		Studio:    details.Callsign,
+	}
+	if episode.Title == "" {
+		episode.Title = details.Title
+	}
+	if !details.RecordDate.IsZero() {
+		episode.Aired = details.RecordDate.Format("2006-01-02")
+	}
+	if details.SeriesID != "" {
+		episode.UniqueID = &nfoUniqueID{Type: "tivo", Value: details.SeriesID}
+	}
+
+	_, err := io.WriteString(w, xml.Header)
+	if err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	err = enc.Encode(episode)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "\n")
+	return err
+}
+
+type jsonDetails struct {
+	Title        string    `json:"title"`
+	EpisodeTitle string    `json:"episodeTitle,omitempty"`
+	SeriesID     string    `json:"seriesId,omitempty"`
+	Channel      string    `json:"channel,omitempty"`
+	Callsign     string    `json:"callsign,omitempty"`
+	RecordDate   time.Time `json:"recordDate"`
+	Duration     float64   `json:"duration"` // Seconds
+	Description  string    `json:"description,omitempty"`
+}
+
+func newJSONDetails(details devo.VideoDetails) jsonDetails {
+	return jsonDetails{
+		Title:        details.Title,
+		EpisodeTitle: details.EpisodeTitle,
+		SeriesID:     details.SeriesID,
+		Channel:      details.Channel,
+		Callsign:     details.Callsign,
+		RecordDate:   details.RecordDate,
+		Duration:     details.Duration.Seconds(),
+		Description:  details.Description,
+	}
+}
+
+func writeJSON(w io.Writer, details devo.VideoDetails) error {
+	enc := json.NewEncoder(w)
+	return enc.Encode(newJSONDetails(details))
+}
@@ -0,0 +1,370 @@
+// Copyright (c) 2016 Bob Ziuchkovski
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/bobziuchkovski/writ"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+const (
+	watchUsage            = "Usage: devo watch [OPTION]..."
+	defaultSettle         = 30 * time.Second
+	defaultPollInterval   = 10 * time.Second
+	defaultNotifyInterval = time.Minute
+)
+
+type watchConfig struct {
+	AccessKey  string `option:"m, mak" placeholder:"MAK" description:"The 10-digit media access key (MAK) from your TiVo"`
+	InputDir   string `option:"in-dir" placeholder:"DIR" description:"Directory to watch for new .TiVo files"`
+	OutputDir  string `option:"out-dir" placeholder:"DIR" description:"Directory for the decrypted output"`
+	Name       string `option:"name" placeholder:"TEMPLATE" description:"Output path template, relative to the output directory (default {{.Base}}{{.Ext}})"`
+	Jobs       int    `option:"j, jobs" placeholder:"N" description:"Decrypt N files concurrently (default 1)"`
+	Settle     string `option:"settle" placeholder:"DURATION" description:"Wait until a file stops growing for DURATION before decrypting it (default 30s)"`
+	Interval   string `option:"interval" placeholder:"DURATION" description:"Rescan the directory every DURATION (default 10s, or 1m with inotify)"`
+	Poll       bool   `flag:"poll" description:"Poll the directory rather than using inotify"`
+	After      string `option:"after" placeholder:"ACTION" description:"What to do with each source file once decrypted: keep, move, or delete (default keep)"`
+	MoveDir    string `option:"move-dir" placeholder:"DIR" description:"Directory that source files are moved to with --after move"`
+	Journal    string `option:"journal" placeholder:"FILE" description:"Track completed files in FILE (default OUT-DIR/.devo-state.json)"`
+	MetaFormat string `option:"metadata-format" placeholder:"FORMAT" description:"Write show metadata sidecars next to each output (txt, nfo, json, or a comma-separated list)"`
+	Lenient    bool   `flag:"lenient" description:"Skip past corrupt or truncated input rather than failing"`
+	HelpFlag   bool   `flag:"h, help" description:"Display this help text and exit"`
+}
+
+func (cfg *watchConfig) validate(positional []string) error {
+	if len(positional) != 0 {
+		return fmt.Errorf("too many arguments provided")
+	}
+	if cfg.Jobs < 0 {
+		return fmt.Errorf("-j/--jobs must not be negative")
+	}
+	for _, option := range []struct{ name, value string }{{"--settle", cfg.Settle}, {"--interval", cfg.Interval}} {
+		if option.value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(option.value)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("%s must be a positive duration, such as 30s", option.name)
+		}
+	}
+	switch cfg.After {
+	case "", "keep", "delete":
+		if cfg.MoveDir != "" {
+			return fmt.Errorf("--move-dir requires --after move")
+		}
+	case "move":
+		if cfg.MoveDir == "" {
+			return fmt.Errorf("--after move requires --move-dir")
+		}
+	default:
+		return fmt.Errorf("--after must be keep, move, or delete")
+	}
+	return validateDirOptions(cfg.AccessKey, cfg.InputDir, cfg.OutputDir, cfg.Name, cfg.MetaFormat)
+}
+
+// observation is the size and modification time of a file when last scanned
+type observation struct {
+	size    int64
+	modTime time.Time
+	since   time.Time // When the size and modification time were first observed
+}
+
+func (o observation) matches(info os.FileInfo) bool {
+	return o.size == info.Size() && o.modTime.Equal(info.ModTime())
+}
+
+// watchResult is the outcome of decrypting a single file
+type watchResult struct {
+	input  string
+	output string
+	err    error
+}
+
+// watcher decrypts TiVo files as they appear in a directory.  Scanning and
+// bookkeeping happen on a single goroutine, while decryption happens on a pool of
+// workers.
+type watcher struct {
+	dir      string
+	dec      *fileDecryptor
+	journal  *stateFile
+	settle   time.Duration
+	after    string
+	moveDir  string
+	log      *log.Logger
+	seen     map[string]observation // Files waiting to settle
+	failed   map[string]observation // Files that failed, retried once they change
+	pending  map[string]bool        // Files queued or being decrypted
+	queue    []string
+	jobs     chan string
+	results  chan watchResult
+	previous map[string]os.FileInfo // File info at the time each job was queued
+}
+
+func runWatch(cmd *writ.Command, cfg *watchConfig, positional []string) {
+	if cfg.HelpFlag {
+		cmd.ExitHelp(nil)
+	}
+	err := cfg.validate(positional)
+	if err != nil {
+		cmd.ExitHelp(err)
+	}
+
+	dec, err := newFileDecryptor(cfg.AccessKey, cfg.OutputDir, cfg.Name, cfg.MetaFormat, cfg.Lenient)
+	check(err)
+	journalPath := cfg.Journal
+	if journalPath == "" {
+		journalPath = filepath.Join(cfg.OutputDir, defaultStateFile)
+	}
+	journal, err := loadState(journalPath)
+	check(err)
+
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+	var changes <-chan struct{}
+	interval := defaultPollInterval
+	if !cfg.Poll {
+		var stop func()
+		changes, stop, err = notifyDir(cfg.InputDir)
+		if err == nil {
+			defer stop()
+			interval = defaultNotifyInterval
+		} else {
+			logger.Printf("Falling back to polling: %s", err)
+		}
+	}
+	if cfg.Interval != "" {
+		interval, _ = time.ParseDuration(cfg.Interval)
+	}
+	settle := defaultSettle
+	if cfg.Settle != "" {
+		settle, _ = time.ParseDuration(cfg.Settle)
+	}
+	jobs := cfg.Jobs
+	if jobs == 0 {
+		jobs = 1
+	}
+
+	// Interrupts cancel decryption in progress, leaving the journal consistent
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		logger.Printf("Received %s, stopping", sig)
+		cancel()
+	}()
+
+	w := &watcher{
+		dir:      cfg.InputDir,
+		dec:      dec,
+		journal:  journal,
+		settle:   settle,
+		after:    cfg.After,
+		moveDir:  cfg.MoveDir,
+		log:      logger,
+		seen:     make(map[string]observation),
+		failed:   make(map[string]observation),
+		pending:  make(map[string]bool),
+		jobs:     make(chan string),
+		results:  make(chan watchResult),
+		previous: make(map[string]os.FileInfo),
+	}
+	logger.Printf("Watching %s", cfg.InputDir)
+	w.run(ctx, jobs, interval, changes)
+}
+
+// run scans the directory until ctx is done, rescanning every interval and
+// whenever changes receives a value
+func (w *watcher) run(ctx context.Context, workers int, interval time.Duration, changes <-chan struct{}) {
+	done := make(chan struct{})
+	for i := 0; i < workers; i++ {
+		go w.work(ctx, done)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// Files are only ready once they've settled, so changes are followed by a
+	// rescan after the settle time
+	settled := time.NewTimer(w.settle)
+	defer settled.Stop()
+
+	w.scan()
+	active := 0
+	for {
+		var jobs chan string
+		var next string
+		if len(w.queue) != 0 {
+			jobs, next = w.jobs, w.queue[0]
+		}
+
+		select {
+		case <-ctx.Done():
+			close(done)
+			for ; active != 0; active-- {
+				<-w.results
+			}
+			return
+		case jobs <- next:
+			w.queue = w.queue[1:]
+			active++
+		case result := <-w.results:
+			active--
+			w.finish(ctx, result)
+		case _, ok := <-changes:
+			if !ok {
+				w.log.Printf("Directory notification failed, falling back to polling")
+				changes = nil
+				ticker.Stop()
+				ticker = time.NewTicker(defaultPollInterval)
+				continue
+			}
+			if !settled.Stop() {
+				select {
+				case <-settled.C:
+				default:
+				}
+			}
+			settled.Reset(w.settle)
+			w.scan()
+		case <-settled.C:
+			w.scan()
+		case <-ticker.C:
+			w.scan()
+		}
+	}
+}
+
+// scan queues the files that have settled and haven't been decrypted already
+func (w *watcher) scan() {
+	inputs, err := listTiVoFiles(w.dir)
+	if err != nil {
+		w.log.Printf("Error scanning %s: %s", w.dir, err)
+		return
+	}
+
+	now := time.Now()
+	present := make(map[string]bool)
+	for _, input := range inputs {
+		present[input] = true
+		if w.pending[input] {
+			continue
+		}
+		info, err := os.Stat(input)
+		if err != nil {
+			continue
+		}
+		if output, ok := w.journal.completed(input, info); ok {
+			// Completed previously, possibly prior to a restart
+			w.disposeSource(input, output)
+			continue
+		}
+		if failure, ok := w.failed[input]; ok && failure.matches(info) {
+			continue
+		}
+
+		seen, ok := w.seen[input]
+		if !ok || !seen.matches(info) {
+			w.seen[input] = observation{size: info.Size(), modTime: info.ModTime(), since: now}
+			continue
+		}
+		if now.Sub(seen.since) < w.settle {
+			continue
+		}
+		delete(w.seen, input)
+		delete(w.failed, input)
+		w.pending[input] = true
+		w.previous[input] = info
+		w.queue = append(w.queue, input)
+	}
+
+	for input := range w.seen {
+		if !present[input] {
+			delete(w.seen, input)
+		}
+	}
+	for input := range w.failed {
+		if !present[input] {
+			delete(w.failed, input)
+		}
+	}
+}
+
+func (w *watcher) work(ctx context.Context, done <-chan struct{}) {
+	for {
+		select {
+		case input := <-w.jobs:
+			output, err := w.dec.decrypt(ctx, input)
+			w.results <- watchResult{input: input, output: output, err: err}
+		case <-done:
+			return
+		}
+	}
+}
+
+// finish records the result of decrypting a file
+func (w *watcher) finish(ctx context.Context, result watchResult) {
+	info := w.previous[result.input]
+	delete(w.pending, result.input)
+	delete(w.previous, result.input)
+	if ctx.Err() != nil {
+		return
+	}
+	if result.err != nil {
+		w.log.Printf("Failed to decrypt %s: %s", result.input, result.err)
+		w.failed[result.input] = observation{size: info.Size(), modTime: info.ModTime()}
+		return
+	}
+
+	err := w.journal.record(result.input, info, result.output)
+	if err != nil {
+		w.log.Printf("Failed to update journal for %s: %s", result.input, err)
+		return
+	}
+	w.log.Printf("Decrypted %s to %s", result.input, result.output)
+	w.disposeSource(result.input, result.output)
+}
+
+// disposeSource moves or deletes a source file once it's been decrypted
+func (w *watcher) disposeSource(input, output string) {
+	var err error
+	switch w.after {
+	case "move":
+		err = os.MkdirAll(w.moveDir, 0755)
+		if err == nil {
+			err = os.Rename(input, filepath.Join(w.moveDir, filepath.Base(input)))
+		}
+	case "delete":
+		err = os.Remove(input)
+	default:
+		return
+	}
+	if err != nil {
+		w.log.Printf("Failed to %s %s: %s", w.after, input, err)
+		return
+	}
+	w.log.Printf("Finished with %s (%sd)", input, w.after)
+}
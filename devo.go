@@ -26,13 +26,20 @@ package devo
 
 import (
 	"bufio"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"time"
 )
 
-const tsType = 0x20
+const (
+	tsType        = 0x20
+	metaPlaintext = 0x01
+	metaEncrypted = 0x02
+)
 
 type fileHeader struct {
 	Magic        [4]byte
@@ -50,85 +57,341 @@ type metaHeader struct {
 	Type      uint16
 }
 
-type metadata struct {
+type metaSegment struct {
 	Header  metaHeader
 	Content []byte
 }
 
+// maxMetadataLength bounds the size of a metadata segment.  Real segments are
+// a few kilobytes, so anything larger is treated as corrupt rather than buffered.
+const maxMetadataLength = 16 << 20
+
+// progressInterval is the number of packets processed between progress callbacks
+const progressInterval = 1024
+
+// Options controls optional DecryptContext behavior.  A nil *Options is
+// equivalent to the zero value.
+type Options struct {
+	// Progress, if non-nil, is called periodically during decryption and
+	// once more when decryption stops.
+	Progress func(Stats)
+
+	// Lenient enables recovery from corrupt or truncated input.  Rather than
+	// failing, decryption skips forward to the next packet boundary and
+	// continues.  A boundary must be confirmed by the packet that follows, so
+	// a packet directly preceding corrupt input is skipped as well.  Skipped
+	// input is reported in Stats.Dropped.  Unsupported streams still fail.
+	Lenient bool
+
+	// Parallel sets the number of goroutines used to decrypt mpeg-ts input.
+	// Packets sharing a cipher are decrypted in order by the same goroutine, so
+	// there is little benefit beyond the number of scrambled streams (usually
+	// one video and one audio stream).  Values below 2 decrypt on the calling
+	// goroutine.  mpeg-ps input is always decrypted on the calling goroutine.
+	Parallel int
+
+	// Index, if non-nil, receives an index of the video in the .devoidx format
+	// once decryption succeeds.  See Index for details.  Indexing decrypts on
+	// the calling goroutine regardless of Parallel.  In lenient mode, the index
+	// ends at the first corrupt input skipped.  Index can't be combined with
+	// clipping.
+	Index io.Writer
+
+	// Start and End clip the output to the video between those times, measured
+	// from the first video timestamp.  The video is cut at the resync points
+	// (mpeg-ps packs or mpeg-ts packets) ahead of keyframes, so that output
+	// begins with the keyframe at or before Start and ends ahead of the first
+	// keyframe at or after End.  Decryption stops there.  A zero End clips to
+	// the end of the video.  Video in an unrecognized codec is cut at any video
+	// packet.  mpeg-ps output ends with a program end code, and mpeg-ts output
+	// begins with the program tables.  Clipping decrypts on the calling
+	// goroutine regardless of Parallel.
+	Start time.Duration
+	End   time.Duration
+
+	// Cuts lists spans to drop from the output, such as commercial breaks.
+	// Video is cut at keyframes as when clipping, keeping any GOP (group of
+	// pictures) that overlaps the video outside the cuts, and the output either
+	// side of each cut is spliced together.  mpeg-ts continuity counters are
+	// adjusted to run on across splices.  mpeg-ts null packets are kept or
+	// dropped along with the GOP they fall in, and are written unchanged.
+	Cuts []Cut
+}
+
+// clipping reports whether opts clip or cut the output
+func (opts *Options) clipping() bool {
+	return opts.Start > 0 || opts.End > 0 || len(opts.Cuts) != 0
+}
+
+// Stats reports decryption progress.
+type Stats struct {
+	BytesRead int64 // Input bytes consumed, including the file header
+	Packets   int64 // Packets processed
+	Decrypted int64 // Scrambled packets decrypted
+	Dropped   int64 // Corrupt input bytes skipped in lenient mode
+	BadTables int64 // Damaged mpeg-ts table sections discarded, such as for a bad CRC
+	PTS       int64 // Most recent presentation timestamp (90kHz units), or -1 if none seen
+}
+
+// packetInfo describes a packet returned by a decryptor
+type packetInfo struct {
+	decrypted bool  // The packet was scrambled and has been decrypted
+	pts       int64 // Presentation timestamp, or -1 if absent
+	dropped   int64 // Corrupt input bytes skipped prior to the packet
+	badTables int64 // Damaged table sections discarded while reading the packet
+}
+
+// decryptor is implemented by the mpeg-ps and mpeg-ts decryptors
+type decryptor interface {
+	// next reads and decrypts a single packet, returning the decrypted packet.
+	// The returned slice is only valid until the following call to next.
+	// io.EOF is returned once the stream ends cleanly.
+	next() ([]byte, packetInfo, error)
+}
+
 // Decrypt a TiVo file from src using the specified media access key (mak).
-// The decrypted content is written to dst.
+// The decrypted content is written to dst.  ErrBadAccessKey is returned
+// prior to writing any content if mak fails to decrypt the file metadata.
 func Decrypt(dst io.Writer, src io.Reader, mak string) error {
+	return DecryptContext(context.Background(), dst, src, mak, nil)
+}
+
+// DecryptContext is like Decrypt, but stops between packets and returns
+// ctx.Err() once ctx is done.  Additional behavior is controlled by opts,
+// which may be nil.  Problems with the input are reported as a *FormatError
+// or *PacketError.
+func DecryptContext(ctx context.Context, dst io.Writer, src io.Reader, mak string, opts *Options) error {
+	if opts == nil {
+		opts = &Options{}
+	}
+	if opts.Start < 0 || opts.End < 0 || (opts.End > 0 && opts.End <= opts.Start) {
+		return fmt.Errorf("devo: invalid clip %s-%s", opts.Start, opts.End)
+	}
+	for _, cut := range opts.Cuts {
+		if cut.Start < 0 || cut.End <= cut.Start {
+			return fmt.Errorf("devo: invalid cut %s-%s", cut.Start, cut.End)
+		}
+	}
+	if opts.Index != nil && opts.clipping() {
+		return errors.New("devo: an index can't be written while clipping or cutting")
+	}
+	header, dec, err := newDecryptor(src, mak, opts)
+	if err != nil {
+		return err
+	}
+	if s, ok := dec.(stopper); ok {
+		defer s.stop()
+	}
+
+	dstbuf := bufio.NewWriter(dst)
+	var out io.Writer = dstbuf
+	var clip *clipper
+	if opts.clipping() {
+		clip = newClipper(dstbuf, dec.(*indexer), keepSpans(opts.Start, opts.End, opts.Cuts))
+		out = clip
+	}
+	stats := Stats{BytesRead: int64(header.VideoOffset), PTS: -1}
+	err = decryptAll(ctx, out, dec, &stats, opts)
+	if opts.Progress != nil {
+		opts.Progress(stats)
+	}
+	if err == errClipEnd {
+		err = nil
+	}
+	if err == nil && clip != nil {
+		err = clip.close()
+	}
+	if err != nil {
+		return err
+	}
+	err = dstbuf.Flush()
+	if err != nil {
+		return err
+	}
+	if opts.Index != nil {
+		_, err = dec.(*indexer).finish().WriteTo(opts.Index)
+	}
+	return err
+}
+
+// newDecryptor reads the file metadata from src and returns the appropriate
+// decryptor for the video content that follows.
+func newDecryptor(src io.Reader, mak string, opts *Options) (fileHeader, decryptor, error) {
 	header, meta, err := readFileMetadata(src)
 	if err != nil {
-		return fmt.Errorf("devo: error parsing metadata: %s", err)
+		return header, nil, err
+	}
+	err = checkAccessKey(mak, meta)
+	if err != nil {
+		return header, nil, err
 	}
 
 	// The first metadata segment is used in entirety as an initialization vector
 	iv := meta[0].Content
 
-	srcbuf := bufio.NewReader(src)
-	dstbuf := bufio.NewWriter(dst)
+	srcbuf := newSourceReader(src, int64(header.VideoOffset))
+
+	// Index points record the keystream each cipher has consumed
+	var keys *keyTracker
+	if opts.Index != nil {
+		keys = newKeyTracker()
+		keys.settled = true
+	}
 
 	if header.Flags&tsType != 0 {
-		err = newTSDecryptor(mak, iv).decrypt(dstbuf, srcbuf)
-	} else {
-		err = newPSDecryptor(mak, iv).decrypt(dstbuf, srcbuf)
+		dec := newTSDecryptor(mak, iv, srcbuf)
+		dec.lenient = opts.Lenient
+		dec.keys = keys
+		switch {
+		case opts.Index != nil:
+			return header, newIndexer(dec, StreamTS, srcbuf, meta), nil
+		case opts.clipping():
+			return header, newIndexer(dec, StreamTS, srcbuf, nil), nil
+		case opts.Parallel > 1:
+			return header, newParallelTSDecryptor(dec, opts.Parallel), nil
+		}
+		return header, dec, nil
 	}
-	if err != nil {
-		seeker, ok := src.(io.Seeker)
-		if ok {
-			pos, _ := seeker.Seek(0, 1)
-			err = fmt.Errorf("devo: error processing input at offset 0x%08x: %s", pos, err)
-		} else {
-			err = fmt.Errorf("devo: error processing input: %s", err)
+	dec := newPSDecryptor(mak, iv, srcbuf)
+	dec.lenient = opts.Lenient
+	dec.keys = keys
+	switch {
+	case opts.Index != nil:
+		return header, newIndexer(dec, StreamPS, srcbuf, meta), nil
+	case opts.clipping():
+		return header, newIndexer(dec, StreamPS, srcbuf, nil), nil
+	}
+	return header, dec, nil
+}
+
+func decryptAll(ctx context.Context, dst io.Writer, dec decryptor, stats *Stats, opts *Options) error {
+	for {
+		err := ctx.Err()
+		if err != nil {
+			return err
+		}
+
+		packet, info, err := dec.next()
+		stats.BytesRead += info.dropped
+		stats.Dropped += info.dropped
+		stats.BadTables += info.badTables
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		stats.BytesRead += int64(len(packet))
+		stats.Packets++
+		if info.decrypted {
+			stats.Decrypted++
+		}
+		if info.pts >= 0 {
+			stats.PTS = info.pts
+		}
+		if opts.Progress != nil && stats.Packets%progressInterval == 0 {
+			opts.Progress(*stats)
+		}
+
+		_, err = dst.Write(packet)
+		if err != nil {
+			return err
 		}
-		return err
 	}
-	return dstbuf.Flush()
 }
 
-func readFileMetadata(src io.Reader) (header fileHeader, meta []metadata, err error) {
+// readFileMetadata reads the file header and metadata segments from src, leaving
+// src positioned at the start of the video content.  Errors are returned as a
+// *FormatError.
+func readFileMetadata(src io.Reader) (header fileHeader, meta []metaSegment, err error) {
 	var position int64
+	defer func() {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			err = &FormatError{Offset: position, Err: err}
+		}
+	}()
 
 	err = binary.Read(src, binary.BigEndian, &header)
 	if err != nil {
 		return
 	}
 	if string(header.Magic[:]) != "TiVo" {
-		err = fmt.Errorf("not a tivo file (missing magic 'TiVo' marker)")
+		err = ErrNotTiVo
 		return
 	}
 	position += 16 // Size of file header
 
-	// We skip the last metadata segment because it's redundant and sometimes has bogus header data
-	meta = make([]metadata, header.MetaSegments-1)
-	for i := range meta {
-		current := metadata{}
+	for i := 0; i < int(header.MetaSegments); i++ {
+		// The last metadata segment is redundant and sometimes has bogus header data,
+		// so we tolerate errors there and simply skip forward to the video content.
+		last := i == int(header.MetaSegments)-1
+
+		current := metaSegment{}
 		err = binary.Read(src, binary.BigEndian, &current.Header)
 		if err != nil {
 			return
 		}
+		position += 12 // Size of metadata header
+		if position+int64(current.Header.DataSize)+4 > int64(header.VideoOffset) {
+			if last {
+				break
+			}
+			err = corruptf("metadata segment %d overlaps video content", i)
+			return
+		}
+		if current.Header.DataSize > maxMetadataLength {
+			if last {
+				break
+			}
+			err = corruptf("metadata segment %d is too large", i)
+			return
+		}
 
 		current.Content = make([]byte, current.Header.DataSize)
-		_, err = src.Read(current.Content)
+		_, err = io.ReadFull(src, current.Content)
 		if err != nil {
 			return
 		}
-		meta[i] = current
 
 		var endMarker uint32
 		err = binary.Read(src, binary.BigEndian, &endMarker)
 		if err != nil {
 			return
 		}
+		position += int64(current.Header.DataSize) + 4 // Size of content and end marker
 		if endMarker != 0x000000 {
-			err = fmt.Errorf("metadata offset error")
+			if last {
+				break
+			}
+			err = corruptf("metadata offset error")
 			return
 		}
-		position += 16 + int64(current.Header.DataSize) // Size of current chunk
+		meta = append(meta, current)
+	}
+	if len(meta) == 0 {
+		err = corruptf("missing metadata segments")
+		return
+	}
+	if int64(header.VideoOffset) < position {
+		err = corruptf("video offset 0x%08x precedes end of metadata", header.VideoOffset)
+		return
 	}
 
 	// Skip forward to video content
 	_, err = io.CopyN(ioutil.Discard, src, int64(header.VideoOffset)-position)
+	if err == nil {
+		position = int64(header.VideoOffset)
+	}
 	return
 }
+
+// checkAccessKey verifies mak by decrypting the file metadata.  Files lacking an
+// encrypted metadata segment can't be verified and are accepted as-is.
+func checkAccessKey(mak string, meta []metaSegment) error {
+	_, err := decryptMetadata(mak, meta)
+	return err
+}
@@ -21,10 +21,19 @@
 package devo
 
 import (
+	"bytes"
+	"context"
 	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
 	"os"
 	"reflect"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 )
 
 // These are baseline sanity tests.
@@ -65,6 +74,545 @@ func TestTS(t *testing.T) {
 	runDevoTest(t, test)
 }
 
+func TestBadAccessKey(t *testing.T) {
+	for _, file := range []string{"test.mpegps.tivo", "test.mpegts.tivo"} {
+		r, err := os.Open(file)
+		if err != nil {
+			t.Fatalf("Encountered unexpected error reading test file.  File: %s, Error: %s", file, err)
+		}
+
+		var out bytes.Buffer
+		err = Decrypt(&out, r, "0123456789")
+		r.Close()
+		if err != ErrBadAccessKey {
+			t.Errorf("Expected ErrBadAccessKey for incorrect MAK.  File: %s, Error: %v", file, err)
+		}
+		if out.Len() != 0 {
+			t.Errorf("Expected no output for incorrect MAK.  File: %s, Written: %d", file, out.Len())
+		}
+	}
+}
+
+func TestDecryptContext(t *testing.T) {
+	for _, file := range []string{"test.mpegps.tivo", "test.mpegts.tivo"} {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatalf("Encountered unexpected error reading test file.  File: %s, Error: %s", file, err)
+		}
+
+		var final Stats
+		opts := &Options{Progress: func(s Stats) { final = s }}
+		err = DecryptContext(context.Background(), ioutil.Discard, bytes.NewReader(content), "3886854575", opts)
+		if err != nil {
+			t.Errorf("Encountered unexpected error decrypting test file.  File: %s, Error: %s", file, err)
+		}
+		if final.BytesRead != int64(len(content)) || final.Packets == 0 || final.Decrypted == 0 || final.PTS < 0 {
+			t.Errorf("Final progress stats are invalid.  File: %s, Stats: %+v", file, final)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		err = DecryptContext(ctx, ioutil.Discard, bytes.NewReader(content), "3886854575", nil)
+		if err != context.Canceled {
+			t.Errorf("Expected context.Canceled for canceled context.  File: %s, Error: %v", file, err)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	err := Decrypt(ioutil.Discard, bytes.NewReader([]byte("NotATiVoFile0000")), "3886854575")
+	var formatErr *FormatError
+	if !errors.Is(err, ErrNotTiVo) || !errors.As(err, &formatErr) || formatErr.Offset != 0 {
+		t.Errorf("Expected ErrNotTiVo format error.  Error: %v", err)
+	}
+
+	err = Decrypt(ioutil.Discard, bytes.NewReader([]byte("TiVo")), "3886854575")
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Expected io.ErrUnexpectedEOF for truncated header.  Error: %v", err)
+	}
+
+	header := testHeader(0x00, []byte("initialization vector"))
+	input := append(header, 0x00, 0x00, 0x02, 0xba)
+	err = Decrypt(ioutil.Discard, bytes.NewReader(input), "3886854575")
+	var packetErr *PacketError
+	if !errors.Is(err, ErrCorrupt) || !errors.As(err, &packetErr) {
+		t.Fatalf("Expected ErrCorrupt packet error for invalid start code.  Error: %v", err)
+	}
+	if packetErr.Stream != StreamPS || packetErr.Packet != 1 || packetErr.Offset != int64(len(header)) {
+		t.Errorf("Packet error fields are invalid.  Error: %+v", packetErr)
+	}
+}
+
+func TestSentinelMessages(t *testing.T) {
+	for _, err := range []error{ErrBadAccessKey, ErrNotTiVo, ErrCorrupt, ErrUnsupported, ErrBadIndex} {
+		if !strings.HasPrefix(err.Error(), "devo: ") {
+			t.Errorf("Sentinel error lacks the package prefix.  Error: %s", err)
+		}
+	}
+}
+
+func TestLenient(t *testing.T) {
+	garbage := []byte{0x00, 0x00, 0x01, 0x47, 0x47, 0x12, 0x34}
+	pack := []byte{0x00, 0x00, 0x01, 0xba, 0x44, 0x00, 0x04, 0x00, 0x04, 0x01, 0x01, 0x89, 0xc3, 0xf8}
+	end := []byte{0x00, 0x00, 0x01, 0xb9}
+	null := make([]byte, 188)
+	copy(null, []byte{0x47, 0x1f, 0xff, 0x10})
+
+	tests := []struct {
+		name     string
+		flags    uint16
+		video    [][]byte
+		expected [][]byte
+		dropped  int64
+	}{
+		{"PS garbage", 0x00, [][]byte{pack, garbage, pack, end}, [][]byte{pack, pack, end}, int64(len(garbage))},
+		{"PS truncated", 0x00, [][]byte{pack, pack[:9]}, [][]byte{pack}, 9},
+		{"TS garbage", tsType, [][]byte{garbage, null, null, garbage, null}, [][]byte{null, null}, int64(2*len(garbage) + len(null))},
+		{"TS truncated", tsType, [][]byte{null, null[:100]}, [][]byte{null}, 100},
+	}
+	for _, test := range tests {
+		input := append(testHeader(test.flags, []byte("initialization vector")), bytes.Join(test.video, nil)...)
+		err := Decrypt(ioutil.Discard, bytes.NewReader(input), "3886854575")
+		if !errors.Is(err, ErrCorrupt) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("Expected corrupt input error without lenient mode.  Test: %s, Error: %v", test.name, err)
+		}
+
+		var out bytes.Buffer
+		var final Stats
+		opts := &Options{Lenient: true, Progress: func(s Stats) { final = s }}
+		err = DecryptContext(context.Background(), &out, bytes.NewReader(input), "3886854575", opts)
+		if err != nil {
+			t.Errorf("Encountered unexpected error in lenient mode.  Test: %s, Error: %s", test.name, err)
+		}
+		if !bytes.Equal(out.Bytes(), bytes.Join(test.expected, nil)) {
+			t.Errorf("Lenient output is invalid.  Test: %s", test.name)
+		}
+		if final.Dropped != test.dropped || final.BytesRead != int64(len(input)) {
+			t.Errorf("Lenient stats are invalid.  Test: %s, Stats: %+v", test.name, final)
+		}
+	}
+}
+
+func TestPSUnscrambledPackets(t *testing.T) {
+	// Padding and private stream 2 packets lack a PES header, so their leading
+	// bytes aren't scrambling control bits and they pass through unchanged
+	pack := []byte{0x00, 0x00, 0x01, 0xba, 0x44, 0x00, 0x04, 0x00, 0x04, 0x01, 0x01, 0x89, 0xc3, 0xf8}
+	padding := append([]byte{0x00, 0x00, 0x01, 0xbe, 0x00, 0x10}, bytes.Repeat([]byte{0xff}, 16)...)
+	private2 := append([]byte{0x00, 0x00, 0x01, 0xbf, 0x00, 0x08}, 0x30, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07)
+	end := []byte{0x00, 0x00, 0x01, 0xb9}
+	video := bytes.Join([][]byte{pack, padding, private2, end}, nil)
+
+	var out bytes.Buffer
+	input := append(testHeader(0x00, []byte("initialization vector")), video...)
+	err := Decrypt(&out, bytes.NewReader(input), "3886854575")
+	if err != nil {
+		t.Fatalf("Encountered unexpected error decrypting.  Error: %s", err)
+	}
+	if !bytes.Equal(out.Bytes(), video) {
+		t.Errorf("Packets without PES headers were altered.  Expected: %x, Got: %x", video, out.Bytes())
+	}
+}
+
+func TestResync(t *testing.T) {
+	pack := []byte{0x00, 0x00, 0x01, 0xba, 0x44, 0x00, 0x04, 0x00, 0x04, 0x01, 0x01, 0x89, 0xc3, 0xf8}
+	null := make([]byte, 188)
+	copy(null, []byte{0x47, 0x1f, 0xff, 0x10})
+
+	// Start codes and sync bytes within packet content aren't boundaries unless
+	// the packet that follows confirms them
+	tests := []struct {
+		name    string
+		flags   uint16
+		input   []byte
+		skipped int64
+	}{
+		{"PS packet start", 0x00, append([]byte{0x00, 0x00, 0x01, 0xe0, 0x00, 0x04, 0x01, 0x02, 0x03, 0x04}, pack...), 0},
+		{"PS stray start code", 0x00, append([]byte{0x00, 0x00, 0x01, 0xe0, 0x00, 0x02, 0x01, 0x02, 0x03, 0x04}, pack...), 10},
+		{"PS stray pack start", 0x00, append(pack[:12], pack...), 12},
+		{"PS final packet", 0x00, pack, 0},
+		{"TS packet start", tsType, append(append([]byte{}, null...), null...), 0},
+		{"TS stray sync byte", tsType, append([]byte{0x47, 0x00, 0x00}, append(null, null...)...), 3},
+		{"TS final packet", tsType, null, 0},
+	}
+	for _, test := range tests {
+		src := newSourceReader(bytes.NewReader(test.input), 0)
+		var resync func() (int64, error)
+		if test.flags&tsType != 0 {
+			resync = newTSDecryptor("3886854575", nil, src).resync
+		} else {
+			resync = newPSDecryptor("3886854575", nil, src).resync
+		}
+		skipped, err := resync()
+		if err != nil {
+			t.Errorf("Encountered unexpected error resyncing.  Test: %s, Error: %s", test.name, err)
+		}
+		if skipped != test.skipped {
+			t.Errorf("Resync skipped the wrong amount.  Test: %s, Expected: %d, Got: %d", test.name, test.skipped, skipped)
+		}
+	}
+}
+
+func TestKeyTracker(t *testing.T) {
+	a := cipherHandle{id: 0xe0, confounder: [3]byte{1, 2, 3}}
+	b := cipherHandle{id: 0xe0, confounder: [3]byte{4, 5, 6}}
+
+	// Streams sharing a cipher switch confounders one at a time
+	keys := newKeyTracker()
+	keys.assign(0x11, a)
+	keys.assign(0x12, a)
+	keys.assign(0x11, b)
+	keys.assign(0x12, b)
+	keys.assign(0x11, b)
+	if keys.reused || !keys.retired[a] {
+		t.Errorf("Confounder changes are tracked incorrectly.  Reused: %t, Retired: %v", keys.reused, keys.retired)
+	}
+	if !keys.suspect[a] || keys.suspect[b] {
+		t.Errorf("Suspect ciphers are invalid.  Got: %v", keys.suspect)
+	}
+
+	// Switching back to a retired confounder is flagged
+	keys.assign(0x12, a)
+	if !keys.reused {
+		t.Errorf("Expected reused confounder to be flagged")
+	}
+}
+
+func TestPAT(t *testing.T) {
+	// A two-section table of program 0 (network PID) and programs 1-3
+	sections := [][]byte{
+		{0x00, 0xb0, 0x15, 0x00, 0x01, 0xc1, 0x00, 0x01,
+			0x00, 0x00, 0xe0, 0x10, 0x00, 0x01, 0xe1, 0x00, 0x00, 0x02, 0xe2, 0x00},
+		{0x00, 0xb0, 0x0d, 0x00, 0x01, 0xc1, 0x01, 0x01,
+			0x00, 0x03, 0xe3, 0x00},
+	}
+	var table []byte
+	for _, section := range sections {
+		var crc [4]byte
+		binary.BigEndian.PutUint32(crc[:], crc32MPEG(section))
+		table = append(table, section...)
+		table = append(table, crc[:]...)
+	}
+
+	// Split the table across two packets, using the pointer field to skip filler in the first
+	payload := append([]byte{170}, bytes.Repeat([]byte{0xff}, 170)...)
+	payload = append(payload, table...)
+	packets := []*tsPacket{{}, {}}
+	copy(packets[0].content[:], []byte{tsSync, 0x40, 0x00, 0x10})
+	copy(packets[1].content[:], []byte{tsSync, 0x00, 0x00, 0x11})
+	n := copy(packets[0].content[4:], payload)
+	copy(packets[1].content[4:], payload[n:])
+	for i := 4 + len(payload) - n; i < tsPacketSize; i++ {
+		packets[1].content[i] = 0xff
+	}
+
+	dec := newTSDecryptor("3886854575", nil, nil)
+	for _, packet := range packets {
+		_, err := dec.processPacket(packet)
+		if err != nil {
+			t.Fatalf("Encountered unexpected error processing PAT.  Error: %s", err)
+		}
+	}
+	expected := map[packetID]bool{0x100: true, 0x200: true, 0x300: true}
+	if !reflect.DeepEqual(expected, dec.pmtIDs) {
+		t.Errorf("PMT PIDs are invalid.  Expected: %v, Got: %v", expected, dec.pmtIDs)
+	}
+
+	// A section with a bad CRC is discarded and counted
+	packets[1].content[10] ^= 0xff
+	dec = newTSDecryptor("3886854575", nil, nil)
+	for _, packet := range packets {
+		_, err := dec.processPacket(packet)
+		if err != nil {
+			t.Fatalf("Encountered unexpected error processing PAT with bad CRC.  Error: %s", err)
+		}
+	}
+	if dec.badTables != 1 {
+		t.Errorf("Damaged PAT sections miscounted.  Expected: 1, Got: %d", dec.badTables)
+	}
+}
+
+func TestMultiProgramPMT(t *testing.T) {
+	// Programs 1 and 2 have program maps on PIDs 0x100 and 0x200, and only program 2 carries TiVo private data
+	sections := [][]byte{
+		{0x00, 0xb0, 0x11, 0x00, 0x01, 0xc1, 0x00, 0x00,
+			0x00, 0x01, 0xe1, 0x00, 0x00, 0x02, 0xe2, 0x00},
+		{0x02, 0xb0, 0x12, 0x00, 0x01, 0xc1, 0x00, 0x00, 0xe1, 0x01, 0xf0, 0x00,
+			0x02, 0xe1, 0x01, 0xf0, 0x00},
+		{0x02, 0xb0, 0x17, 0x00, 0x02, 0xc1, 0x00, 0x00, 0xe2, 0x01, 0xf0, 0x00,
+			0x02, 0xe2, 0x01, 0xf0, 0x00, 0x97, 0xe2, 0x02, 0xf0, 0x00},
+	}
+	pids := []packetID{tsPatID, 0x100, 0x200}
+	packets := make([]*tsPacket, len(sections))
+	for i, section := range sections {
+		var crc [4]byte
+		binary.BigEndian.PutUint32(crc[:], crc32MPEG(section))
+		packets[i] = &tsPacket{}
+		content := packets[i].content[:]
+		for j := range content {
+			content[j] = 0xff
+		}
+		copy(content, []byte{tsSync, 0x40 | byte(pids[i]>>8), byte(pids[i]), 0x10, 0x00})
+		copy(content[5:], append(section, crc[:]...))
+	}
+
+	dec := newTSDecryptor("3886854575", nil, nil)
+	for _, packet := range packets {
+		_, err := dec.processPacket(packet)
+		if err != nil {
+			t.Fatalf("Encountered unexpected error processing program tables.  Error: %s", err)
+		}
+	}
+	if dec.privateTables[0x202] == nil || len(dec.privateTables) != 1 {
+		t.Errorf("Private data PIDs are invalid.  Got: %v", dec.privateTables)
+	}
+
+	// A damaged private table is discarded, leaving scrambled packets without a cipher
+	private := &tsPacket{}
+	copy(private.content[:], []byte{tsSync, 0x42, 0x02, 0x10})
+	copy(private.content[4:], "TiVx")
+	_, err := dec.processPacket(private)
+	if err != nil {
+		t.Errorf("Encountered unexpected error processing damaged private data.  Error: %s", err)
+	}
+	if dec.badTables != 1 {
+		t.Errorf("Damaged private tables miscounted.  Expected: 1, Got: %d", dec.badTables)
+	}
+	scrambled := &tsPacket{}
+	copy(scrambled.content[:], []byte{tsSync, 0x42, 0x01, 0x90})
+	_, err = dec.processPacket(scrambled)
+	if !errors.Is(err, ErrCorrupt) {
+		t.Errorf("Expected ErrCorrupt for scrambled packet without a cipher.  Error: %v", err)
+	}
+
+	// Without program 2's private data, the PID is missing once both programs are mapped
+	dec = newTSDecryptor("3886854575", nil, nil)
+	for _, packet := range packets[:2] {
+		_, err := dec.processPacket(packet)
+		if err != nil {
+			t.Fatalf("Encountered unexpected error processing program tables.  Error: %s", err)
+		}
+	}
+	_, err = dec.processPacket(packets[1])
+	if err != nil {
+		t.Errorf("Encountered unexpected error reprocessing program map.  Error: %s", err)
+	}
+	packets[2].content[5+17] = 0x02
+	binary.BigEndian.PutUint32(packets[2].content[5+22:], crc32MPEG(packets[2].content[5:5+22]))
+	_, err = dec.processPacket(packets[2])
+	if !errors.Is(err, ErrCorrupt) {
+		t.Errorf("Expected ErrCorrupt for programs without private data.  Error: %v", err)
+	}
+}
+
+func TestEncrypt(t *testing.T) {
+	video := bytes.Repeat([]byte("video content "), 40)
+	audio := bytes.Repeat([]byte("audio content "), 10)
+	pack := []byte{0x00, 0x00, 0x01, 0xba, 0x44, 0x00, 0x04, 0x00, 0x04, 0x01, 0x01, 0x89, 0xc3, 0xf8}
+	pes := func(id uint8, payload []byte) []byte {
+		content := append([]byte{0x80, 0x80, 0x05, 0x21, 0x00, 0x01, 0x00, 0x01}, payload...)
+		return append([]byte{0x00, 0x00, 0x01, id, byte(len(content) >> 8), byte(len(content))}, content...)
+	}
+	ps := bytes.Join([][]byte{pack, pes(0xe0, video), pes(0xc0, audio), pack, pes(0xe0, video), {0x00, 0x00, 0x01, 0xb9}}, nil)
+
+	var ts []byte
+	counters := make(map[int]byte)
+	packetize := func(pid int, data []byte) {
+		for first := true; first || len(data) != 0; first = false {
+			packet := bytes.Repeat([]byte{0xff}, 188)
+			copy(packet, []byte{tsSync, byte(pid >> 8), byte(pid), 0x10 | counters[pid]&0x0f})
+			if first {
+				packet[1] |= 0x40
+			}
+			counters[pid]++
+			data = data[copy(packet[4:], data):]
+			ts = append(ts, packet...)
+		}
+	}
+	section := func(table []byte) []byte {
+		var crc [4]byte
+		binary.BigEndian.PutUint32(crc[:], crc32MPEG(table))
+		return append(append([]byte{0}, table...), crc[:]...)
+	}
+	pat := section([]byte{0x00, 0xb0, 0x0d, 0x00, 0x01, 0xc1, 0x00, 0x00, 0x00, 0x01, 0xe1, 0x00})
+	pmt := section([]byte{0x02, 0xb0, 0x17, 0x00, 0x01, 0xc1, 0x00, 0x00, 0xe1, 0x01, 0xf0, 0x00,
+		0x02, 0xe1, 0x01, 0xf0, 0x00, 0x81, 0xe1, 0x02, 0xf0, 0x00})
+	for i := 0; i < 2; i++ {
+		packetize(0x000, pat)
+		packetize(0x100, pmt)
+		packetize(0x101, pes(0xe0, video))
+		packetize(0x102, pes(0xbd, audio))
+	}
+
+	details := VideoDetails{Title: "A Series", EpisodeTitle: "Pilot", Channel: "5-1", Duration: time.Hour}
+	tests := []struct {
+		name  string
+		input []byte
+	}{
+		{"PS", ps},
+		{"TS", ts},
+	}
+	for _, test := range tests {
+		var encrypted bytes.Buffer
+		err := Encrypt(&encrypted, bytes.NewReader(test.input), "3886854575", &EncryptOptions{Metadata: &Metadata{Details: details}})
+		if err != nil {
+			t.Fatalf("Encountered unexpected error encrypting.  Test: %s, Error: %s", test.name, err)
+		}
+		if bytes.Contains(encrypted.Bytes(), video[:32]) || bytes.Contains(encrypted.Bytes(), audio[:32]) {
+			t.Errorf("Encrypted output contains plaintext.  Test: %s", test.name)
+		}
+
+		meta, err := ReadMetadata(bytes.NewReader(encrypted.Bytes()), "3886854575")
+		if err != nil {
+			t.Fatalf("Encountered unexpected error reading metadata.  Test: %s, Error: %s", test.name, err)
+		}
+		if meta.Details.Title != details.Title || meta.Details.Channel != details.Channel || meta.Details.Duration != details.Duration {
+			t.Errorf("Encrypted metadata is invalid.  Test: %s, Details: %+v", test.name, meta.Details)
+		}
+
+		var decrypted bytes.Buffer
+		err = Decrypt(&decrypted, bytes.NewReader(encrypted.Bytes()), "3886854575")
+		if err != nil {
+			t.Fatalf("Encountered unexpected error decrypting.  Test: %s, Error: %s", test.name, err)
+		}
+		if !bytes.Contains(decrypted.Bytes(), video[:64]) || !bytes.Contains(decrypted.Bytes(), audio[:64]) {
+			t.Errorf("Decrypted output lacks plaintext.  Test: %s", test.name)
+		}
+
+		// Decrypted output carries confounders, so it should round-trip exactly
+		plain := decrypted.Bytes()
+		encrypted.Reset()
+		decrypted.Reset()
+		err = Encrypt(&encrypted, bytes.NewReader(plain), "3886854575", nil)
+		if err == nil {
+			err = Decrypt(&decrypted, &encrypted, "3886854575")
+		}
+		if err != nil {
+			t.Fatalf("Encountered unexpected error re-encrypting.  Test: %s, Error: %s", test.name, err)
+		}
+		if !bytes.Equal(plain, decrypted.Bytes()) {
+			t.Errorf("Re-encrypted output doesn't round-trip.  Test: %s", test.name)
+		}
+	}
+}
+
+// testHeader returns a TiVo file header with a single plaintext metadata segment
+func testHeader(flags uint16, content []byte) []byte {
+	var buf bytes.Buffer
+	videoOffset := 16 + 12 + len(content) + 4
+	binary.Write(&buf, binary.BigEndian, fileHeader{
+		Magic:        [4]byte{'T', 'i', 'V', 'o'},
+		Flags:        flags,
+		VideoOffset:  uint32(videoOffset),
+		MetaSegments: 1,
+	})
+	binary.Write(&buf, binary.BigEndian, metaHeader{
+		ChunkSize: uint32(12 + len(content) + 4),
+		DataSize:  uint32(len(content)),
+		ID:        1,
+		Type:      metaPlaintext,
+	})
+	buf.Write(content)
+	buf.Write([]byte{0, 0, 0, 0})
+	return buf.Bytes()
+}
+
+func TestVideoDetails(t *testing.T) {
+	doc := []byte(`<?xml version="1.0" encoding="utf-8"?>
+<TvBusMarshalledStruct:TvBusEnvelope xmlns:TvBusMarshalledStruct="http://tivo.com/developer/xml/idl/TvBusMarshalledStruct">
+  <recordedDuration>PT1H1M30S</recordedDuration>
+  <showing>
+    <duration>PT1H</duration>
+    <program>
+      <description>A description.</description>
+      <episodeTitle>Pilot</episodeTitle>
+      <series>
+        <seriesTitle>A Series</seriesTitle>
+        <uniqueId>SH0123456789</uniqueId>
+      </series>
+      <title>A Series</title>
+    </program>
+    <channel>
+      <displayMajorNumber>5</displayMajorNumber>
+      <displayMinorNumber>1</displayMinorNumber>
+      <callsign>KTVU</callsign>
+    </channel>
+  </showing>
+  <startTime>2016-02-04T20:00:00Z</startTime>
+</TvBusMarshalledStruct:TvBusEnvelope>`)
+
+	expected := VideoDetails{
+		Title:        "A Series",
+		EpisodeTitle: "Pilot",
+		SeriesID:     "SH0123456789",
+		Channel:      "5-1",
+		Callsign:     "KTVU",
+		RecordDate:   time.Date(2016, 2, 4, 20, 0, 0, 0, time.UTC),
+		Duration:     time.Hour + time.Minute + 30*time.Second,
+		Description:  "A description.",
+	}
+	details, err := parseVideoDetails(doc)
+	if err != nil {
+		t.Fatalf("Encountered unexpected error parsing video details.  Error: %s", err)
+	}
+	if !reflect.DeepEqual(expected, details) {
+		t.Errorf("Video details are invalid.  Expected: %+v, Got: %+v", expected, details)
+	}
+}
+
+func TestFormatISODuration(t *testing.T) {
+	tests := map[time.Duration]string{
+		0:                                        "PT0H0M0S",
+		time.Hour + time.Minute + 30*time.Second: "PT1H1M30S",
+		59*time.Second + 600*time.Millisecond:    "PT0H1M0S",
+		30*time.Minute + 400*time.Millisecond:    "PT0H30M0S",
+	}
+	for d, expected := range tests {
+		formatted := FormatISODuration(d)
+		if formatted != expected {
+			t.Errorf("ISO duration is invalid.  Duration: %s, Expected: %s, Got: %s", d, expected, formatted)
+		}
+		parsed, err := parseISODuration(formatted)
+		if err != nil || parsed != (d+time.Second/2)/time.Second*time.Second {
+			t.Errorf("ISO duration didn't round trip.  Duration: %s, Got: %s, Error: %v", d, parsed, err)
+		}
+	}
+}
+
+func BenchmarkPS(b *testing.B) {
+	runDevoBenchmark(b, "test.mpegps.tivo", nil)
+}
+
+func BenchmarkTS(b *testing.B) {
+	runDevoBenchmark(b, "test.mpegts.tivo", nil)
+}
+
+func BenchmarkTSParallel(b *testing.B) {
+	runDevoBenchmark(b, "test.mpegts.tivo", &Options{Parallel: 4})
+}
+
+func runDevoBenchmark(b *testing.B, file string, opts *Options) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		b.Fatalf("Encountered unexpected error reading test file.  File: %s, Error: %s", file, err)
+	}
+	b.SetBytes(int64(len(content)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	for i := 0; i < b.N; i++ {
+		err = DecryptContext(context.Background(), ioutil.Discard, bytes.NewReader(content), "3886854575", opts)
+		if err != nil {
+			b.Fatalf("Encountered unexpected error decrypting test file.  File: %s, Error: %s", file, err)
+		}
+	}
+	runtime.ReadMemStats(&after)
+
+	mb := float64(len(content)) * float64(b.N) / (1 << 20)
+	b.ReportMetric(float64(after.Mallocs-before.Mallocs)/mb, "allocs/MB")
+}
+
 func runDevoTest(t *testing.T, test devoTest) {
 	r, err := os.Open(test.file)
 	if err != nil {
@@ -81,4 +629,36 @@ func runDevoTest(t *testing.T, test devoTest) {
 	if !reflect.DeepEqual(test.decryptedMd5, h.Sum(nil)) {
 		t.Errorf("Decrypted file is invalid.  Test: %s", test.name)
 	}
+
+	_, err = r.Seek(0, 0)
+	if err != nil {
+		t.Fatalf("Encountered unexpected error rewinding test file.  Test: %s, Error: %s", test.name, err)
+	}
+	h.Reset()
+	err = DecryptContext(context.Background(), h, r, test.mak, &Options{Parallel: 4})
+	if err != nil {
+		t.Errorf("Encountered unexpected error decrypting test file in parallel.  Test: %s, Error: %s", test.name, err)
+	}
+	if !reflect.DeepEqual(test.decryptedMd5, h.Sum(nil)) {
+		t.Errorf("Parallel decrypted file is invalid.  Test: %s", test.name)
+	}
+
+	_, err = r.Seek(0, 0)
+	if err != nil {
+		t.Fatalf("Encountered unexpected error rewinding test file.  Test: %s, Error: %s", test.name, err)
+	}
+	dr, err := NewReader(r, test.mak)
+	if err != nil {
+		t.Fatalf("Encountered unexpected error creating reader.  Test: %s, Error: %s", test.name, err)
+	}
+	defer dr.Close()
+
+	h.Reset()
+	_, err = io.Copy(h, dr)
+	if err != nil {
+		t.Errorf("Encountered unexpected error reading decrypted content.  Test: %s, Error: %s", test.name, err)
+	}
+	if !reflect.DeepEqual(test.decryptedMd5, h.Sum(nil)) {
+		t.Errorf("Decrypted reader content is invalid.  Test: %s", test.name)
+	}
 }
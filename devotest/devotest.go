@@ -0,0 +1,378 @@
+// Copyright (c) 2016 Bob Ziuchkovski
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package devotest builds synthetic mpeg-ps and mpeg-ts streams for testing
+// DeVo.  Generated streams carry the confounders used to key TiVo ciphers (PES
+// private data for mpeg-ps, a TiVo private data stream for mpeg-ts), so they can
+// be scrambled with devo.Encrypt and restored exactly by devo.Decrypt.
+package devotest
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/bobziuchkovski/devo"
+	"math/rand"
+)
+
+// MAK is a media access key for use in tests
+const MAK = "3886854575"
+
+// ES describes an elementary stream.
+type ES struct {
+	ID   uint8  // PES stream ID, e.g. 0xe0 for video or 0xc0 for audio
+	PID  uint16 // Packet ID carrying the stream in mpeg-ts output
+	Type uint8  // Stream type listed in the mpeg-ts program map table
+}
+
+func (es ES) video() bool {
+	return es.ID >= 0xe0 && es.ID <= 0xef
+}
+
+// DefaultStreams holds the streams used when Options.Streams is empty: mpeg-2
+// video and mpeg audio.
+var DefaultStreams = []ES{
+	{ID: 0xe0, PID: 0x0011, Type: 0x02},
+	{ID: 0xc0, PID: 0x0014, Type: 0x03},
+}
+
+// Options controls stream generation.  The zero value produces a small stream
+// with the default streams.
+type Options struct {
+	Seed            int64 // Seed for payload content and confounders
+	Streams         []ES  // Defaults to DefaultStreams
+	Packets         int   // PES packets per stream.  Defaults to 8.
+	PayloadSize     int   // Payload bytes per PES packet (at most 65000).  Defaults to 1024.
+	SequenceHeaders bool  // Start video payloads with sequence, sequence extension, and group headers
+	QMatrices       int   // Q matrices (0-2) following each sequence header
+	HeaderStuffing  int   // PES header stuffing bytes
+	Rekey           int   // Change confounders every Rekey PES packets.  Zero never changes them.
+	Cycle           int   // Cycle through the first Cycle confounders of each stream.  Zero never reuses them.
+
+	// mpeg-ps options
+	PackStuffing int  // Pack header stuffing bytes (0-7)
+	Padding      bool // Add a padding packet to each pack
+
+	// mpeg-ts options
+	PMTPID             uint16 // Packet ID of the program map table.  Defaults to 0x0020.
+	PrivatePID         uint16 // Packet ID of the TiVo private data.  Defaults to 0x0030.
+	Adaptation         bool   // Add an adaptation field with a PCR to the first packet of each PES packet
+	AdaptationStuffing int    // Adaptation field stuffing bytes (0-128) when Adaptation is set
+}
+
+// epoch identifies the confounder used by a stream between changes
+type epoch struct {
+	id uint8
+	n  int
+}
+
+type generator struct {
+	opts     Options
+	rng      *rand.Rand
+	buf      bytes.Buffer
+	private  map[epoch][]byte // PES private data by stream ID and confounder epoch
+	counters map[uint16]byte  // Continuity counters by packet ID
+}
+
+func newGenerator(opts Options) *generator {
+	if len(opts.Streams) == 0 {
+		opts.Streams = DefaultStreams
+	}
+	if opts.Packets == 0 {
+		opts.Packets = 8
+	}
+	if opts.PayloadSize == 0 {
+		opts.PayloadSize = 1024
+	}
+	if opts.PMTPID == 0 {
+		opts.PMTPID = 0x0020
+	}
+	if opts.PrivatePID == 0 {
+		opts.PrivatePID = 0x0030
+	}
+	return &generator{
+		opts:     opts,
+		rng:      rand.New(rand.NewSource(opts.Seed)),
+		private:  make(map[epoch][]byte),
+		counters: make(map[uint16]byte),
+	}
+}
+
+// PS returns a plain mpeg-ps stream.  Each PES packet is preceded by a pack
+// header, and the first pack includes a system header.
+func PS(opts Options) []byte {
+	g := newGenerator(opts)
+	for i := 0; i < g.opts.Packets; i++ {
+		for j, es := range g.opts.Streams {
+			g.pack()
+			if i == 0 && j == 0 {
+				g.systemHeader()
+			}
+			if g.opts.Padding {
+				g.buf.Write([]byte{0x00, 0x00, 0x01, 0xbe, 0x00, 0x10})
+				g.buf.Write(bytes.Repeat([]byte{0xff}, 0x10))
+			}
+			g.buf.Write(g.pes(es, i, true))
+		}
+	}
+	g.buf.Write([]byte{0x00, 0x00, 0x01, 0xb9})
+	return g.buf.Bytes()
+}
+
+// TS returns a plain mpeg-ts stream with a single program.  The program tables
+// and TiVo private data are repeated ahead of each round of PES packets.
+func TS(opts Options) []byte {
+	g := newGenerator(opts)
+	for i := 0; i < g.opts.Packets; i++ {
+		g.tables(i)
+		for _, es := range g.opts.Streams {
+			g.packetize(es.PID, g.pes(es, i, false), true)
+		}
+	}
+	return g.buf.Bytes()
+}
+
+func (g *generator) pack() {
+	stuffing := g.opts.PackStuffing & 0x07
+	g.buf.Write([]byte{0x00, 0x00, 0x01, 0xba, 0x44, 0x00, 0x04, 0x00, 0x04, 0x01, 0x01, 0x89, 0xc3, 0xf8 | byte(stuffing)})
+	g.buf.Write(bytes.Repeat([]byte{0xff}, stuffing))
+}
+
+func (g *generator) systemHeader() {
+	content := []byte{0x80, 0xc4, 0xe1, 0x04, 0xe1, 0xff}
+	for _, es := range g.opts.Streams {
+		content = append(content, es.ID, 0xe0, 0xe8)
+	}
+	g.buf.Write([]byte{0x00, 0x00, 0x01, 0xbb, byte(len(content) >> 8), byte(len(content))})
+	g.buf.Write(content)
+}
+
+// pes returns the index'th PES packet of es, with private data if requested
+func (g *generator) pes(es ES, index int, private bool) []byte {
+	pts := int64(index) * 3003
+	flags := byte(0x80) // PTS present
+	data := []byte{
+		0x21 | byte(pts>>29)&0x0e,
+		byte(pts >> 22),
+		byte(pts>>14) | 0x01,
+		byte(pts >> 7),
+		byte(pts<<1) | 0x01,
+	}
+	if private {
+		flags |= 0x01 // PES extension present
+		data = append(data, 0x8e)
+		data = append(data, g.privateData(es, index)...)
+	}
+	data = append(data, bytes.Repeat([]byte{0xff}, g.opts.HeaderStuffing)...)
+	content := append([]byte{0x80, flags, byte(len(data))}, data...)
+
+	if es.video() && g.opts.SequenceHeaders {
+		intra := byte(0x10)
+		if g.opts.QMatrices > 0 {
+			intra |= 1 << 1
+		}
+		if g.opts.QMatrices > 1 {
+			intra |= 1 << 0
+		}
+		content = append(content, 0x00, 0x00, 0x01, 0xb3, 0x2d, 0x01, 0xe0, 0x24, 0x18, 0x98, 0x40, intra)
+		content = append(content, g.random(64*g.opts.QMatrices)...)
+		content = append(content, 0x00, 0x00, 0x01, 0xb5, 0x14, 0x8a, 0x00, 0x01, 0x00, 0x00)
+		content = append(content, 0x00, 0x00, 0x01, 0xb8, 0x00, 0x08, 0x00, 0x40)
+	}
+	content = append(content, g.random(g.opts.PayloadSize)...)
+	return append([]byte{0x00, 0x00, 0x01, es.ID, byte(len(content) >> 8), byte(len(content))}, content...)
+}
+
+// privateData returns the PES private data for the index'th packet of es.  The
+// confounder is held in bytes 1-4.
+func (g *generator) privateData(es ES, index int) []byte {
+	e := epoch{id: es.ID}
+	if g.opts.Rekey > 0 {
+		e.n = index / g.opts.Rekey
+	}
+	if g.opts.Cycle > 0 {
+		e.n %= g.opts.Cycle
+	}
+	if g.private[e] == nil {
+		g.private[e] = g.random(16)
+	}
+	return g.private[e]
+}
+
+// random returns n bytes of content lacking zero bytes, so that start codes
+// aren't emulated
+func (g *generator) random(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(1 + g.rng.Intn(255))
+	}
+	return b
+}
+
+// tables writes the program association table, program map table, and TiVo
+// private data ahead of the index'th round of PES packets
+func (g *generator) tables(index int) {
+	pat := []byte{0x00, 0xb0, 0x00, 0x00, 0x01, 0xc1, 0x00, 0x00,
+		0x00, 0x01, 0xe0 | byte(g.opts.PMTPID>>8), byte(g.opts.PMTPID)}
+	g.packetize(0x0000, append([]byte{0x00}, section(pat)...), false)
+
+	first := g.opts.Streams[0].PID
+	pmt := []byte{0x02, 0xb0, 0x00, 0x00, 0x01, 0xc1, 0x00, 0x00,
+		0xe0 | byte(first>>8), byte(first), 0xf0, 0x00}
+	for _, es := range g.opts.Streams {
+		pmt = append(pmt, es.Type, 0xe0|byte(es.PID>>8), byte(es.PID), 0xf0, 0x00)
+	}
+	pmt = append(pmt, 0x97, 0xe0|byte(g.opts.PrivatePID>>8), byte(g.opts.PrivatePID), 0xf0, 0x00)
+	g.packetize(g.opts.PMTPID, append([]byte{0x00}, section(pmt)...), false)
+
+	private := []byte{'T', 'i', 'V', 'o', 0x00, 0x00, 0x00, 0x00, 0x00, byte(20 * len(g.opts.Streams))}
+	for _, es := range g.opts.Streams {
+		entry := make([]byte, 20)
+		entry[0], entry[1], entry[2] = 0xe0|byte(es.PID>>8), byte(es.PID), es.ID
+		copy(entry[5:9], g.privateData(es, index)[1:5])
+		private = append(private, entry...)
+	}
+	g.packetize(g.opts.PrivatePID, private, false)
+}
+
+// section fills in the length and CRC of a PSI section
+func section(table []byte) []byte {
+	length := len(table) + 4 - 3
+	table[1] = table[1]&0xf0 | byte(length>>8)
+	table[2] = byte(length)
+	crc := crc32MPEG(table)
+	return append(table, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+}
+
+func crc32MPEG(b []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, octet := range b {
+		crc ^= uint32(octet) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// packetize splits data into transport packets for pid.  PES data is terminated
+// with adaptation field stuffing, while other data is terminated with payload
+// stuffing.
+func (g *generator) packetize(pid uint16, data []byte, pes bool) {
+	for first := true; first || len(data) != 0; first = false {
+		packet := make([]byte, 188)
+		packet[0] = 0x47
+		packet[1], packet[2] = byte(pid>>8)&0x1f, byte(pid)
+		if first {
+			packet[1] |= 0x40
+		}
+
+		var adaptation []byte // Excluding the length byte
+		if pes && first && g.opts.Adaptation {
+			stuffing := g.opts.AdaptationStuffing
+			if stuffing > 128 {
+				stuffing = 128
+			}
+			adaptation = []byte{0x10, 0x00, 0x00, 0x00, 0x00, 0x7e, 0x00} // PCR flag and a zero PCR
+			adaptation = append(adaptation, bytes.Repeat([]byte{0xff}, stuffing)...)
+		}
+		room := 184
+		if adaptation != nil {
+			room -= 1 + len(adaptation)
+		}
+		if pes && len(data) < room {
+			// Stuff the adaptation field so the payload fills the rest of the packet
+			if adaptation == nil && room-len(data) > 1 {
+				adaptation = []byte{0x00}
+			} else if adaptation == nil {
+				adaptation = []byte{}
+			}
+			for 1+len(adaptation) < 184-len(data) {
+				adaptation = append(adaptation, 0xff)
+			}
+			room = len(data)
+		}
+
+		packet[3] = 0x10 | g.counters[pid]&0x0f
+		g.counters[pid]++
+		offset := 4
+		if adaptation != nil {
+			packet[3] |= 0x20
+			packet[4] = byte(len(adaptation))
+			copy(packet[5:], adaptation)
+			offset += 1 + len(adaptation)
+		}
+		n := copy(packet[offset:offset+room], data)
+		data = data[n:]
+		for i := offset + n; i < len(packet); i++ {
+			packet[i] = 0xff
+		}
+		g.buf.Write(packet)
+	}
+}
+
+// Scramble encrypts plain as a TiVo file using mak.  Confounders for any streams
+// lacking them are drawn from a fixed seed, so the result is reproducible.
+func Scramble(plain []byte, mak string) ([]byte, error) {
+	var buf bytes.Buffer
+	opts := &devo.EncryptOptions{Rand: rand.New(rand.NewSource(1))}
+	err := devo.Encrypt(&buf, bytes.NewReader(plain), mak, opts)
+	return buf.Bytes(), err
+}
+
+// RoundTrip scrambles plain and decrypts the result, returning an error unless
+// the video content was scrambled and decryption restores plain exactly.
+func RoundTrip(plain []byte, mak string) error {
+	scrambled, err := Scramble(plain, mak)
+	if err != nil {
+		return fmt.Errorf("scramble failed: %s", err)
+	}
+	if len(scrambled) < 16 {
+		return fmt.Errorf("scrambled output lacks a file header")
+	}
+	offset := int(scrambled[10])<<24 | int(scrambled[11])<<16 | int(scrambled[12])<<8 | int(scrambled[13])
+	if bytes.Equal(scrambled[offset:], plain) {
+		return fmt.Errorf("scrambled video is identical to the plaintext")
+	}
+
+	var decrypted bytes.Buffer
+	err = devo.Decrypt(&decrypted, bytes.NewReader(scrambled), mak)
+	if err != nil {
+		return fmt.Errorf("decrypt failed: %s", err)
+	}
+	return Compare(plain, decrypted.Bytes())
+}
+
+// Compare returns an error describing the first difference between expected
+// and actual, or nil if they're identical.
+func Compare(expected, actual []byte) error {
+	for i := 0; i < len(expected) && i < len(actual); i++ {
+		if expected[i] != actual[i] {
+			return fmt.Errorf("content differs at offset 0x%08x: expected 0x%02x, got 0x%02x", i, expected[i], actual[i])
+		}
+	}
+	if len(expected) != len(actual) {
+		return fmt.Errorf("content length differs: expected %d, got %d", len(expected), len(actual))
+	}
+	return nil
+}
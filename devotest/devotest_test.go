@@ -0,0 +1,752 @@
+// Copyright (c) 2016 Bob Ziuchkovski
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package devotest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/bobziuchkovski/devo"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type roundTripTest struct {
+	name string
+	opts Options
+}
+
+var roundTripTests = []roundTripTest{
+	{"Defaults", Options{}},
+	{"Single Stream", Options{Streams: DefaultStreams[:1]}},
+	{"AC-3 Audio", Options{Streams: []ES{DefaultStreams[0], {ID: 0xbd, PID: 0x0015, Type: 0x81}}}},
+	{"Sequence Headers", Options{SequenceHeaders: true}},
+	{"One Q Matrix", Options{SequenceHeaders: true, QMatrices: 1}},
+	{"Two Q Matrices", Options{SequenceHeaders: true, QMatrices: 2}},
+	{"Header Stuffing", Options{HeaderStuffing: 16, SequenceHeaders: true}},
+	{"Rekey", Options{Packets: 12, Rekey: 3}},
+	{"Tiny Payloads", Options{PayloadSize: 1}},
+	{"Large Payloads", Options{PayloadSize: 60000, Packets: 2}},
+	{"Pack Stuffing", Options{PackStuffing: 7}},
+	{"Padding", Options{Padding: true}},
+	{"Adaptation", Options{Adaptation: true}},
+	{"Adaptation Stuffing", Options{Adaptation: true, AdaptationStuffing: 100}},
+	{"Adaptation With Q Matrices", Options{Adaptation: true, SequenceHeaders: true, QMatrices: 2}},
+	{"Overrun Headers", Options{Adaptation: true, AdaptationStuffing: 128, SequenceHeaders: true, QMatrices: 2}},
+	{"Many Streams", Options{Streams: manyStreams(10)}},
+	{"Custom PIDs", Options{PMTPID: 0x1000, PrivatePID: 0x1ffe}},
+}
+
+func manyStreams(n int) []ES {
+	streams := []ES{DefaultStreams[0]}
+	for i := 0; len(streams) < n; i++ {
+		streams = append(streams, ES{ID: 0xc0 + uint8(i), PID: 0x0100 + uint16(i), Type: 0x03})
+	}
+	return streams
+}
+
+func TestPSRoundTrip(t *testing.T) {
+	for _, test := range roundTripTests {
+		err := RoundTrip(PS(test.opts), MAK)
+		if err != nil {
+			t.Errorf("Encountered unexpected error in round trip.  Test: %s, Error: %s", test.name, err)
+		}
+	}
+}
+
+func TestTSRoundTrip(t *testing.T) {
+	for _, test := range roundTripTests {
+		err := RoundTrip(TS(test.opts), MAK)
+		if err != nil {
+			t.Errorf("Encountered unexpected error in round trip.  Test: %s, Error: %s", test.name, err)
+		}
+	}
+}
+
+func TestDeterministic(t *testing.T) {
+	opts := Options{Seed: 42, SequenceHeaders: true}
+	if !bytes.Equal(PS(opts), PS(opts)) || !bytes.Equal(TS(opts), TS(opts)) {
+		t.Errorf("Generated streams differ for the same seed")
+	}
+	if bytes.Equal(TS(opts), TS(Options{Seed: 43, SequenceHeaders: true})) {
+		t.Errorf("Generated streams match for different seeds")
+	}
+}
+
+func TestDecryptModes(t *testing.T) {
+	opts := Options{Packets: 200, SequenceHeaders: true, Adaptation: true, Rekey: 50}
+	for _, plain := range [][]byte{PS(opts), TS(opts)} {
+		scrambled, err := Scramble(plain, MAK)
+		if err != nil {
+			t.Fatalf("Encountered unexpected error scrambling.  Error: %s", err)
+		}
+
+		var parallel bytes.Buffer
+		err = devo.DecryptContext(context.Background(), &parallel, bytes.NewReader(scrambled), MAK, &devo.Options{Parallel: 3})
+		if err != nil {
+			t.Errorf("Encountered unexpected error decrypting in parallel.  Error: %s", err)
+		}
+		if err = Compare(plain, parallel.Bytes()); err != nil {
+			t.Errorf("Parallel decryption is invalid.  Error: %s", err)
+		}
+
+		r, err := devo.NewReader(bytes.NewReader(scrambled), MAK)
+		if err != nil {
+			t.Fatalf("Encountered unexpected error creating reader.  Error: %s", err)
+		}
+		streamed, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Errorf("Encountered unexpected error reading decrypted content.  Error: %s", err)
+		}
+		if err = Compare(plain, streamed); err != nil {
+			t.Errorf("Reader decryption is invalid.  Error: %s", err)
+		}
+	}
+}
+
+func TestParallelSharedCipher(t *testing.T) {
+	// Both video PIDs carry stream ID 0xe0 with the same confounders, so they share a cipher
+	streams := []ES{DefaultStreams[0], {ID: 0xe0, PID: 0x0012, Type: 0x02}, DefaultStreams[1]}
+	plain := TS(Options{Streams: streams, Packets: 200, Rekey: 50})
+	scrambled, err := Scramble(plain, MAK)
+	if err != nil {
+		t.Fatalf("Encountered unexpected error scrambling.  Error: %s", err)
+	}
+
+	var serial, parallel bytes.Buffer
+	err = devo.DecryptContext(context.Background(), &serial, bytes.NewReader(scrambled), MAK, nil)
+	if err != nil {
+		t.Fatalf("Encountered unexpected error decrypting.  Error: %s", err)
+	}
+	if err = Compare(plain, serial.Bytes()); err != nil {
+		t.Errorf("Serial decryption is invalid.  Error: %s", err)
+	}
+	err = devo.DecryptContext(context.Background(), &parallel, bytes.NewReader(scrambled), MAK, &devo.Options{Parallel: 4})
+	if err != nil {
+		t.Fatalf("Encountered unexpected error decrypting in parallel.  Error: %s", err)
+	}
+	if !bytes.Equal(serial.Bytes(), parallel.Bytes()) {
+		t.Errorf("Parallel decryption differs from serial decryption")
+	}
+}
+
+func TestDamagedTables(t *testing.T) {
+	// Damage the program map and private data repeated ahead of the second
+	// round, leaving the tables from the first round in effect
+	plain := TS(Options{Packets: 4})
+	scrambled, err := Scramble(plain, MAK)
+	if err != nil {
+		t.Fatalf("Encountered unexpected error scrambling.  Error: %s", err)
+	}
+	videoOffset := len(scrambled) - len(plain)
+	rounds := 0
+	for i := 0; i < len(plain); i += 188 {
+		pid := uint16(plain[i+1]&0x1f)<<8 | uint16(plain[i+2])
+		if pid == 0x0000 {
+			rounds++
+		}
+		if rounds != 2 {
+			continue
+		}
+		switch pid {
+		case 0x0020:
+			plain[i+10] ^= 0xff
+			scrambled[videoOffset+i+10] ^= 0xff
+		case 0x0030:
+			plain[i+4] ^= 0xff
+			scrambled[videoOffset+i+4] ^= 0xff
+		}
+	}
+
+	var (
+		decrypted bytes.Buffer
+		stats     devo.Stats
+	)
+	opts := &devo.Options{Progress: func(s devo.Stats) { stats = s }}
+	err = devo.DecryptContext(context.Background(), &decrypted, bytes.NewReader(scrambled), MAK, opts)
+	if err != nil {
+		t.Fatalf("Encountered unexpected error decrypting damaged tables.  Error: %s", err)
+	}
+	if err = Compare(plain, decrypted.Bytes()); err != nil {
+		t.Errorf("Decryption with damaged tables is invalid.  Error: %s", err)
+	}
+	if stats.BadTables != 2 {
+		t.Errorf("Damaged tables miscounted.  Expected: 2, Got: %d", stats.BadTables)
+	}
+}
+
+func TestDecryptRange(t *testing.T) {
+	// The larger streams exceed the initial lookbehind, so ranges late in the
+	// stream start mid-stream, and at offsets that aren't packet boundaries
+	tests := []struct {
+		name string
+		opts Options
+	}{
+		{"Long", Options{Packets: 120, PayloadSize: 60000, Rekey: 4}},
+		{"Rekey", Options{Packets: 64, PayloadSize: 40000, Rekey: 4}},
+		{"No Rekey", Options{Packets: 64, PayloadSize: 40000}},
+		{"Reused Confounders", Options{Packets: 120, PayloadSize: 60000, Rekey: 4, Cycle: 3}},
+		{"Small", Options{Rekey: 2}},
+	}
+	for _, test := range tests {
+		for _, plain := range [][]byte{PS(test.opts), TS(test.opts)} {
+			scrambled, err := Scramble(plain, MAK)
+			if err != nil {
+				t.Fatalf("Encountered unexpected error scrambling.  Test: %s, Error: %s", test.name, err)
+			}
+			size := int64(len(plain))
+			ranges := [][2]int64{{0, -1}, {0, 1}, {size / 3, size/3 + 5000}, {size - size/5, -1}, {size - 1, size}, {size, -1}, {size / 2, size / 2}}
+			for _, offset := range []int64{5<<20 + 1, 7<<20 + 93, 9<<20 + 187} {
+				if offset+100000 <= size {
+					ranges = append(ranges, [2]int64{offset, offset + 100000})
+				}
+			}
+			if plain[0] == 0x47 && size > 5<<20 {
+				// Start decrypting at a byte resembling a sync byte, 4 MiB ahead of the range
+				videoOffset := int64(len(scrambled)) - size
+				for offset := size - 1<<20 - 4<<20; offset > 0; offset-- {
+					if offset%188 != 0 && scrambled[videoOffset+offset] == 0x47 {
+						ranges = append(ranges, [2]int64{offset + 4<<20, offset + 4<<20 + 1000})
+						break
+					}
+				}
+			}
+			for _, r := range ranges {
+				var decrypted bytes.Buffer
+				err = devo.DecryptRange(&decrypted, bytes.NewReader(scrambled), MAK, r[0], r[1])
+				if err != nil {
+					t.Errorf("Encountered unexpected error decrypting range.  Test: %s, Range: %v, Error: %s", test.name, r, err)
+					continue
+				}
+				expected := plain[r[0]:]
+				if r[1] >= 0 {
+					expected = plain[r[0]:r[1]]
+				}
+				if !bytes.Equal(decrypted.Bytes(), expected) {
+					t.Errorf("Decrypted range is invalid.  Test: %s, Range: %v, Expected length: %d, Actual length: %d", test.name, r, len(expected), decrypted.Len())
+				}
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	err := devo.DecryptRange(&buf, bytes.NewReader([]byte("TiVo")), MAK, 10, 5)
+	if err == nil {
+		t.Errorf("Expected error for invalid range")
+	}
+}
+
+func TestSeeker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "devotest")
+	if err != nil {
+		t.Fatalf("Encountered unexpected error creating temp dir.  Error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name string
+		opts Options
+	}{
+		{"Rekey", Options{Packets: 64, PayloadSize: 40000, Rekey: 4}},
+		{"No Rekey", Options{Packets: 64, PayloadSize: 40000}},
+	}
+	for _, test := range tests {
+		for i, plain := range [][]byte{PS(test.opts), TS(test.opts)} {
+			scrambled, err := Scramble(plain, MAK)
+			if err != nil {
+				t.Fatalf("Encountered unexpected error scrambling.  Test: %s, Error: %s", test.name, err)
+			}
+			indexPath := filepath.Join(dir, fmt.Sprintf("%s-%d.devoidx", test.name, i))
+
+			// The second seeker reuses the index cached by the first
+			for pass := 0; pass < 2; pass++ {
+				seeker, err := devo.NewSeeker(bytes.NewReader(scrambled), MAK, &devo.SeekerOptions{IndexPath: indexPath})
+				if err != nil {
+					t.Fatalf("Encountered unexpected error creating seeker.  Test: %s, Error: %s", test.name, err)
+				}
+				size := int64(len(plain))
+				if seeker.Size() != size {
+					t.Errorf("Seeker size is incorrect.  Test: %s, Expected: %d, Actual: %d", test.name, size, seeker.Size())
+				}
+				for _, offset := range []int64{size / 2, size - 100, 10, size / 4, size/4 + 1000, size - size/10} {
+					_, err = seeker.Seek(offset, io.SeekStart)
+					if err != nil {
+						t.Fatalf("Encountered unexpected error seeking.  Test: %s, Error: %s", test.name, err)
+					}
+					buf := make([]byte, 5000)
+					n, err := io.ReadFull(seeker, buf)
+					if err != nil && err != io.ErrUnexpectedEOF {
+						t.Errorf("Encountered unexpected error reading.  Test: %s, Offset: %d, Error: %s", test.name, offset, err)
+						continue
+					}
+					expected := plain[offset:]
+					if len(expected) > len(buf) {
+						expected = expected[:len(buf)]
+					}
+					if !bytes.Equal(buf[:n], expected) {
+						t.Errorf("Seeker content is invalid.  Test: %s, Pass: %d, Offset: %d", test.name, pass, offset)
+					}
+				}
+			}
+			if _, err := os.Stat(indexPath); err != nil {
+				t.Errorf("Index wasn't cached.  Test: %s, Error: %s", test.name, err)
+			}
+		}
+	}
+}
+
+func TestSeekerIndexFunc(t *testing.T) {
+	opts := Options{Packets: 64, PayloadSize: 40000, Rekey: 4}
+	plain := TS(opts)
+	scrambled, err := Scramble(plain, MAK)
+	if err != nil {
+		t.Fatalf("Encountered unexpected error scrambling.  Error: %s", err)
+	}
+	other, err := Scramble(PS(opts), MAK)
+	if err != nil {
+		t.Fatalf("Encountered unexpected error scrambling.  Error: %s", err)
+	}
+	otherIndex, err := devo.BuildIndex(bytes.NewReader(other), MAK)
+	if err != nil {
+		t.Fatalf("Encountered unexpected error building index.  Error: %s", err)
+	}
+
+	// The first seeker loads the index, the second reuses it, and the third is
+	// handed an index for another file, which is ignored
+	var shared *devo.Index
+	loads := 0
+	funcs := []func(load func() (*devo.Index, error)) (*devo.Index, error){
+		func(load func() (*devo.Index, error)) (*devo.Index, error) {
+			loads++
+			idx, err := load()
+			shared = idx
+			return idx, err
+		},
+		func(load func() (*devo.Index, error)) (*devo.Index, error) { return shared, nil },
+		func(load func() (*devo.Index, error)) (*devo.Index, error) { return otherIndex, nil },
+	}
+	for i, indexFunc := range funcs {
+		seeker, err := devo.NewSeeker(bytes.NewReader(scrambled), MAK, &devo.SeekerOptions{IndexFunc: indexFunc})
+		if err != nil {
+			t.Fatalf("Encountered unexpected error creating seeker.  Error: %s", err)
+		}
+		offset := int64(len(plain)) / 2
+		_, err = seeker.Seek(offset, io.SeekStart)
+		if err != nil {
+			t.Fatalf("Encountered unexpected error seeking.  Error: %s", err)
+		}
+		buf := make([]byte, 5000)
+		_, err = io.ReadFull(seeker, buf)
+		if err != nil {
+			t.Errorf("Encountered unexpected error reading.  Seeker: %d, Error: %s", i, err)
+			continue
+		}
+		if !bytes.Equal(buf, plain[offset:offset+int64(len(buf))]) {
+			t.Errorf("Seeker content is invalid.  Seeker: %d", i)
+		}
+	}
+	if loads != 1 || shared == nil {
+		t.Errorf("Index wasn't shared.  Loads: %d", loads)
+	}
+}
+
+func TestIndex(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      Options
+		keyframes bool
+	}{
+		{"Sequence Headers", Options{Packets: 64, PayloadSize: 40000, Rekey: 4, SequenceHeaders: true}, true},
+		{"No Sequence Headers", Options{Packets: 64, PayloadSize: 40000, Rekey: 4}, false},
+	}
+	for _, test := range tests {
+		for _, plain := range [][]byte{PS(test.opts), TS(test.opts)} {
+			scrambled, err := Scramble(plain, MAK)
+			if err != nil {
+				t.Fatalf("Encountered unexpected error scrambling.  Test: %s, Error: %s", test.name, err)
+			}
+			var decrypted, sidecar bytes.Buffer
+			err = devo.DecryptContext(context.Background(), &decrypted, bytes.NewReader(scrambled), MAK, &devo.Options{Index: &sidecar, Parallel: 4})
+			if err != nil {
+				t.Fatalf("Encountered unexpected error decrypting.  Test: %s, Error: %s", test.name, err)
+			}
+			if !bytes.Equal(decrypted.Bytes(), plain) {
+				t.Errorf("Decrypted content is invalid.  Test: %s", test.name)
+			}
+
+			idx, err := devo.ReadIndex(&sidecar)
+			if err != nil {
+				t.Fatalf("Encountered unexpected error reading index.  Test: %s, Error: %s", test.name, err)
+			}
+			if idx.Size != int64(len(plain)) || len(idx.Points) == 0 {
+				t.Errorf("Index is invalid.  Test: %s, Size: %d, Points: %d", test.name, idx.Size, len(idx.Points))
+			}
+			keyframes := idx.Keyframes()
+			if test.keyframes && len(keyframes) != test.opts.Packets {
+				t.Errorf("Expected a keyframe for each video PES packet.  Test: %s, Keyframes: %d", test.name, len(keyframes))
+			}
+			if !test.keyframes && len(keyframes) != 0 {
+				t.Errorf("Expected no keyframes.  Test: %s, Keyframes: %d", test.name, len(keyframes))
+			}
+			for _, point := range idx.Points {
+				if point.PTS < 0 || point.PTS%3003 != 0 {
+					t.Errorf("Index point PTS is invalid.  Test: %s, Point: %+v", test.name, point)
+				}
+				if idx.Stream == devo.StreamPS && !bytes.HasPrefix(plain[point.Offset:], []byte{0x00, 0x00, 0x01, 0xba}) {
+					t.Errorf("Index point isn't at a pack start.  Test: %s, Point: %+v", test.name, point)
+				}
+				if idx.Stream == devo.StreamTS && (point.Offset%188 != 0 || plain[point.Offset+1]&0x40 == 0) {
+					t.Errorf("Index point isn't at a payload start.  Test: %s, Point: %+v", test.name, point)
+				}
+			}
+
+			// Seeking resumes from the points of the supplied index
+			seeker, err := devo.NewSeeker(bytes.NewReader(scrambled), MAK, &devo.SeekerOptions{Index: idx})
+			if err != nil {
+				t.Fatalf("Encountered unexpected error creating seeker.  Test: %s, Error: %s", test.name, err)
+			}
+			for _, point := range idx.Points {
+				_, err = seeker.Seek(point.Offset, io.SeekStart)
+				if err != nil {
+					t.Fatalf("Encountered unexpected error seeking.  Test: %s, Error: %s", test.name, err)
+				}
+				buf := make([]byte, 1000)
+				n, err := io.ReadFull(seeker, buf)
+				if err != nil && err != io.ErrUnexpectedEOF {
+					t.Errorf("Encountered unexpected error reading.  Test: %s, Offset: %d, Error: %s", test.name, point.Offset, err)
+					continue
+				}
+				if !bytes.Equal(buf[:n], plain[point.Offset:point.Offset+int64(n)]) {
+					t.Errorf("Seeker content is invalid.  Test: %s, Offset: %d", test.name, point.Offset)
+				}
+			}
+
+			built, err := devo.BuildIndex(bytes.NewReader(scrambled), MAK)
+			if err != nil {
+				t.Fatalf("Encountered unexpected error building index.  Test: %s, Error: %s", test.name, err)
+			}
+			var rewritten bytes.Buffer
+			_, err = built.WriteTo(&rewritten)
+			if err != nil {
+				t.Fatalf("Encountered unexpected error writing index.  Test: %s, Error: %s", test.name, err)
+			}
+			_, err = idx.WriteTo(&sidecar)
+			if err != nil {
+				t.Fatalf("Encountered unexpected error writing index.  Test: %s, Error: %s", test.name, err)
+			}
+			if !bytes.Equal(rewritten.Bytes(), sidecar.Bytes()) {
+				t.Errorf("Built index differs from the index written during decryption.  Test: %s", test.name)
+			}
+
+			corrupt := append([]byte(nil), sidecar.Bytes()...)
+			corrupt[len(corrupt)/2] ^= 0xff
+			_, err = devo.ReadIndex(bytes.NewReader(corrupt))
+			if !errors.Is(err, devo.ErrBadIndex) {
+				t.Errorf("Expected ErrBadIndex for corrupt index.  Test: %s, Error: %v", test.name, err)
+			}
+		}
+	}
+}
+
+func TestClip(t *testing.T) {
+	opts := Options{Packets: 64, PayloadSize: 4000, Rekey: 4, SequenceHeaders: true}
+	clips := [][2]time.Duration{{500 * time.Millisecond, time.Second}, {time.Second, 0}, {0, 700 * time.Millisecond}}
+	for _, plain := range [][]byte{PS(opts), TS(opts)} {
+		scrambled, err := Scramble(plain, MAK)
+		if err != nil {
+			t.Fatalf("Encountered unexpected error scrambling.  Error: %s", err)
+		}
+		idx, err := devo.BuildIndex(bytes.NewReader(scrambled), MAK)
+		if err != nil {
+			t.Fatalf("Encountered unexpected error building index.  Error: %s", err)
+		}
+		keyframes := idx.Keyframes()
+
+		for _, clip := range clips {
+			// The clip runs from the keyframe at or before the start to the keyframe at or after the end
+			from, to := int64(0), int64(len(plain))
+			for _, point := range keyframes {
+				at := time.Duration(point.PTS) * time.Second / 90000
+				if at <= clip[0] {
+					from = point.Offset
+				}
+				if clip[1] > 0 && at >= clip[1] && to == int64(len(plain)) {
+					to = point.Offset
+				}
+			}
+
+			var clipped bytes.Buffer
+			err = devo.DecryptContext(context.Background(), &clipped, bytes.NewReader(scrambled), MAK, &devo.Options{Start: clip[0], End: clip[1]})
+			if err != nil {
+				t.Errorf("Encountered unexpected error clipping.  Stream: %s, Clip: %v, Error: %s", idx.Stream, clip, err)
+				continue
+			}
+			if idx.Stream == devo.StreamPS {
+				expected := append([]byte(nil), bytes.TrimSuffix(plain[from:to], []byte{0x00, 0x00, 0x01, 0xb9})...)
+				expected = append(expected, 0x00, 0x00, 0x01, 0xb9)
+				if !bytes.Equal(clipped.Bytes(), expected) {
+					t.Errorf("Clipped content is invalid.  Stream: %s, Clip: %v, Expected length: %d, Actual length: %d", idx.Stream, clip, len(expected), clipped.Len())
+				}
+			}
+
+			analysis, err := devo.Analyze(bytes.NewReader(clipped.Bytes()), nil)
+			if err != nil {
+				t.Errorf("Encountered unexpected error analyzing clip.  Stream: %s, Clip: %v, Error: %s", idx.Stream, clip, err)
+				continue
+			}
+			if analysis.Truncated {
+				t.Errorf("Clip is truncated.  Stream: %s, Clip: %v", idx.Stream, clip)
+			}
+			for _, stream := range analysis.Streams {
+				if stream.ContinuityErrors != 0 {
+					t.Errorf("Clip has continuity errors.  Stream: %s, Clip: %v, Analysis: %+v", idx.Stream, clip, stream)
+				}
+				if stream.Codec == devo.CodecMPEG2Video && (stream.FirstPTS > int64(clip[0]/time.Millisecond)*90 || (clip[1] > 0 && stream.LastPTS >= int64(clip[1]/time.Millisecond)*90)) {
+					t.Errorf("Clip timestamps are out of range.  Stream: %s, Clip: %v, First PTS: %d, Last PTS: %d", idx.Stream, clip, stream.FirstPTS, stream.LastPTS)
+				}
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	err := devo.DecryptContext(context.Background(), &buf, bytes.NewReader(nil), MAK, &devo.Options{Start: time.Second, End: time.Second})
+	if err == nil {
+		t.Errorf("Expected error for invalid clip")
+	}
+}
+
+func TestCuts(t *testing.T) {
+	opts := Options{Packets: 64, PayloadSize: 4000, Rekey: 4, SequenceHeaders: true}
+	cutLists := [][]devo.Cut{
+		{{Start: 300 * time.Millisecond, End: 600 * time.Millisecond}, {Start: 900 * time.Millisecond, End: 1200 * time.Millisecond}},
+		{{Start: 0, End: 400 * time.Millisecond}},
+		{{Start: time.Second, End: time.Hour}, {Start: 200 * time.Millisecond, End: 500 * time.Millisecond}, {Start: 400 * time.Millisecond, End: 700 * time.Millisecond}},
+	}
+	for _, plain := range [][]byte{PS(opts), TS(opts)} {
+		scrambled, err := Scramble(plain, MAK)
+		if err != nil {
+			t.Fatalf("Encountered unexpected error scrambling.  Error: %s", err)
+		}
+		idx, err := devo.BuildIndex(bytes.NewReader(scrambled), MAK)
+		if err != nil {
+			t.Fatalf("Encountered unexpected error building index.  Error: %s", err)
+		}
+		keyframes := idx.Keyframes()
+
+		for _, cuts := range cutLists {
+			// Each GOP is kept unless the cuts cover it entirely
+			var expected []byte
+			for i, point := range keyframes {
+				from := time.Duration(point.PTS) * time.Second / 90000
+				to, end := time.Duration(1<<62), int64(len(plain))
+				if i+1 < len(keyframes) {
+					to = time.Duration(keyframes[i+1].PTS) * time.Second / 90000
+					end = keyframes[i+1].Offset
+				}
+				start := point.Offset
+				if i == 0 {
+					start = 0
+				}
+				for covered := true; covered; {
+					covered = false
+					for _, cut := range cuts {
+						if cut.Start <= from && from < cut.End {
+							from, covered = cut.End, true
+						}
+					}
+				}
+				if from < to {
+					expected = append(expected, plain[start:end]...)
+				}
+			}
+			expected = append(bytes.TrimSuffix(expected, []byte{0x00, 0x00, 0x01, 0xb9}), 0x00, 0x00, 0x01, 0xb9)
+
+			var cut bytes.Buffer
+			err = devo.DecryptContext(context.Background(), &cut, bytes.NewReader(scrambled), MAK, &devo.Options{Cuts: cuts})
+			if err != nil {
+				t.Errorf("Encountered unexpected error cutting.  Stream: %s, Cuts: %v, Error: %s", idx.Stream, cuts, err)
+				continue
+			}
+			if idx.Stream == devo.StreamPS && !bytes.Equal(cut.Bytes(), expected) {
+				t.Errorf("Cut content is invalid.  Stream: %s, Cuts: %v, Expected length: %d, Actual length: %d", idx.Stream, cuts, len(expected), cut.Len())
+			}
+			if cut.Len() >= len(plain) {
+				t.Errorf("Cut content is too long.  Stream: %s, Cuts: %v, Plain length: %d, Actual length: %d", idx.Stream, cuts, len(plain), cut.Len())
+			}
+
+			analysis, err := devo.Analyze(bytes.NewReader(cut.Bytes()), nil)
+			if err != nil {
+				t.Errorf("Encountered unexpected error analyzing cut video.  Stream: %s, Cuts: %v, Error: %s", idx.Stream, cuts, err)
+				continue
+			}
+			if analysis.Truncated {
+				t.Errorf("Cut video is truncated.  Stream: %s, Cuts: %v", idx.Stream, cuts)
+			}
+			for _, stream := range analysis.Streams {
+				if stream.ContinuityErrors != 0 {
+					t.Errorf("Cut video has continuity errors.  Stream: %s, Cuts: %v, Analysis: %+v", idx.Stream, cuts, stream)
+				}
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	err := devo.DecryptContext(context.Background(), &buf, bytes.NewReader(nil), MAK, &devo.Options{Cuts: []devo.Cut{{Start: time.Second, End: 0}}})
+	if err == nil {
+		t.Errorf("Expected error for invalid cut")
+	}
+}
+
+func TestCutsNullPackets(t *testing.T) {
+	// Follow the first packet of each video PES packet with a null packet
+	var plain []byte
+	ts := TS(Options{Packets: 64, PayloadSize: 4000, Rekey: 4, SequenceHeaders: true})
+	null := append([]byte{0x47, 0x1f, 0xff, 0x10}, bytes.Repeat([]byte{0xff}, 184)...)
+	for i := 0; i < len(ts); i += 188 {
+		packet := ts[i : i+188]
+		plain = append(plain, packet...)
+		if packet[1]&0x40 != 0 && uint16(packet[1]&0x1f)<<8|uint16(packet[2]) == DefaultStreams[0].PID {
+			plain = append(plain, null...)
+		}
+	}
+	scrambled, err := Scramble(plain, MAK)
+	if err != nil {
+		t.Fatalf("Encountered unexpected error scrambling.  Error: %s", err)
+	}
+
+	var cut bytes.Buffer
+	cuts := []devo.Cut{{Start: 300 * time.Millisecond, End: 600 * time.Millisecond}, {Start: 900 * time.Millisecond, End: 1200 * time.Millisecond}}
+	err = devo.DecryptContext(context.Background(), &cut, bytes.NewReader(scrambled), MAK, &devo.Options{Cuts: cuts})
+	if err != nil {
+		t.Fatalf("Encountered unexpected error cutting.  Error: %s", err)
+	}
+
+	// Null packets are kept along with the video packets they follow
+	out := cut.Bytes()
+	starts, nulls := 0, 0
+	for i := 0; i+188 <= len(out); i += 188 {
+		packet := out[i : i+188]
+		switch uint16(packet[1]&0x1f)<<8 | uint16(packet[2]) {
+		case DefaultStreams[0].PID:
+			if packet[1]&0x40 == 0 {
+				continue
+			}
+			starts++
+			if i+2*188 > len(out) || !bytes.Equal(out[i+188:i+2*188], null) {
+				t.Errorf("Video packet at offset %d isn't followed by a null packet", i)
+			}
+		case 0x1fff:
+			nulls++
+		}
+	}
+	if nulls == 0 || nulls != starts || len(out) >= len(plain) {
+		t.Errorf("Null packets are invalid.  Video packets: %d, Null packets: %d, Output length: %d, Plain length: %d", starts, nulls, len(out), len(plain))
+	}
+}
+
+func TestInspect(t *testing.T) {
+	scrambled, err := Scramble(TS(Options{}), MAK)
+	if err != nil {
+		t.Fatalf("Encountered unexpected error scrambling.  Error: %s", err)
+	}
+	info, err := devo.Inspect(bytes.NewReader(scrambled), MAK)
+	if err != nil {
+		t.Fatalf("Encountered unexpected error inspecting.  Error: %s", err)
+	}
+	if info.Stream != devo.StreamTS || len(info.Chunks) == 0 || info.Metadata == nil {
+		t.Errorf("File info is invalid.  Info: %+v", info)
+	}
+	if len(info.Programs) != 1 {
+		t.Fatalf("Expected a single program.  Programs: %+v", info.Programs)
+	}
+	program := info.Programs[0]
+	if program.PMTPID != 0x0020 || program.PrivatePID != 0x0030 || len(program.Streams) != len(DefaultStreams)+1 {
+		t.Errorf("Program info is invalid.  Program: %+v", program)
+	}
+	for i, es := range DefaultStreams {
+		if program.Streams[i].PID != int(es.PID) || program.Streams[i].Type != es.Type {
+			t.Errorf("Stream info is invalid.  Expected: %+v, Actual: %+v", es, program.Streams[i])
+		}
+	}
+
+	_, err = devo.Inspect(bytes.NewReader(scrambled), "0000000000")
+	if err != devo.ErrBadAccessKey {
+		t.Errorf("Expected ErrBadAccessKey for incorrect mak.  Error: %v", err)
+	}
+	info, err = devo.Inspect(bytes.NewReader(scrambled), "")
+	if err != nil || info.Metadata != nil || len(info.Programs) != 1 {
+		t.Errorf("Inspecting without a mak is invalid.  Info: %+v, Error: %v", info, err)
+	}
+}
+
+func TestAnalyze(t *testing.T) {
+	opts := Options{Packets: 100, SequenceHeaders: true}
+	frames := time.Duration(opts.Packets-1) * 3003 * time.Second / 90000
+	for _, plain := range [][]byte{PS(opts), TS(opts)} {
+		analysis, err := devo.Analyze(bytes.NewReader(plain), nil)
+		if err != nil {
+			t.Fatalf("Encountered unexpected error analyzing.  Error: %s", err)
+		}
+		if analysis.Truncated || analysis.Bytes != int64(len(plain)) || analysis.Duration != frames || len(analysis.Streams) != 2 {
+			t.Fatalf("Analysis is invalid.  Analysis: %+v", analysis)
+		}
+		video, audio := analysis.Streams[0], analysis.Streams[1]
+		if analysis.Stream == devo.StreamPS {
+			// mpeg-ps streams are ordered by stream ID
+			video, audio = audio, video
+		}
+		if video.Codec != devo.CodecMPEG2Video || audio.Codec != devo.CodecMPEGAudio {
+			t.Errorf("Detected codecs are invalid.  Video: %s, Audio: %s", video.Codec, audio.Codec)
+		}
+		for _, stream := range analysis.Streams {
+			if stream.Packets != int64(opts.Packets) || stream.FirstPTS != 0 || stream.LastPTS != int64(opts.Packets-1)*3003 {
+				t.Errorf("Stream analysis is invalid.  Stream: %+v", stream)
+			}
+			if len(stream.Gaps) != 0 || stream.Discontinuities != 0 || stream.ContinuityErrors != 0 {
+				t.Errorf("Unexpected stream errors.  Stream: %+v", stream)
+			}
+		}
+
+		analysis, err = devo.Analyze(bytes.NewReader(plain[:len(plain)-100]), nil)
+		if err != nil || !analysis.Truncated {
+			t.Errorf("Expected truncated analysis.  Analysis: %+v, Error: %v", analysis, err)
+		}
+	}
+
+	// Drop packets from the middle of the stream
+	plain := TS(opts)
+	packets := len(plain) / 188
+	glitched := append(append([]byte(nil), plain[:packets*2/5*188]...), plain[packets*3/5*188:]...)
+	analysis, err := devo.Analyze(bytes.NewReader(glitched), &devo.AnalyzeOptions{GapThreshold: time.Second / 2})
+	if err != nil {
+		t.Fatalf("Encountered unexpected error analyzing.  Error: %s", err)
+	}
+	for _, stream := range analysis.Streams {
+		if len(stream.Gaps) != 1 || stream.Gaps[0].Duration() < time.Second/2 || stream.ContinuityErrors != 1 {
+			t.Errorf("Expected a gap and continuity error.  Stream: %+v", stream)
+		}
+	}
+}
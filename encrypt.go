@@ -0,0 +1,185 @@
+// Copyright (c) 2016 Bob Ziuchkovski
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package devo
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// EncryptOptions controls optional Encrypt behavior.  A nil *EncryptOptions is
+// equivalent to the zero value.
+type EncryptOptions struct {
+	// Metadata supplies the metadata segments for the file header.  Chunks are
+	// written in order, encrypting chunks of type 2, which must hold xml
+	// documents.  The first chunk doubles as the initialization vector for the
+	// video ciphers, so it must be plaintext (type 1).  If there are no chunks,
+	// a plaintext and an encrypted chunk are generated from Details.
+	Metadata *Metadata
+
+	// Rand is the source of the confounders that key the video ciphers.
+	// If nil, crypto/rand.Reader is used.
+	Rand io.Reader
+}
+
+// Encrypt produces a TiVo file from the plain mpeg-ps or mpeg-ts video read from
+// src using the specified media access key (mak).  The result is written to dst
+// and may be decrypted with Decrypt.
+//
+// Scrambled packets must reference a confounder.  Encrypt adds PES private data
+// to mpeg-ps packets that lack it, and adds a TiVo private data stream to mpeg-ts
+// program map tables that lack one, so decrypting the result yields the input
+// with these additions.  Input that already carries them, such as the output of
+// Decrypt, round-trips exactly.
+func Encrypt(dst io.Writer, src io.Reader, mak string, opts *EncryptOptions) error {
+	if opts == nil {
+		opts = &EncryptOptions{}
+	}
+	random := opts.Rand
+	if random == nil {
+		random = rand.Reader
+	}
+	chunks, err := encryptChunks(opts.Metadata)
+	if err != nil {
+		return err
+	}
+
+	srcbuf := newSourceReader(src, 0)
+	stream, err := detectStream(srcbuf)
+	if err != nil {
+		return err
+	}
+	var flags uint16
+	if stream == StreamTS {
+		flags |= tsType
+	}
+
+	dstbuf := bufio.NewWriter(dst)
+	iv, err := writeFileMetadata(dstbuf, flags, mak, chunks)
+	if err != nil {
+		return err
+	}
+	if stream == StreamTS {
+		err = newTSEncryptor(mak, iv, srcbuf, random).encrypt(dstbuf)
+	} else {
+		err = newPSEncryptor(mak, iv, srcbuf, random).encrypt(dstbuf)
+	}
+	if err != nil {
+		return err
+	}
+	return dstbuf.Flush()
+}
+
+// encryptChunks returns the metadata chunks to write for meta
+func encryptChunks(meta *Metadata) ([]MetadataChunk, error) {
+	if meta == nil {
+		meta = &Metadata{}
+	}
+	if len(meta.Chunks) == 0 {
+		doc, err := marshalVideoDetails(meta.Details)
+		if err != nil {
+			return nil, err
+		}
+		return []MetadataChunk{
+			{ID: 1, Type: metaPlaintext, Data: doc},
+			{ID: 2, Type: metaEncrypted, Data: doc},
+		}, nil
+	}
+
+	if meta.Chunks[0].Type != metaPlaintext || len(meta.Chunks[0].Data) == 0 {
+		return nil, fmt.Errorf("devo: the first metadata chunk must be non-empty plaintext")
+	}
+	for _, chunk := range meta.Chunks {
+		if chunk.Type == metaEncrypted && !bytes.HasPrefix(chunk.Data, xmlPrefix) {
+			return nil, fmt.Errorf("devo: encrypted metadata chunk %d isn't an xml document", chunk.ID)
+		}
+	}
+	return meta.Chunks, nil
+}
+
+// detectStream identifies the container format of the video at the start of src
+func detectStream(src *sourceReader) (StreamType, error) {
+	start, err := src.Peek(4)
+	if err == io.EOF && len(start) == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	switch {
+	case len(start) != 0 && start[0] == tsSync:
+		return StreamTS, nil
+	case len(start) == 4 && joinWord(start) == psCode(psPackStart):
+		return StreamPS, nil
+	default:
+		return 0, unsupportedf("input is neither an mpeg-ps nor an mpeg-ts stream")
+	}
+}
+
+// writeFileMetadata writes the file header and metadata segments for chunks,
+// encrypting segments of type metaEncrypted.  The initialization vector for the
+// video ciphers is returned.
+func writeFileMetadata(dst io.Writer, flags uint16, mak string, chunks []MetadataChunk) (iv []byte, err error) {
+	iv = chunks[0].Data
+	header := fileHeader{
+		Magic:        [4]byte{'T', 'i', 'V', 'o'},
+		Flags:        flags,
+		VideoOffset:  16, // Size of file header
+		MetaSegments: uint16(len(chunks)),
+	}
+	for _, chunk := range chunks {
+		header.VideoOffset += 12 + uint32(len(chunk.Data)) + 4 // Size of metadata header, content, and end marker
+	}
+	err = binary.Write(dst, binary.BigEndian, &header)
+	if err != nil {
+		return
+	}
+
+	cipher := newMetadataCipher(mak, iv)
+	for _, chunk := range chunks {
+		data := make([]byte, len(chunk.Data))
+		copy(data, chunk.Data)
+		if chunk.Type == metaEncrypted {
+			cipher.XORKeyStream(data, data)
+		}
+		mh := metaHeader{
+			ChunkSize: 12 + uint32(len(data)) + 4,
+			DataSize:  uint32(len(data)),
+			ID:        chunk.ID,
+			Type:      chunk.Type,
+		}
+		err = binary.Write(dst, binary.BigEndian, &mh)
+		if err != nil {
+			return
+		}
+		_, err = dst.Write(data)
+		if err != nil {
+			return
+		}
+		var endMarker uint32
+		err = binary.Write(dst, binary.BigEndian, endMarker)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
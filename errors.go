@@ -0,0 +1,131 @@
+// Copyright (c) 2016 Bob Ziuchkovski
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package devo
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Sentinel errors.  FormatError and PacketError wrap these, so they should be
+// tested with errors.Is.  Truncated input is reported as io.ErrUnexpectedEOF.
+var (
+	// ErrBadAccessKey is returned when the media access key fails to decrypt the
+	// TiVo file metadata.  No video content is written in this case.
+	ErrBadAccessKey = errors.New("devo: incorrect media access key")
+
+	// ErrNotTiVo indicates the input lacks the TiVo file header.
+	ErrNotTiVo = errors.New("devo: not a tivo file (missing magic 'TiVo' marker)")
+
+	// ErrCorrupt indicates malformed input, such as a damaged or partial download.
+	ErrCorrupt = errors.New("devo: corrupt input")
+
+	// ErrUnsupported indicates well-formed input using stream features that
+	// DeVo doesn't support.
+	ErrUnsupported = errors.New("devo: unsupported input")
+
+	// ErrBadIndex indicates a .devoidx index is malformed or was written by an
+	// unsupported version of DeVo.
+	ErrBadIndex = errors.New("devo: invalid index")
+)
+
+// StreamType identifies the container format of TiVo video content.
+type StreamType int
+
+// Supported stream types
+const (
+	StreamPS StreamType = iota // mpeg-ps (program stream)
+	StreamTS                   // mpeg-ts (transport stream)
+)
+
+func (t StreamType) String() string {
+	switch t {
+	case StreamPS:
+		return "mpeg-ps"
+	case StreamTS:
+		return "mpeg-ts"
+	default:
+		return fmt.Sprintf("StreamType(%d)", int(t))
+	}
+}
+
+// FormatError reports a problem parsing the TiVo file header or metadata.
+type FormatError struct {
+	Offset int64 // Byte offset within the file
+	Err    error // Underlying cause
+}
+
+func (e *FormatError) Error() string {
+	return fmt.Sprintf("devo: error parsing metadata at offset 0x%08x: %s", e.Offset, e.Err)
+}
+
+// Unwrap returns the underlying cause.
+func (e *FormatError) Unwrap() error {
+	return e.Err
+}
+
+// PacketError reports a problem processing a video packet.
+type PacketError struct {
+	Stream StreamType
+	Packet int64 // Index of the failed packet, starting from 1
+	Offset int64 // Byte offset of the packet within the file
+	PID    int   // Packet ID (mpeg-ts) or stream ID (mpeg-ps), or -1 if unknown
+	Err    error // Underlying cause
+}
+
+func (e *PacketError) Error() string {
+	pid := "unknown"
+	if e.PID >= 0 {
+		pid = fmt.Sprintf("0x%04x", e.PID)
+	}
+	return fmt.Sprintf("devo: error processing %s packet %d (id %s) at offset 0x%08x: %s", e.Stream, e.Packet, pid, e.Offset, e.Err)
+}
+
+// Unwrap returns the underlying cause.
+func (e *PacketError) Unwrap() error {
+	return e.Err
+}
+
+// causeError adds detail to one of the sentinel errors
+type causeError struct {
+	kind error
+	msg  string
+}
+
+func (e *causeError) Error() string {
+	return e.msg
+}
+
+func (e *causeError) Unwrap() error {
+	return e.kind
+}
+
+func corruptf(format string, args ...interface{}) error {
+	return &causeError{kind: ErrCorrupt, msg: fmt.Sprintf(format, args...)}
+}
+
+func unsupportedf(format string, args ...interface{}) error {
+	return &causeError{kind: ErrUnsupported, msg: fmt.Sprintf(format, args...)}
+}
+
+func badIndexf(format string, args ...interface{}) error {
+	return &causeError{kind: ErrBadIndex, msg: "devo: invalid index: " + fmt.Sprintf(format, args...)}
+}
@@ -0,0 +1,189 @@
+// Copyright (c) 2016 Bob Ziuchkovski
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+//go:build go1.18
+// +build go1.18
+
+package devo
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+)
+
+// Fuzz targets for the parsers.  Run with e.g. go test -fuzz FuzzDecrypt.
+// Each target only checks that malformed input is rejected without panicking.
+
+var (
+	fuzzPack = []byte{0x00, 0x00, 0x01, 0xba, 0x44, 0x00, 0x04, 0x00, 0x04, 0x01, 0x01, 0x89, 0xc3, 0xf8}
+	fuzzPES  = []byte{0x00, 0x00, 0x01, 0xe0, 0x00, 0x1f, 0xb0, 0x81, 0x16, 0x21, 0x00, 0x01, 0x00, 0x01, 0x8e,
+		0x00, 0x11, 0x22, 0x33, 0x44, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x02, 0x03, 0x04}
+	fuzzPAT = []byte{0x00, 0xb0, 0x0d, 0x00, 0x01, 0xc1, 0x00, 0x00, 0x00, 0x01, 0xe0, 0x20, 0x53, 0xe7, 0x66, 0x14}
+	fuzzPMT = []byte{0x02, 0xb0, 0x17, 0x00, 0x01, 0xc1, 0x00, 0x00, 0xe0, 0x11, 0xf0, 0x00,
+		0x02, 0xe0, 0x11, 0xf0, 0x00, 0x97, 0xe0, 0x30, 0xf0, 0x00, 0x00, 0x00, 0x00, 0x00}
+)
+
+// fuzzTSPacket returns a packet for pid with the given header flags and payload
+func fuzzTSPacket(pid packetID, flags byte, payload []byte) []byte {
+	packet := bytes.Repeat([]byte{0xff}, tsPacketSize)
+	copy(packet, []byte{tsSync, 0x40 | byte(pid>>8), byte(pid), flags})
+	copy(packet[4:], payload)
+	return packet
+}
+
+func FuzzReadFileMetadata(f *testing.F) {
+	f.Add(testHeader(0x00, []byte("initialization vector")))
+	f.Add(testHeader(tsType, []byte("<?xml version=\"1.0\"?>")))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, meta, err := readFileMetadata(bytes.NewReader(data))
+		if err == nil {
+			decryptMetadata("3886854575", meta)
+		}
+		ReadMetadata(bytes.NewReader(data), "3886854575")
+	})
+}
+
+func FuzzReadPSPacket(f *testing.F) {
+	f.Add(fuzzPack)
+	f.Add(fuzzPES)
+	f.Add([]byte{0x00, 0x00, 0x01, 0xbc, 0x00, 0x01, 0x20})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		dec := newPSDecryptor("3886854575", nil, nil)
+		var packet psPacket
+		err := readPSPacket(bytes.NewReader(data), &packet)
+		if err != nil {
+			return
+		}
+		packet.pts()
+		packet.privateData()
+		dec.processPacket(&packet)
+		appendPSPacket(nil, &packet)
+	})
+}
+
+func FuzzProcessPAT(f *testing.F) {
+	f.Add(fuzzPAT)
+	f.Fuzz(func(t *testing.T, section []byte) {
+		if len(section) == 0 {
+			return
+		}
+		dec := newTSDecryptor("3886854575", nil, nil)
+		dec.processPAT(section)
+	})
+}
+
+func FuzzProcessPMT(f *testing.F) {
+	f.Add(fuzzPMT)
+	f.Fuzz(func(t *testing.T, section []byte) {
+		if len(section) == 0 {
+			return
+		}
+		dec := newTSDecryptor("3886854575", nil, nil)
+		dec.processPMT(0x100, section)
+	})
+}
+
+func FuzzProcessPrivate(f *testing.F) {
+	table := []byte{'T', 'i', 'V', 'o', 0, 0, 0, 0, 0, 20, 0xe0, 0x11, 0xe0, 0, 0, 0x11, 0x22, 0x33, 0x44}
+	f.Add(fuzzTSPacket(0x30, 0x10, table), []byte{})
+	f.Add(fuzzTSPacket(0x30, 0x10, table[:12]), fuzzTSPacket(0x30, 0x11, table[12:])[1:])
+	f.Fuzz(func(t *testing.T, first, second []byte) {
+		dec := newTSDecryptor("3886854575", nil, nil)
+		dec.privateTables[0x30] = make(map[packetID]bool)
+		for _, data := range [][]byte{first, second} {
+			var packet tsPacket
+			copy(packet.content[:], data)
+			packet.content[1] = packet.content[1]&0xe0 | 0x00
+			packet.content[2] = 0x30
+			dec.processPrivate(&packet)
+		}
+	})
+}
+
+func FuzzDecryptTSPacket(f *testing.F) {
+	pes := []byte{0x00, 0x00, 0x01, 0xe0, 0x00, 0x00, 0x80, 0x80, 0x05, 0x21, 0x00, 0x01, 0x00, 0x01,
+		0x00, 0x00, 0x01, 0xb3, 0x2d, 0x01, 0xe0, 0x24, 0x18, 0x98, 0x40, 0x12}
+	f.Add(fuzzTSPacket(0x11, 0xd0, pes))
+	f.Add(fuzzTSPacket(0x11, 0xf0, append([]byte{0x07, 0x10, 0, 0, 0, 0, 0x7e, 0}, pes...)))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		dec := newTSDecryptor("3886854575", nil, nil)
+		var packet tsPacket
+		copy(packet.content[:], data)
+		dec.ciphers[packet.id()] = dec.pool.getCipher(0xe0, [3]byte{})
+		packet.pts()
+		cipher, err := dec.processPacket(&packet)
+		if err == nil && cipher != nil {
+			_, err = packet.scrambledPayload()
+		}
+		if err == nil && cipher != nil {
+			cryptTSPacket(cipher, &packet)
+		}
+	})
+}
+
+func FuzzDecrypt(f *testing.F) {
+	var ts []byte
+	ts = append(ts, fuzzTSPacket(0x00, 0x10, append([]byte{0}, fuzzPAT...))...)
+	ts = append(ts, fuzzTSPacket(0x20, 0x10, append([]byte{0}, fuzzPMT...))...)
+	f.Add(append(testHeader(0x00, []byte("iv")), bytes.Join([][]byte{fuzzPack, fuzzPES, {0x00, 0x00, 0x01, 0xb9}}, nil)...), false)
+	f.Add(append(testHeader(tsType, []byte("iv")), ts...), false)
+	f.Add(append(testHeader(tsType, []byte("iv")), ts...), true)
+	f.Fuzz(func(t *testing.T, data []byte, lenient bool) {
+		opts := &Options{Lenient: lenient}
+		DecryptContext(context.Background(), ioutil.Discard, bytes.NewReader(data), "3886854575", opts)
+	})
+}
+
+func FuzzAnalyze(f *testing.F) {
+	var ts []byte
+	ts = append(ts, fuzzTSPacket(0x00, 0x10, append([]byte{0}, fuzzPAT...))...)
+	ts = append(ts, fuzzTSPacket(0x20, 0x10, append([]byte{0}, fuzzPMT...))...)
+	ts = append(ts, fuzzTSPacket(0x11, 0x10, fuzzPES)...)
+	f.Add(bytes.Join([][]byte{fuzzPack, fuzzPES, fuzzPES, {0x00, 0x00, 0x01, 0xb9}}, nil))
+	f.Add(ts)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		Analyze(bytes.NewReader(data), nil)
+	})
+}
+
+func FuzzReadIndex(f *testing.F) {
+	idx := &Index{Stream: StreamTS, Size: 1 << 20, Points: []IndexPoint{{Offset: 188, PTS: 3003, Keyframe: true, state: checkpoint{
+		Keys:   []keyState{{Stream: 0x11, ID: 0x01, Confounder: [3]byte{0x11, 0x22, 0x33}, Used: 4096}},
+		PMTIDs: []uint16{0x20},
+		Tables: []tableState{{PID: 0x30, Streams: []uint16{0x11}}},
+	}}}}
+	f.Add(idx.encode())
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// Fix up the checksum so that the remaining fields are exercised
+		if len(data) >= 4 {
+			crc := crc32MPEG(data[:len(data)-4])
+			data[len(data)-4], data[len(data)-3], data[len(data)-2], data[len(data)-1] = byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc)
+		}
+		idx, err := ReadIndex(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		if !bytes.Equal(idx.encode(), data) {
+			t.Errorf("Index didn't round-trip")
+		}
+	})
+}
@@ -0,0 +1,661 @@
+// Copyright (c) 2016 Bob Ziuchkovski
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package devo
+
+import (
+	"crypto/md5"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// indexInterval is the maximum distance between index points when keyframes
+// are sparse or can't be identified
+const indexInterval = 2 << 20
+
+const (
+	indexMagic   = "DEVOIDX"
+	indexVersion = 1
+)
+
+// Index lists points in the video content of a TiVo file from which decryption
+// can resume without decrypting what precedes them.  Points are recorded ahead
+// of each video keyframe, and at least every few megabytes otherwise, so an
+// index serves both for seeking and for locating cut points and thumbnails.
+// Offsets are the same in the encrypted video content and the decrypted video.
+//
+// Indexes are stored in .devoidx sidecar files, written by DecryptContext when
+// Options.Index is set, or by WriteTo.  The format is big-endian:
+//
+//	magic       [7]byte  "DEVOIDX"
+//	version     uint8    1
+//	stream      uint8    0 for mpeg-ps, 1 for mpeg-ts
+//	fingerprint [16]byte md5 of the first TiVo metadata segment
+//	size        int64    size of the video
+//	count       uint32   number of points, each consisting of:
+//	  offset    int64
+//	  pts       int64    -1 if absent
+//	  flags     uint8    bit 0 is set for keyframes
+//	  keys      uint16   number of cipher states, each consisting of:
+//	    stream     uint16   PES stream ID (mpeg-ps) or PID (mpeg-ts)
+//	    id         uint8    TiVo cipher ID
+//	    confounder [3]byte
+//	    used       int64    keystream bytes consumed
+//	  pmts      uint16   number of program map PIDs that follow (mpeg-ts only)
+//	  tables    uint16   number of private data tables (mpeg-ts only), each:
+//	    pid        uint16
+//	    streams    uint16   number of scrambled PIDs that follow
+//	crc         uint32   mpeg-2 CRC32 of everything preceding it
+//
+// The cipher states are anchors from which the keystream can be regenerated,
+// so an index is only meaningful alongside the TiVo file it was built from,
+// and only with that file's media access key.
+type Index struct {
+	Stream StreamType
+	Size   int64        // Size of the video
+	Points []IndexPoint // Ordered by offset
+
+	fingerprint [md5.Size]byte
+}
+
+// IndexPoint is a resync point: an mpeg-ps pack or mpeg-ts packet boundary ahead
+// of the start of a video PES packet.
+type IndexPoint struct {
+	Offset   int64 // Offset into the video
+	PTS      int64 // Presentation timestamp of the video PES packet (90kHz units), or -1 if absent
+	Keyframe bool  // The video PES packet starts a GOP (mpeg-2) or an IDR picture or SPS (h.264)
+
+	state checkpoint
+}
+
+// checkpoint is the decryption state at an index point.  Ciphers are recorded
+// along with the keystream they've consumed, which is skipped when resuming.
+type checkpoint struct {
+	Keys   []keyState
+	PMTIDs []uint16     // mpeg-ts program map PIDs
+	Tables []tableState // mpeg-ts private data tables
+}
+
+type keyState struct {
+	Stream     int // PES stream ID for mpeg-ps or PID for mpeg-ts
+	ID         uint8
+	Confounder [3]byte
+	Used       int64
+}
+
+// tableState lists the PIDs with ciphers from the latest table on a private data PID
+type tableState struct {
+	PID     uint16
+	Streams []uint16
+}
+
+func fingerprint(meta []metaSegment) [md5.Size]byte {
+	return md5.Sum(meta[0].Content)
+}
+
+// BuildIndex decrypts the TiVo file read from src using the specified media
+// access key (mak), discarding the output, and returns an index of the video.
+// ErrBadAccessKey is returned if mak fails to decrypt the file metadata.
+func BuildIndex(src io.Reader, mak string) (*Index, error) {
+	// Any index writer enables indexing.  The index is returned rather than written.
+	_, dec, err := newDecryptor(src, mak, &Options{Index: ioutil.Discard})
+	if err != nil {
+		return nil, err
+	}
+	ix := dec.(*indexer)
+	for {
+		_, _, err = ix.next()
+		if err == io.EOF {
+			return ix.finish(), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// LoadIndex reads the .devoidx file at path.
+func LoadIndex(path string) (*Index, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return decodeIndex(data)
+}
+
+// ReadIndex reads an index in the .devoidx format from r.
+func ReadIndex(r io.Reader) (*Index, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return decodeIndex(data)
+}
+
+// WriteTo writes idx to w in the .devoidx format.
+func (idx *Index) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(idx.encode())
+	return int64(n), err
+}
+
+// Keyframes returns the points that precede keyframes.
+func (idx *Index) Keyframes() []IndexPoint {
+	var points []IndexPoint
+	for _, point := range idx.Points {
+		if point.Keyframe {
+			points = append(points, point)
+		}
+	}
+	return points
+}
+
+// Before returns the last point at or before offset, or a point at the start
+// of the video if there's none.
+func (idx *Index) Before(offset int64) IndexPoint {
+	i := sort.Search(len(idx.Points), func(i int) bool { return idx.Points[i].Offset > offset })
+	if i == 0 {
+		return IndexPoint{PTS: -1}
+	}
+	return idx.Points[i-1]
+}
+
+// matches reports whether idx was built from a file with the given stream type,
+// video size, and metadata fingerprint
+func (idx *Index) matches(stream StreamType, size int64, fp [md5.Size]byte) bool {
+	return idx.Stream == stream && idx.Size == size && idx.fingerprint == fp
+}
+
+func (idx *Index) encode() []byte {
+	var enc indexEncoder
+	enc.buf = append(enc.buf, indexMagic...)
+	enc.uint8(indexVersion)
+	enc.uint8(uint8(idx.Stream))
+	enc.buf = append(enc.buf, idx.fingerprint[:]...)
+	enc.uint64(uint64(idx.Size))
+	enc.uint32(uint32(len(idx.Points)))
+	for _, point := range idx.Points {
+		enc.uint64(uint64(point.Offset))
+		enc.uint64(uint64(point.PTS))
+		var flags uint8
+		if point.Keyframe {
+			flags |= 1
+		}
+		enc.uint8(flags)
+
+		enc.uint16(uint16(len(point.state.Keys)))
+		for _, key := range point.state.Keys {
+			enc.uint16(uint16(key.Stream))
+			enc.uint8(key.ID)
+			enc.buf = append(enc.buf, key.Confounder[:]...)
+			enc.uint64(uint64(key.Used))
+		}
+		if idx.Stream != StreamTS {
+			continue
+		}
+		enc.uint16(uint16(len(point.state.PMTIDs)))
+		for _, pid := range point.state.PMTIDs {
+			enc.uint16(pid)
+		}
+		enc.uint16(uint16(len(point.state.Tables)))
+		for _, table := range point.state.Tables {
+			enc.uint16(table.PID)
+			enc.uint16(uint16(len(table.Streams)))
+			for _, pid := range table.Streams {
+				enc.uint16(pid)
+			}
+		}
+	}
+	enc.uint32(crc32MPEG(enc.buf))
+	return enc.buf
+}
+
+func decodeIndex(data []byte) (*Index, error) {
+	if len(data) < len(indexMagic)+1 || string(data[:len(indexMagic)]) != indexMagic {
+		return nil, badIndexf("missing magic %q", indexMagic)
+	}
+	if version := data[len(indexMagic)]; version != indexVersion {
+		return nil, badIndexf("unsupported version %d", version)
+	}
+	if len(data) < 4 || crc32MPEG(data[:len(data)-4]) != joinWord(data[len(data)-4:]) {
+		return nil, badIndexf("checksum mismatch")
+	}
+
+	dec := indexDecoder{buf: data[len(indexMagic)+1 : len(data)-4]}
+	idx := &Index{Stream: StreamType(dec.uint8())}
+	if idx.Stream != StreamPS && idx.Stream != StreamTS {
+		return nil, badIndexf("unknown stream type %d", idx.Stream)
+	}
+	copy(idx.fingerprint[:], dec.bytes(md5.Size))
+	idx.Size = int64(dec.uint64())
+	count := dec.uint32()
+	for i := uint32(0); i < count && dec.err == nil; i++ {
+		point := IndexPoint{Offset: int64(dec.uint64()), PTS: int64(dec.uint64())}
+		point.Keyframe = dec.uint8()&1 != 0
+
+		keys := int(dec.uint16())
+		for j := 0; j < keys && dec.err == nil; j++ {
+			key := keyState{Stream: int(dec.uint16()), ID: dec.uint8()}
+			copy(key.Confounder[:], dec.bytes(3))
+			key.Used = int64(dec.uint64())
+			if key.Used < 0 || key.Used > idx.Size {
+				dec.err = badIndexf("keystream position %d is out of range", key.Used)
+			}
+			point.state.Keys = append(point.state.Keys, key)
+		}
+		if idx.Stream == StreamTS {
+			pmts := int(dec.uint16())
+			for j := 0; j < pmts && dec.err == nil; j++ {
+				point.state.PMTIDs = append(point.state.PMTIDs, dec.uint16())
+			}
+			tables := int(dec.uint16())
+			for j := 0; j < tables && dec.err == nil; j++ {
+				table := tableState{PID: dec.uint16()}
+				streams := int(dec.uint16())
+				for k := 0; k < streams && dec.err == nil; k++ {
+					table.Streams = append(table.Streams, dec.uint16())
+				}
+				point.state.Tables = append(point.state.Tables, table)
+			}
+		}
+		if point.Offset < 0 || point.Offset >= idx.Size {
+			return nil, badIndexf("offset %d is out of range", point.Offset)
+		}
+		if len(idx.Points) != 0 && point.Offset <= idx.Points[len(idx.Points)-1].Offset {
+			return nil, badIndexf("points out of order")
+		}
+		idx.Points = append(idx.Points, point)
+	}
+	if dec.err == nil && len(dec.buf) != 0 {
+		dec.err = badIndexf("%d bytes of trailing data", len(dec.buf))
+	}
+	if dec.err != nil {
+		return nil, dec.err
+	}
+	return idx, nil
+}
+
+type indexEncoder struct {
+	buf []byte
+}
+
+func (e *indexEncoder) uint8(v uint8) {
+	e.buf = append(e.buf, v)
+}
+
+func (e *indexEncoder) uint16(v uint16) {
+	e.buf = append(e.buf, byte(v>>8), byte(v))
+}
+
+func (e *indexEncoder) uint32(v uint32) {
+	e.buf = append(e.buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (e *indexEncoder) uint64(v uint64) {
+	e.uint32(uint32(v >> 32))
+	e.uint32(uint32(v))
+}
+
+// indexDecoder reads fields from buf, setting err once the data runs out.  Reads
+// past the end return zeros.
+type indexDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *indexDecoder) bytes(n int) []byte {
+	if d.err != nil || len(d.buf) < n {
+		if d.err == nil {
+			d.err = badIndexf("truncated")
+		}
+		return make([]byte, n)
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *indexDecoder) uint8() uint8 {
+	return d.bytes(1)[0]
+}
+
+func (d *indexDecoder) uint16() uint16 {
+	return joinShort(d.bytes(2))
+}
+
+func (d *indexDecoder) uint32() uint32 {
+	return joinWord(d.bytes(4))
+}
+
+func (d *indexDecoder) uint64() uint64 {
+	return uint64(d.uint32())<<32 | uint64(d.uint32())
+}
+
+// resumable is implemented by decryptors that can report their state at resync
+// points, from which restore resumes decryption
+type resumable interface {
+	decryptor
+
+	// resyncPoint reports whether src is positioned at a resync point
+	resyncPoint() bool
+
+	// checkpoint returns the decryption state.  The decryptor must track its
+	// ciphers with a settled keyTracker.
+	checkpoint() checkpoint
+}
+
+// indexer wraps a decryptor, tracking the resync points ahead of each video
+// keyframe.  If it's building an index, a point is recorded ahead of each
+// keyframe and at least every indexInterval otherwise.
+type indexer struct {
+	resumable
+	stream      StreamType
+	index       *Index // nil unless an index is being built
+	src         *sourceReader
+	videoOffset int64
+	codecs      map[uint8]Codec // Video codec by PES stream ID
+	packet      tsPacket        // Scratch space for parsing mpeg-ts packets
+	pending     IndexPoint      // Latest resync point, not yet recorded
+	pendingOut  int64           // Output offset of the pending resync point
+	hasPending  bool
+	last        int64 // Offset of the latest recorded point
+	out         int64 // Output bytes returned so far
+	dropped     bool  // Input has been skipped, so input offsets are no longer reliable
+
+	// Set by next when the returned packet shows the pending resync point
+	// precedes a keyframe
+	found    bool
+	foundOut int64 // Output offset of the resync point
+	foundPTS int64 // Presentation timestamp of the keyframe, or -1 if absent
+	basePTS  int64 // First video presentation timestamp, or -1 if none seen
+}
+
+// newIndexer returns an indexer for dec, which reads from src.  If meta is
+// non-nil, an index of the file with those metadata segments is built.
+func newIndexer(dec resumable, stream StreamType, src *sourceReader, meta []metaSegment) *indexer {
+	ix := &indexer{
+		resumable:   dec,
+		stream:      stream,
+		src:         src,
+		videoOffset: src.offset(),
+		codecs:      make(map[uint8]Codec),
+		basePTS:     -1,
+	}
+	if meta != nil {
+		ix.index = &Index{Stream: stream, fingerprint: fingerprint(meta)}
+	}
+	return ix
+}
+
+func (ix *indexer) next() ([]byte, packetInfo, error) {
+	ix.found = false
+	if ix.resumable.resyncPoint() {
+		ix.pending = IndexPoint{Offset: ix.src.offset() - ix.videoOffset}
+		ix.pendingOut = ix.out
+		ix.hasPending = true
+		if ix.index != nil && !ix.dropped {
+			ix.pending.state = ix.resumable.checkpoint()
+		}
+	}
+
+	packet, info, err := ix.resumable.next()
+	if info.dropped != 0 {
+		ix.dropped = true
+	}
+	if err != nil {
+		return packet, info, err
+	}
+	ix.out += int64(len(packet))
+	id, es, ok := ix.videoPayload(packet)
+	if !ok {
+		return packet, info, err
+	}
+	if ix.basePTS < 0 {
+		ix.basePTS = info.pts
+	}
+	if !ix.hasPending {
+		return packet, info, err
+	}
+	codec := ix.codecs[id]
+	if codec == CodecUnknown {
+		codec = sniffCodec(id, es)
+		ix.codecs[id] = codec
+	}
+	point := ix.pending
+	point.PTS = info.pts
+	point.Keyframe = keyframe(codec, es)
+
+	// Without a recognized codec, any video packet is as good a cut point as another
+	if point.Keyframe || codec == CodecUnknown {
+		ix.found, ix.foundOut, ix.foundPTS = true, ix.pendingOut, point.PTS
+		ix.hasPending = false
+	}
+	if ix.index != nil && !ix.dropped && (point.Keyframe || point.Offset-ix.last >= indexInterval) {
+		ix.index.Points = append(ix.index.Points, point)
+		ix.last = point.Offset
+		ix.hasPending = false
+	}
+	return packet, info, err
+}
+
+// finish returns the index once the wrapped decryptor has returned io.EOF
+func (ix *indexer) finish() *Index {
+	ix.index.Size = ix.src.offset() - ix.videoOffset
+	return ix.index
+}
+
+// videoPayload returns the stream ID and elementary stream payload of a video PES
+// packet starting in packet
+func (ix *indexer) videoPayload(packet []byte) (id uint8, es []byte, ok bool) {
+	pes := packet
+	if ix.stream == StreamTS {
+		copy(ix.packet.content[:], packet)
+		if !ix.packet.payloadStart() {
+			return 0, nil, false
+		}
+		pes = ix.packet.payload()
+	}
+	return videoPES(pes)
+}
+
+// videoPES returns the stream ID and elementary stream payload of the video PES
+// packet at the start of b
+func videoPES(b []byte) (id uint8, es []byte, ok bool) {
+	if len(b) < 9 || !hasStartCode(b, 0) || b[3] < psVideoStreamMin || b[3] > psVideoStreamMax {
+		return 0, nil, false
+	}
+	offset := 9 + int(b[8])
+	if offset > len(b) {
+		return 0, nil, false
+	}
+	return b[3], b[offset:], true
+}
+
+// keyframe reports whether es, the payload of a video PES packet, contains an
+// mpeg-2 sequence or group header, or an h.264 IDR picture or sequence parameter
+// set, ahead of the first picture
+func keyframe(codec Codec, es []byte) bool {
+	for offset := 0; offset+4 <= len(es); offset++ {
+		if !hasStartCode(es, offset) {
+			continue
+		}
+		code := es[offset+3]
+		switch codec {
+		case CodecMPEG2Video:
+			switch code {
+			case psSequenceHeader, psGroupHeader:
+				return true
+			case 0x00:
+				// Picture start
+				return false
+			}
+		case CodecH264Video:
+			if code&0x80 != 0 {
+				continue
+			}
+			switch code & 0x1f {
+			case 5, 7:
+				return true
+			case 1:
+				// Non-IDR slice
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// resyncPoint reports whether src is positioned at a pack start
+func (dec *psDecryptor) resyncPoint() bool {
+	window, _ := dec.src.Peek(4)
+	return len(window) == 4 && joinWord(window) == psCode(psPackStart)
+}
+
+func (dec *psDecryptor) checkpoint() checkpoint {
+	var cp checkpoint
+	for stream, handle := range dec.keys.current {
+		cp.Keys = append(cp.Keys, keyState{Stream: stream, ID: handle.id, Confounder: handle.confounder, Used: dec.keys.used[handle]})
+	}
+	sort.Slice(cp.Keys, func(i, j int) bool { return cp.Keys[i].Stream < cp.Keys[j].Stream })
+	return cp
+}
+
+// resyncPoint reports whether src is positioned at a packet that starts a video
+// PES packet, and no private data table is partially read
+func (dec *tsDecryptor) resyncPoint() bool {
+	window, _ := dec.src.Peek(tsPacketSize)
+	if len(window) < tsPacketSize || window[0] != tsSync || window[1]&(1<<6) == 0 {
+		return false
+	}
+	var packet tsPacket
+	copy(packet.content[:], window)
+	if _, _, ok := videoPES(packet.payload()); !ok {
+		return false
+	}
+	for _, data := range dec.privateData {
+		if len(data) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (dec *tsDecryptor) checkpoint() checkpoint {
+	var cp checkpoint
+	for pid := range dec.pmtIDs {
+		cp.PMTIDs = append(cp.PMTIDs, uint16(pid))
+	}
+	for pid, table := range dec.privateTables {
+		state := tableState{PID: uint16(pid)}
+		for id := range table {
+			state.Streams = append(state.Streams, uint16(id))
+		}
+		sort.Slice(state.Streams, func(i, j int) bool { return state.Streams[i] < state.Streams[j] })
+		cp.Tables = append(cp.Tables, state)
+	}
+	for pid := range dec.ciphers {
+		handle := dec.keys.current[int(pid)]
+		cp.Keys = append(cp.Keys, keyState{Stream: int(pid), ID: handle.id, Confounder: handle.confounder, Used: dec.keys.used[handle]})
+	}
+	sort.Slice(cp.PMTIDs, func(i, j int) bool { return cp.PMTIDs[i] < cp.PMTIDs[j] })
+	sort.Slice(cp.Tables, func(i, j int) bool { return cp.Tables[i].PID < cp.Tables[j].PID })
+	sort.Slice(cp.Keys, func(i, j int) bool { return cp.Keys[i].Stream < cp.Keys[j].Stream })
+	return cp
+}
+
+// restore returns a decryptor that resumes decryption from point.  src must be
+// positioned at point.Offset within the video content.  The zero IndexPoint
+// restores decryption from the beginning of the video.
+func restore(point IndexPoint, header fileHeader, iv []byte, mak string, src io.Reader) decryptor {
+	srcbuf := newSourceReader(src, int64(header.VideoOffset)+point.Offset)
+	pool := newCipherPool(mak, iv)
+
+	// Ciphers may be shared between streams, so each is advanced only once
+	ciphers := make(map[int]cipherHandle)
+	advanced := make(map[cipherHandle]bool)
+	var discard [4096]byte
+	for _, key := range point.state.Keys {
+		handle := cipherHandle{id: key.ID, confounder: key.Confounder}
+		ciphers[key.Stream] = handle
+		c := pool.getCipher(handle.id, handle.confounder)
+		if advanced[handle] {
+			continue
+		}
+		advanced[handle] = true
+		for used := key.Used; used > 0; {
+			n := int64(len(discard))
+			if used < n {
+				n = used
+			}
+			c.XORKeyStream(discard[:n], discard[:n])
+			used -= n
+		}
+	}
+
+	if header.Flags&tsType == 0 {
+		dec := newPSDecryptor(mak, iv, srcbuf)
+		dec.pool = pool
+		return dec
+	}
+	dec := newTSDecryptor(mak, iv, srcbuf)
+	dec.pool = pool
+	for _, pid := range point.state.PMTIDs {
+		dec.pmtIDs[packetID(pid)] = true
+	}
+	for _, state := range point.state.Tables {
+		table := make(map[packetID]bool)
+		for _, id := range state.Streams {
+			table[packetID(id)] = true
+		}
+		dec.privateTables[packetID(state.PID)] = table
+	}
+	for stream, handle := range ciphers {
+		dec.ciphers[packetID(stream)] = pool.getCipher(handle.id, handle.confounder)
+	}
+	return dec
+}
+
+// writeIndexFile writes idx to path, writing to a temporary file that's renamed
+// into place so that concurrent readers never see a partial index
+func writeIndexFile(path string, idx *Index) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	_, err = idx.WriteTo(tmp)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
@@ -0,0 +1,190 @@
+// Copyright (c) 2016 Bob Ziuchkovski
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package devo
+
+import (
+	"io"
+	"sort"
+)
+
+// inspectPacketLimit bounds the number of mpeg-ts packets scanned for tables
+const inspectPacketLimit = 100000
+
+// FileInfo describes the layout of a TiVo file.
+type FileInfo struct {
+	Stream      StreamType
+	Flags       uint16
+	VideoOffset int64
+	Chunks      []ChunkInfo
+	Metadata    *Metadata     // Decrypted metadata, or nil if no mak was given
+	Programs    []ProgramInfo // Programs listed in the PAT (mpeg-ts only)
+}
+
+// ChunkInfo describes a metadata segment from a TiVo file header.
+type ChunkInfo struct {
+	ID   uint16
+	Type uint16 // 1 for plaintext, 2 for encrypted
+	Size int
+}
+
+// ProgramInfo describes an mpeg-ts program and the streams in its program map.
+// The PIDs are -1 if the program map wasn't found.
+type ProgramInfo struct {
+	Number     uint16
+	PMTPID     int
+	PCRPID     int
+	PrivatePID int // PID of the TiVo private data, or -1 if absent
+	Streams    []ESInfo
+}
+
+// ESInfo describes an elementary stream listed in a program map.
+type ESInfo struct {
+	PID  int
+	Type uint8 // Stream type from the program map, e.g. 0x02 for mpeg-2 video
+}
+
+// Inspect reads the file header and metadata segments from src without
+// decrypting any video.  If mak is non-empty, the metadata is decrypted and
+// parsed as well, returning ErrBadAccessKey if mak is incorrect.  For mpeg-ts
+// files, the start of the video is scanned for the program tables.
+func Inspect(src io.Reader, mak string) (*FileInfo, error) {
+	header, meta, err := readFileMetadata(src)
+	if err != nil {
+		return nil, err
+	}
+	info := &FileInfo{
+		Stream:      StreamPS,
+		Flags:       header.Flags,
+		VideoOffset: int64(header.VideoOffset),
+	}
+	for _, m := range meta {
+		info.Chunks = append(info.Chunks, ChunkInfo{ID: m.Header.ID, Type: m.Header.Type, Size: len(m.Content)})
+	}
+
+	if mak != "" {
+		chunks, err := decryptMetadata(mak, meta)
+		if err != nil {
+			return nil, err
+		}
+		info.Metadata = newMetadata(chunks)
+	}
+
+	if header.Flags&tsType != 0 {
+		info.Stream = StreamTS
+		info.Programs = scanPrograms(newSourceReader(src, info.VideoOffset))
+	}
+	return info, nil
+}
+
+// scanPrograms reads packets from src until the PAT and every program map it
+// lists have been found.  Scanning is best-effort: it stops quietly at the end
+// of the input, at corrupt packets, or after inspectPacketLimit packets.
+func scanPrograms(src *sourceReader) []ProgramInfo {
+	var packet tsPacket
+	scanner := newProgramScanner()
+	for i := 0; i < inspectPacketLimit && !scanner.complete(); i++ {
+		if readTSPacket(src, &packet) != nil {
+			break
+		}
+		scanner.push(&packet)
+	}
+	return scanner.programs()
+}
+
+// programScanner collects the programs listed in the first PAT of an mpeg-ts
+// stream along with their program maps.  Table errors are ignored.
+type programScanner struct {
+	sections *sectionAssembler
+	found    map[uint16]*ProgramInfo
+	mapped   map[uint16]bool // Programs with a parsed program map
+	pmtIDs   map[packetID]bool
+	seenPAT  bool
+	pending  int // Program maps not yet found
+}
+
+func newProgramScanner() *programScanner {
+	return &programScanner{
+		sections: newSectionAssembler(),
+		found:    make(map[uint16]*ProgramInfo),
+		mapped:   make(map[uint16]bool),
+		pmtIDs:   make(map[packetID]bool),
+	}
+}
+
+// complete reports whether the PAT and every program map it lists have been found
+func (s *programScanner) complete() bool {
+	return s.seenPAT && s.pending == 0
+}
+
+// push processes p if it carries the PAT or a program map
+func (s *programScanner) push(p *tsPacket) {
+	pid := p.id()
+	if s.complete() || (pid != tsPatID && !s.pmtIDs[pid]) {
+		return
+	}
+	sections, _, err := s.sections.push(p)
+	if err != nil {
+		return
+	}
+	for _, section := range sections {
+		switch {
+		case pid == tsPatID && !s.seenPAT:
+			programs, err := parsePAT(section)
+			if err != nil || !currentSection(section) {
+				continue
+			}
+			s.seenPAT = true
+			for _, program := range programs {
+				s.found[program.number] = &ProgramInfo{Number: program.number, PMTPID: int(program.pmtID), PCRPID: -1, PrivatePID: -1}
+				s.pmtIDs[program.pmtID] = true
+				s.pending++
+			}
+		case pid != tsPatID && section[0] == tsPmtTable:
+			pmt, err := parsePMT(section)
+			if err != nil || !currentSection(section) {
+				continue
+			}
+			program := s.found[pmt.number]
+			if program == nil || program.PMTPID != int(pid) || s.mapped[pmt.number] {
+				continue
+			}
+			program.PCRPID = int(pmt.pcrID)
+			program.Streams = pmt.streams
+			for _, stream := range pmt.streams {
+				if stream.Type == tsPrivateType && program.PrivatePID < 0 {
+					program.PrivatePID = stream.PID
+				}
+			}
+			s.mapped[pmt.number] = true
+			s.pending--
+		}
+	}
+}
+
+// programs returns the programs found so far, ordered by program number
+func (s *programScanner) programs() []ProgramInfo {
+	var result []ProgramInfo
+	for _, program := range s.found {
+		result = append(result, *program)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Number < result[j].Number })
+	return result
+}
@@ -0,0 +1,247 @@
+// Copyright (c) 2016 Bob Ziuchkovski
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package devo
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var xmlPrefix = []byte("<?xml")
+
+const tvBusNamespace = "http://tivo.com/developer/xml/idl/TvBusMarshalledStruct"
+
+// Metadata holds the metadata segments from a TiVo file header along with the
+// show details parsed from them.
+type Metadata struct {
+	Chunks  []MetadataChunk
+	Details VideoDetails
+}
+
+// MetadataChunk is a single metadata segment from a TiVo file header.
+// Encrypted segments are decrypted, so Data holds a raw xml document
+// regardless of the segment type.
+type MetadataChunk struct {
+	ID   uint16
+	Type uint16
+	Data []byte
+}
+
+// VideoDetails holds the show details from the TiVoVideoDetails xml metadata.
+// Fields are left empty when absent from the metadata.
+type VideoDetails struct {
+	Title        string
+	EpisodeTitle string
+	SeriesID     string
+	Channel      string // Display channel number, e.g. "702" or "5-1"
+	Callsign     string
+	RecordDate   time.Time
+	Duration     time.Duration
+	Description  string
+}
+
+// ReadMetadata reads the metadata segments from the header of a TiVo file,
+// decrypting them with the specified media access key (mak).  On success,
+// src is positioned at the start of the video content.  ErrBadAccessKey
+// is returned if mak fails to decrypt the metadata.
+func ReadMetadata(src io.Reader, mak string) (*Metadata, error) {
+	_, meta, err := readFileMetadata(src)
+	if err != nil {
+		return nil, err
+	}
+	chunks, err := decryptMetadata(mak, meta)
+	if err != nil {
+		return nil, err
+	}
+
+	return newMetadata(chunks), nil
+}
+
+// newMetadata returns the Metadata for chunks, parsing the show details from
+// the first chunk holding them
+func newMetadata(chunks []MetadataChunk) *Metadata {
+	result := &Metadata{Chunks: chunks}
+	for _, chunk := range chunks {
+		details, err := parseVideoDetails(chunk.Data)
+		if err == nil && details.Title != "" {
+			result.Details = details
+			break
+		}
+	}
+	return result
+}
+
+// decryptMetadata returns the content of each metadata segment, decrypting
+// encrypted segments as needed.  The encrypted segments share a single
+// keystream in file order.
+func decryptMetadata(mak string, meta []metaSegment) ([]MetadataChunk, error) {
+	cipher := newMetadataCipher(mak, meta[0].Content)
+	chunks := make([]MetadataChunk, len(meta))
+	for i, m := range meta {
+		data := make([]byte, len(m.Content))
+		copy(data, m.Content)
+		if m.Header.Type == metaEncrypted {
+			cipher.XORKeyStream(data, data)
+			if !bytes.HasPrefix(data, xmlPrefix) {
+				return nil, ErrBadAccessKey
+			}
+		}
+		chunks[i] = MetadataChunk{ID: m.Header.ID, Type: m.Header.Type, Data: data}
+	}
+	return chunks, nil
+}
+
+type tvBusEnvelope struct {
+	RecordedDuration string    `xml:"recordedDuration"`
+	StartTime        string    `xml:"startTime"`
+	Showing          tvShowing `xml:"showing"`
+}
+
+type tvShowing struct {
+	Time     string `xml:"time"`
+	Duration string `xml:"duration"`
+	Program  struct {
+		Title        string `xml:"title"`
+		EpisodeTitle string `xml:"episodeTitle"`
+		Description  string `xml:"description"`
+		Series       struct {
+			SeriesTitle string `xml:"seriesTitle"`
+			UniqueID    string `xml:"uniqueId"`
+		} `xml:"series"`
+	} `xml:"program"`
+	Channel struct {
+		Major    string `xml:"displayMajorNumber"`
+		Minor    string `xml:"displayMinorNumber"`
+		Callsign string `xml:"callsign"`
+	} `xml:"channel"`
+}
+
+func parseVideoDetails(doc []byte) (details VideoDetails, err error) {
+	var env tvBusEnvelope
+	err = xml.Unmarshal(doc, &env)
+	if err != nil {
+		return
+	}
+
+	program := env.Showing.Program
+	details.Title = program.Title
+	if details.Title == "" {
+		details.Title = program.Series.SeriesTitle
+	}
+	details.EpisodeTitle = program.EpisodeTitle
+	details.SeriesID = program.Series.UniqueID
+	details.Description = program.Description
+
+	channel := env.Showing.Channel
+	details.Channel = channel.Major
+	if channel.Minor != "" && channel.Minor != "0" {
+		details.Channel += "-" + channel.Minor
+	}
+	details.Callsign = channel.Callsign
+
+	for _, value := range []string{env.StartTime, env.Showing.Time} {
+		if date, perr := time.Parse(time.RFC3339, value); perr == nil {
+			details.RecordDate = date
+			break
+		}
+	}
+	for _, value := range []string{env.RecordedDuration, env.Showing.Duration} {
+		if duration, perr := parseISODuration(value); perr == nil {
+			details.Duration = duration
+			break
+		}
+	}
+	return
+}
+
+// marshalVideoDetails produces a TiVoVideoDetails xml document from details
+func marshalVideoDetails(details VideoDetails) ([]byte, error) {
+	var env tvBusEnvelope
+	program := &env.Showing.Program
+	program.Title = details.Title
+	program.Series.SeriesTitle = details.Title
+	program.EpisodeTitle = details.EpisodeTitle
+	program.Series.UniqueID = details.SeriesID
+	program.Description = details.Description
+
+	channel := &env.Showing.Channel
+	channel.Major = details.Channel
+	if i := strings.IndexByte(details.Channel, '-'); i >= 0 {
+		channel.Major, channel.Minor = details.Channel[:i], details.Channel[i+1:]
+	}
+	channel.Callsign = details.Callsign
+
+	if !details.RecordDate.IsZero() {
+		env.StartTime = details.RecordDate.UTC().Format(time.RFC3339)
+		env.Showing.Time = env.StartTime
+	}
+	if details.Duration != 0 {
+		env.RecordedDuration = FormatISODuration(details.Duration)
+		env.Showing.Duration = env.RecordedDuration
+	}
+
+	doc, err := xml.MarshalIndent(struct {
+		XMLName xml.Name
+		tvBusEnvelope
+	}{xml.Name{Space: tvBusNamespace, Local: "TvBusEnvelope"}, env}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), doc...), nil
+}
+
+// FormatISODuration formats d as an ISO 8601 duration such as PT1H30M0S, as used
+// by TiVo metadata.  d is rounded to the nearest second.
+func FormatISODuration(d time.Duration) string {
+	d = (d + time.Second/2) / time.Second * time.Second
+	hours, minutes, seconds := int(d/time.Hour), int(d%time.Hour/time.Minute), int(d%time.Minute/time.Second)
+	return fmt.Sprintf("PT%dH%dM%dS", hours, minutes, seconds)
+}
+
+var isoDurationPattern = regexp.MustCompile(`^P(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+(?:\.\d+)?)S)?)?$`)
+
+// parseISODuration parses the ISO 8601 durations (e.g. PT1H30M) used by TiVo metadata.
+func parseISODuration(value string) (time.Duration, error) {
+	match := isoDurationPattern.FindStringSubmatch(value)
+	if match == nil || value == "P" || value == "PT" {
+		return 0, fmt.Errorf("invalid duration: %q", value)
+	}
+
+	var duration time.Duration
+	units := []time.Duration{24 * time.Hour, time.Hour, time.Minute, time.Second}
+	for i, unit := range units {
+		if match[i+1] == "" {
+			continue
+		}
+		n, err := strconv.ParseFloat(match[i+1], 64)
+		if err != nil {
+			return 0, err
+		}
+		duration += time.Duration(n * float64(unit))
+	}
+	return duration, nil
+}
@@ -21,9 +21,7 @@
 package devo
 
 import (
-	"bufio"
-	"encoding/binary"
-	"fmt"
+	"errors"
 	"io"
 )
 
@@ -36,8 +34,15 @@ const (
 	psPackStart         = 0xba
 	psSystemHeader      = 0xbb
 	psStreamMap         = 0xbc
+	psPrivateStream1    = 0xbd
+	psAudioStream       = 0xc0
+	psVideoStreamMin    = 0xe0
+	psVideoStreamMax    = 0xef
 )
 
+// Length of pack start content, excluding up to 7 stuffing bytes
+const psPackLength = 10
+
 // Length of headers by flag bit (bit 0 .. 7)
 var flagLengths = []int{
 	1, // Extension
@@ -51,90 +56,345 @@ var flagLengths = []int{
 }
 
 type psDecryptor struct {
-	pool *cipherPool
+	pool    *cipherPool
+	src     *sourceReader
+	packet  psPacket // Reused for every packet read
+	out     []byte   // Reused for every packet written
+	count   int64    // Packets read
+	lenient bool     // Resync after corrupt packets rather than failing
+	ended   bool
+	keys    *keyTracker // Tracks cipher positions when starting mid-stream, or nil
 }
 
-func newPSDecryptor(mak string, iv []byte) *psDecryptor {
+func newPSDecryptor(mak string, iv []byte, src *sourceReader) *psDecryptor {
 	return &psDecryptor{
 		pool: newCipherPool(mak, iv),
+		src:  src,
 	}
 }
 
-func (dec *psDecryptor) decrypt(dst io.Writer, src *bufio.Reader) error {
-	var (
-		packet *psPacket
-		count  int
-		err    error
-	)
-
+// next reads and decrypts the next packet from src, returning the decrypted packet.
+// The returned slice is only valid until the following call.  io.EOF is returned
+// once the program end code has been processed.
+func (dec *psDecryptor) next() ([]byte, packetInfo, error) {
+	info := packetInfo{pts: -1}
 	for {
-		count++
-		packet, err = readPSPacket(src)
-		if err != nil {
-			break
+		if dec.ended {
+			return nil, info, io.EOF
 		}
-		err = dec.processPacket(packet)
-		if err != nil {
-			break
+		if dec.lenient {
+			skipped, err := dec.resync()
+			info.dropped += skipped
+			if err != nil {
+				return nil, info, err
+			}
+		}
+
+		dec.count++
+		start := dec.src.offset()
+		pid := -1
+		packet := &dec.packet
+		err := readPSPacket(dec.src, packet)
+		if err == nil {
+			pid = int(packet.id)
+			info.decrypted = packet.scramble() != 0
+			err = dec.processPacket(packet)
+		}
+		if err == nil {
+			info.pts = packet.pts()
+		}
+		if err == nil {
+			dec.out = appendPSPacket(dec.out[:0], packet)
+		}
+
+		// An EOF is unexpected.  We expect to read psProgramEnd prior to hitting EOF.
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil && dec.lenient && (err == io.ErrUnexpectedEOF || errors.Is(err, ErrCorrupt)) {
+			info.dropped += dec.src.offset() - start
+			info.decrypted = false
+			continue
 		}
-		err = writePSPacket(dst, packet)
 		if err != nil {
-			break
+			return nil, info, &PacketError{Stream: StreamPS, Packet: dec.count, Offset: start, PID: pid, Err: err}
 		}
 		if packet.id == psProgramEnd {
-			break
+			dec.ended = true
 		}
+		return dec.out, info, nil
 	}
+}
 
-	// An EOF is unexpected.  We expect to read psProgramEnd prior to hitting EOF.
-	if err == io.EOF {
-		err = io.ErrUnexpectedEOF
+// resync skips forward to the next packet boundary if src isn't positioned at
+// one, returning the number of bytes skipped.  Candidate boundaries are confirmed
+// by the start code of the packet that follows, unless the input ends with the
+// candidate packet.  io.EOF is returned once the input is exhausted, including
+// when a truncated start code is skipped.
+func (dec *psDecryptor) resync() (skipped int64, err error) {
+	for {
+		window, _ := dec.src.Peek(4)
+		if len(window) < 4 {
+			n, _ := dec.src.Discard(len(window))
+			return skipped + int64(n), io.EOF
+		}
+		if dec.atBoundary() {
+			return skipped, nil
+		}
+		_, err = dec.src.Discard(1)
+		if err != nil {
+			return
+		}
+		skipped++
 	}
-	if err != nil {
-		err = fmt.Errorf("failed while processing mpegps packet %d: %s", count, err)
+}
+
+// atBoundary reports whether src is positioned at a packet followed by another
+// start code or by the end of the input
+func (dec *psDecryptor) atBoundary() bool {
+	header, _ := dec.src.Peek(4 + psPackLength)
+	if len(header) < 4 {
+		return false
+	}
+	code := joinWord(header[:4])
+	if code>>8 != psPrefix || wordOctet(code, 3) < psProgramEnd {
+		return false
+	}
+	length := 4
+	switch wordOctet(code, 3) {
+	case psProgramEnd:
+	case psPackStart:
+		if len(header) < 4+psPackLength {
+			return false
+		}
+		length += psPackLength + int(header[13]&0x07)
+	default:
+		if len(header) < 6 {
+			return false
+		}
+		length += 2 + int(joinShort(header[4:6]))
 	}
-	return err
+	window, _ := dec.src.Peek(length + 4)
+	return len(window) == length || hasStartCode(window, length)
 }
 
 func (dec *psDecryptor) processPacket(packet *psPacket) (err error) {
 	switch packet.id {
 	case psStreamMap:
+		if len(packet.content) == 0 {
+			return corruptf("empty stream map")
+		}
 		// Twiddle stream map for decrypted stream
 		packet.payload()[0] &= 0xdf
 	default:
 		if packet.scramble() != 0 {
-			dec.decryptPacket(packet)
+			err = dec.decryptPacket(packet)
 		}
 	}
 	return
 }
 
-func (dec *psDecryptor) decryptPacket(packet *psPacket) {
-	cipher := dec.pool.getCipher(packet.id, confounder(packet.privateData()[1:5]))
+func (dec *psDecryptor) decryptPacket(packet *psPacket) error {
+	if private := packet.privateData(); dec.keys != nil && len(private) >= 5 {
+		dec.keys.assign(int(packet.id), cipherHandle{id: packet.id, confounder: confounder(private[1:5])})
+	}
+	err := cryptPSPacket(dec.pool, packet)
+	if err != nil {
+		return err
+	}
+	if dec.keys != nil {
+		// The first four bytes of keystream are discarded ahead of the payload
+		dec.keys.consume(int(packet.id), 4+len(packet.payload()))
+	}
+	packet.clearScramble()
+	return nil
+}
+
+// cryptPSPacket XORs the packet payload with the keystream for the packet's stream
+// and confounder.  The operation is symmetric, so it serves for both decryption
+// and encryption.  The scrambling control bits are left to the caller.
+func cryptPSPacket(pool *cipherPool, packet *psPacket) error {
+	if len(packet.content) < 3 || int(packet.content[2])+3 > len(packet.content) {
+		return corruptf("truncated PES header")
+	}
+	private := packet.privateData()
+	if len(private) < 5 {
+		return corruptf("missing PES private data")
+	}
+	cipher := pool.getCipher(packet.id, confounder(private[1:5]))
 
 	// We throw out the first four bytes of the cipher stream
 	// Don't ask why...this is the same thing tivodecode does
 	var dummy [4]byte
 	cipher.XORKeyStream(dummy[:], dummy[:])
 
-	// Use the rest of the stream to decrypt the packet payload
-	encrypted := packet.payload()
-	cipher.XORKeyStream(encrypted, encrypted)
-	packet.clearScramble()
+	// Use the rest of the stream to crypt the packet payload
+	payload := packet.payload()
+	cipher.XORKeyStream(payload, payload)
+	return nil
+}
+
+// psEncryptor scrambles the PES packets of a plain mpeg-ps stream
+type psEncryptor struct {
+	pool    *cipherPool
+	src     *sourceReader
+	random  io.Reader
+	private map[uint8][]byte // PES private data added to packets, by stream ID
+	packet  psPacket         // Reused for every packet read
+	spliced []byte           // Reused for packets with added private data
+	out     []byte           // Reused for every packet written
+	count   int64            // Packets read
+}
+
+func newPSEncryptor(mak string, iv []byte, src *sourceReader, random io.Reader) *psEncryptor {
+	return &psEncryptor{
+		pool:    newCipherPool(mak, iv),
+		src:     src,
+		random:  random,
+		private: make(map[uint8][]byte),
+	}
+}
+
+// encrypt scrambles packets from src and writes them to dst until the program
+// end code.  A program end code is added if src ends without one.
+func (enc *psEncryptor) encrypt(dst io.Writer) error {
+	for {
+		enc.count++
+		start := enc.src.offset()
+		_, err := enc.src.Peek(1)
+		if err == io.EOF {
+			_, err = dst.Write(appendPSPacket(enc.out[:0], &psPacket{id: psProgramEnd}))
+			return err
+		}
+
+		pid := -1
+		packet := &enc.packet
+		if err == nil {
+			err = readPSPacket(enc.src, packet)
+		}
+		if err == nil {
+			pid = int(packet.id)
+			err = enc.processPacket(packet)
+		}
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return &PacketError{Stream: StreamPS, Packet: enc.count, Offset: start, PID: pid, Err: err}
+		}
+
+		enc.out = appendPSPacket(enc.out[:0], packet)
+		_, err = dst.Write(enc.out)
+		if err != nil || packet.id == psProgramEnd {
+			return err
+		}
+	}
+}
+
+func (enc *psEncryptor) processPacket(packet *psPacket) error {
+	switch {
+	case packet.id == psPackStart:
+		if packet.content[0]&0xc0 != 0x40 {
+			return unsupportedf("mpeg-1 pack headers are not supported")
+		}
+	case packet.id == psStreamMap:
+		// Reverse the stream map twiddle applied during decryption
+		if len(packet.content) != 0 {
+			packet.content[0] |= 0x20
+		}
+	case packet.hasPESHeader():
+		if len(packet.content) < 3 || int(packet.content[2])+3 > len(packet.content) {
+			return corruptf("truncated PES header")
+		}
+		if packet.content[0]&0xc0 != 0x80 {
+			return unsupportedf("mpeg-1 PES headers are not supported")
+		}
+		if packet.scramble() != 0 {
+			return unsupportedf("packet is already scrambled")
+		}
+		err := enc.addPrivateData(packet)
+		if err != nil {
+			return err
+		}
+		err = cryptPSPacket(enc.pool, packet)
+		if err != nil {
+			return err
+		}
+		packet.content[0] |= 0x30
+	}
+	return nil
+}
+
+// addPrivateData adds the 16 bytes of PES private data that carry the packet's
+// confounder, unless the packet already has private data.  The private data is
+// chosen once per stream, so packets of a stream share a keystream.
+func (enc *psEncryptor) addPrivateData(packet *psPacket) error {
+	flags := packet.content[1]
+	hdrlen := int(packet.content[2]) + 3
+
+	// Locate the PES extension, which follows the other optional fields
+	offset := 3
+	for bit := 1; bit < len(flagLengths); bit++ {
+		if flags&(1<<uint(bit)) != 0 {
+			offset += flagLengths[bit]
+		}
+	}
+	if offset >= hdrlen && flags&0x01 != 0 {
+		return corruptf("truncated PES header")
+	}
+
+	private := enc.private[packet.id]
+	if private == nil {
+		private = make([]byte, 16)
+		_, err := io.ReadFull(enc.random, private[1:5])
+		if err != nil {
+			return err
+		}
+		enc.private[packet.id] = private
+	}
+
+	var insert []byte
+	switch {
+	case flags&0x01 == 0:
+		// Add an extension holding only private data (private data flag and reserved bits set)
+		insert = append([]byte{0x8e}, private...)
+		packet.content[1] |= 0x01
+	case packet.content[offset]&0x80 == 0:
+		// Add private data to the existing extension
+		offset++
+		insert = private
+		packet.content[offset-1] |= 0x80
+	default:
+		if offset+17 > hdrlen {
+			return corruptf("truncated PES private data")
+		}
+		return nil
+	}
+	if hdrlen+len(insert) > 0xff+3 || len(packet.content)+len(insert) > 0xffff {
+		return unsupportedf("PES packet is too long to add private data")
+	}
+	packet.content[2] += uint8(len(insert))
+
+	enc.spliced = append(enc.spliced[:0], packet.content[:offset]...)
+	enc.spliced = append(enc.spliced, insert...)
+	enc.spliced = append(enc.spliced, packet.content[offset:]...)
+	packet.content = enc.spliced
+	return nil
 }
 
 type psPacket struct {
 	id      uint8
 	content []byte
+	buf     []byte // Backing storage for content, reused across reads
 }
 
+// scramble returns the PES scrambling control bits.  Packets without a PES header,
+// such as padding and system headers, are never scrambled.
 func (packet *psPacket) scramble() uint8 {
-	switch packet.id {
-	case psPackStart, psProgramEnd:
+	if !packet.hasPESHeader() || len(packet.content) == 0 {
 		return 0
-	default:
-		return (packet.content[0] & 0x30) >> 4
 	}
+	return (packet.content[0] & 0x30) >> 4
 }
 
 func (packet *psPacket) clearScramble() {
@@ -143,18 +403,43 @@ func (packet *psPacket) clearScramble() {
 	}
 }
 
+// payload returns the content following the PES header, or nil if the header
+// is truncated
 func (packet *psPacket) payload() []byte {
 	switch packet.id {
 	case psPackStart, psStreamMap, psSystemHeader:
 		return packet.content
 	default:
+		if len(packet.content) < 3 {
+			return nil
+		}
 		hdrlen := int(packet.content[2]) + 3
+		if hdrlen > len(packet.content) {
+			return nil
+		}
 		return packet.content[hdrlen:]
 	}
 }
 
+// pts returns the presentation timestamp of a PES packet, or -1 if absent
+func (packet *psPacket) pts() int64 {
+	if !packet.hasPESHeader() || len(packet.content) < 8 || packet.content[1]&0x80 == 0 {
+		return -1
+	}
+	return parsePTS(packet.content[3:8])
+}
+
+func (packet *psPacket) hasPESHeader() bool {
+	return packet.id == psPrivateStream1 || (packet.id >= psAudioStream && packet.id <= psVideoStreamMax)
+}
+
+// privateData returns the PES private data and what follows it in the header, or
+// nil if the header is truncated.
 func (packet *psPacket) privateData() []byte {
 	flagPos, lenPos, remaining := 1, 2, 3
+	if len(packet.content) < remaining {
+		return nil
+	}
 	flags := packet.content[flagPos]
 	hdrlen := int(packet.content[lenPos]) + remaining
 
@@ -167,49 +452,59 @@ func (packet *psPacket) privateData() []byte {
 	}
 
 	// XXX We might be returning more than just the private data here...
+	if offset > hdrlen-remaining || hdrlen-remaining > len(packet.content) {
+		return nil
+	}
 	return packet.content[offset : hdrlen-remaining]
 }
 
-func readPSPacket(src io.Reader) (packet *psPacket, err error) {
-	var code uint32
-	err = binary.Read(src, binary.BigEndian, &code)
+// readPSPacket reads the next packet from src into packet, reusing the packet's
+// storage where possible
+func readPSPacket(src io.Reader, packet *psPacket) (err error) {
+	if cap(packet.buf) < psPackLength+7 {
+		packet.buf = make([]byte, psPackLength+7)
+	}
+	_, err = io.ReadFull(src, packet.buf[:4])
 	if err != nil {
 		return
 	}
+	code := joinWord(packet.buf[:4])
 	if (code >> 8) != psPrefix {
-		err = fmt.Errorf("invalid PS packet code: 0x%08x", code)
+		err = corruptf("invalid PS packet code: 0x%08x", code)
 		return
 	}
-	packet = &psPacket{id: wordOctet(code, 3)}
+	packet.id = wordOctet(code, 3)
 
 	switch packet.id {
 	case psProgramEnd:
 		// Empty content
-		packet.content = make([]byte, 0)
+		packet.content = packet.buf[:0]
 	case psPackStart:
 		// Pack start content
-		packet.content = make([]byte, 10)
+		packet.content = packet.buf[:psPackLength]
 		_, err = io.ReadFull(src, packet.content)
 		if err != nil {
 			return
 		}
 
 		// Stuffing bytes
-		scount := packet.content[9] & 0x07
-		stuffing := make([]byte, scount)
-		_, err = io.ReadFull(src, stuffing)
+		scount := int(packet.content[9] & 0x07)
+		packet.content = packet.buf[:psPackLength+scount]
+		_, err = io.ReadFull(src, packet.content[psPackLength:])
 		if err != nil {
 			return
 		}
-		packet.content = append(packet.content, stuffing...)
 	default:
 		// Remaining packets are all in type-length-value format and we already have the type (code)
-		var length uint16
-		err = binary.Read(src, binary.BigEndian, &length)
+		_, err = io.ReadFull(src, packet.buf[:2])
 		if err != nil {
 			return
 		}
-		packet.content = make([]byte, length)
+		length := int(joinShort(packet.buf[:2]))
+		if cap(packet.buf) < length {
+			packet.buf = make([]byte, length)
+		}
+		packet.content = packet.buf[:length]
 		_, err = io.ReadFull(src, packet.content)
 		if err != nil {
 			return
@@ -218,23 +513,16 @@ func readPSPacket(src io.Reader) (packet *psPacket, err error) {
 	return
 }
 
-func writePSPacket(dst io.Writer, p *psPacket) (err error) {
-	var code = (psPrefix << 8) | uint32(p.id)
-	err = binary.Write(dst, binary.BigEndian, code)
-	if err != nil {
-		return
-	}
+// appendPSPacket appends the encoded packet to dst and returns the extended slice
+func appendPSPacket(dst []byte, p *psPacket) []byte {
+	dst = append(dst, psPrefix>>16, psPrefix>>8&0xff, psPrefix&0xff, p.id)
 	switch p.id {
 	case psPackStart, psProgramEnd:
 		// Not in type-length-value format, so don't write length
 	default:
-		err = binary.Write(dst, binary.BigEndian, uint16(len(p.content)))
-		if err != nil {
-			return
-		}
+		dst = append(dst, byte(len(p.content)>>8), byte(len(p.content)))
 	}
-	_, err = dst.Write(p.content)
-	return
+	return append(dst, p.content...)
 }
 
 func psCode(id uint8) uint32 {
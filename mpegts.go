@@ -21,161 +21,347 @@
 package devo
 
 import (
-	"bufio"
-	"fmt"
+	"errors"
 	"github.com/bobziuchkovski/turing"
 	"io"
 )
 
 const (
-	tsSync          = 0x47
-	tsPatID         = 0x0000
-	tsIDMask        = 0x1fff
-	tsPrivateType   = 0x97
-	tsPrivateLength = 20
+	tsSync                = 0x47
+	tsPacketSize          = 188
+	tsPatID               = 0x0000
+	tsNullID              = 0x1fff
+	tsIDMask              = 0x1fff
+	tsPatTable            = 0x00
+	tsPmtTable            = 0x02
+	tsSectionHeaderLength = 8
+	tsCRCLength           = 4
+	tsMaxSectionLength    = 4096
+	tsPrivateType         = 0x97
+	tsPrivateLength       = 20
 )
 
 type packetID uint16
 
 type tsDecryptor struct {
-	pool      *cipherPool
-	ciphers   map[packetID]*turing.Cipher
-	pmtID     packetID
-	privateID packetID
+	pool          *cipherPool
+	src           *sourceReader
+	ciphers       map[packetID]*turing.Cipher
+	pmtIDs        map[packetID]bool
+	mappedIDs     map[packetID]bool              // Program map PIDs with a parsed table
+	privateTables map[packetID]map[packetID]bool // Private data PID -> PIDs with ciphers from its latest table
+	patSections   map[uint8][]packetID           // PAT section number -> program map PIDs
+	patVersion    uint8
+	sections      *sectionAssembler
+	privateData   map[packetID][]byte // Private data PID -> partially reassembled table
+	packet        tsPacket            // Reused for every packet read
+	count         int64               // Packets read
+	lenient       bool                // Resync after corrupt packets rather than failing
+	keys          *keyTracker         // Tracks cipher positions when starting mid-stream, or nil
+	badTables     int64               // Damaged table sections discarded
 }
 
-func newTSDecryptor(mak string, iv []byte) *tsDecryptor {
+func newTSDecryptor(mak string, iv []byte, src *sourceReader) *tsDecryptor {
 	return &tsDecryptor{
-		pool:    newCipherPool(mak, iv),
-		ciphers: make(map[packetID]*turing.Cipher),
+		pool:          newCipherPool(mak, iv),
+		src:           src,
+		ciphers:       make(map[packetID]*turing.Cipher),
+		pmtIDs:        make(map[packetID]bool),
+		mappedIDs:     make(map[packetID]bool),
+		privateTables: make(map[packetID]map[packetID]bool),
+		sections:      newSectionAssembler(),
+		privateData:   make(map[packetID][]byte),
 	}
 }
 
-func (dec *tsDecryptor) decrypt(dst io.Writer, src *bufio.Reader) error {
-	var (
-		packet *tsPacket
-		count  int
-		err    error
-	)
+// next reads and decrypts the next packet from src, returning the decrypted packet.
+// The returned slice is only valid until the following call.  io.EOF is returned
+// once the stream ends cleanly.
+func (dec *tsDecryptor) next() ([]byte, packetInfo, error) {
+	packet, info, cipher, err := dec.read()
+	if err != nil {
+		return nil, info, err
+	}
+	if cipher != nil {
+		cryptTSPacket(cipher, packet)
+	}
+	return packet.content[:], info, nil
+}
 
+// read reads and processes the next packet from src, returning the packet along
+// with the cipher needed to decrypt it.  The cipher is nil for unscrambled packets.
+// Decryption is left to the caller so that it may happen concurrently.
+func (dec *tsDecryptor) read() (*tsPacket, packetInfo, *turing.Cipher, error) {
+	info := packetInfo{pts: -1}
 	for {
-		count++
+		if dec.lenient {
+			skipped, err := dec.resync()
+			info.dropped += skipped
+			if err != nil {
+				return nil, info, nil, err
+			}
+		}
+		dec.count++
+		start := dec.src.offset()
 
 		// An mpeg-ts stream ends when there are no more packets to process.
-		_, err = src.Peek(1)
+		_, err := dec.src.Peek(1)
 		if err == io.EOF {
-			if dec.pmtID == 0 || dec.privateID == 0 {
-				err = io.ErrUnexpectedEOF
-			} else {
+			if dec.lenient || (dec.keys != nil && !dec.keys.settled) || (len(dec.pmtIDs) != 0 && len(dec.privateTables) != 0) {
 				// Stream ends cleanly
-				err = nil
+				return nil, info, nil, io.EOF
 			}
-			break
+			err = io.ErrUnexpectedEOF
 		}
-		packet, err = readTSPacket(src)
-		if err != nil {
-			break
+
+		var (
+			packet *tsPacket
+			cipher *turing.Cipher
+		)
+		pid := -1
+		if err == nil {
+			packet = &dec.packet
+			err = readTSPacket(dec.src, packet)
 		}
-		err = dec.processPacket(packet)
-		if err != nil {
-			break
+		if err == nil {
+			pid = int(packet.id())
+			badTables := dec.badTables
+			cipher, err = dec.processPacket(packet)
+			info.badTables += dec.badTables - badTables
+		}
+		var scrambled []byte
+		if err == nil && cipher != nil {
+			scrambled, err = packet.scrambledPayload()
+		}
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil && dec.lenient && (err == io.ErrUnexpectedEOF || errors.Is(err, ErrCorrupt)) {
+			info.dropped += dec.src.offset() - start
+			continue
 		}
-		err = writeTSPacket(dst, packet)
 		if err != nil {
-			break
+			return nil, info, nil, &PacketError{Stream: StreamTS, Packet: dec.count, Offset: start, PID: pid, Err: err}
 		}
+		if cipher != nil && dec.keys != nil {
+			dec.keys.consume(pid, len(scrambled))
+		}
+		info.decrypted = cipher != nil
+		info.pts = packet.pts()
+		return packet, info, cipher, nil
 	}
+}
 
-	if err != nil {
-		err = fmt.Errorf("failed while processing mpegts packet %d: %s", count, err)
+// resync skips forward to the next packet boundary if src isn't positioned at
+// one, returning the number of bytes skipped.  Candidate boundaries are confirmed
+// by the sync byte of the packet that follows, unless the input ends with the
+// candidate packet.  io.EOF is returned once the input is exhausted, including
+// when a truncated packet is skipped.
+func (dec *tsDecryptor) resync() (skipped int64, err error) {
+	for {
+		window, _ := dec.src.Peek(tsPacketSize + 1)
+		if len(window) < tsPacketSize {
+			n, _ := dec.src.Discard(len(window))
+			return skipped + int64(n), io.EOF
+		}
+		if window[0] == tsSync && (len(window) == tsPacketSize || window[tsPacketSize] == tsSync) {
+			return skipped, nil
+		}
+		_, err = dec.src.Discard(1)
+		if err != nil {
+			return
+		}
+		skipped++
 	}
-	return err
 }
 
-func (dec *tsDecryptor) processPacket(packet *tsPacket) error {
-	switch packet.id() {
-	case tsPatID:
-		return dec.processPAT(packet)
-	case dec.pmtID:
-		return dec.processPMT(packet)
-	case dec.privateID:
-		return dec.processPrivate(packet)
+// processPacket handles table packets and returns the cipher for scrambled packets
+func (dec *tsDecryptor) processPacket(packet *tsPacket) (*turing.Cipher, error) {
+	pid := packet.id()
+	switch {
+	case pid == tsPatID || dec.pmtIDs[pid]:
+		sections, damaged, err := dec.sections.push(packet)
+		dec.badTables += int64(damaged)
+		if err != nil {
+			return nil, err
+		}
+		for _, section := range sections {
+			if pid == tsPatID {
+				err = dec.processPAT(section)
+			} else {
+				err = dec.processPMT(pid, section)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	case dec.privateTables[pid] != nil:
+		return nil, dec.processPrivate(packet)
 	default:
-		if packet.scramble() != 0 {
-			return dec.decryptPacket(packet)
+		if packet.scramble() == 0 {
+			return nil, nil
 		}
-		return nil
+		c, present := dec.ciphers[pid]
+		if !present && dec.keys != nil && !dec.keys.settled {
+			// Packets preceding the first private data table are passed over
+			return nil, nil
+		}
+		if !present {
+			return nil, corruptf("cipher missing for scrambled packet with id 0x%04x", pid)
+		}
+		return c, nil
 	}
 }
 
-func (dec *tsDecryptor) processPAT(p *tsPacket) error {
-	offset := 0
-	payload := p.payload()
-	pointer := payload[offset]
-	if pointer != 0x00 {
-		return fmt.Errorf("PAT table contains unsupported pointer to additional data")
+// processPAT tracks the program map PIDs listed in the program association table.
+// Multi-section tables are supported, with the PIDs from every section of the
+// current table version tracked together.
+func (dec *tsDecryptor) processPAT(section []byte) error {
+	programs, err := parsePAT(section)
+	if err != nil || !currentSection(section) {
+		return err
 	}
-	offset++
 
-	// Skip table id
-	offset++
-
-	// We expect only a single program in the stream, which should mean a length of 13
-	length := joinShort(payload[offset:offset+2]) & 0x0fff
-	if length != 13 {
-		return fmt.Errorf("bogus PAT length -- additional programs present?")
+	version, number := sectionVersion(section), section[6]
+	if dec.patSections == nil || version != dec.patVersion {
+		dec.patSections = make(map[uint8][]packetID)
+		dec.patVersion = version
 	}
-	offset += 2
-
-	// Skip transport stream id (uint16), flags (byte), and section number/last section number info (2x uint8)
-	offset += 5
+	var pmtIDs []packetID
+	for _, program := range programs {
+		pmtIDs = append(pmtIDs, program.pmtID)
+	}
+	dec.patSections[number] = pmtIDs
 
-	// What's remaining should be a tuple of [program id (uint16), packet id of program map (uint16)]
-	offset += 2
-	dec.pmtID = extractPacketID(payload[offset : offset+2])
+	dec.pmtIDs = make(map[packetID]bool)
+	for _, ids := range dec.patSections {
+		for _, id := range ids {
+			dec.pmtIDs[id] = true
+		}
+	}
 	return nil
 }
 
-func (dec *tsDecryptor) processPMT(p *tsPacket) error {
-	offset := 0
-	payload := p.payload()
-	pointer := payload[offset]
-	if pointer != 0x00 {
-		return fmt.Errorf("PMT table contains unsupported pointer to additional data")
+// processPMT tracks the TiVo private data PID listed in a program map table.
+// Only some programs may carry private data, so the PID is reported missing
+// once every program listed in the PAT has been mapped without one.
+func (dec *tsDecryptor) processPMT(pmtID packetID, section []byte) error {
+	if section[0] != tsPmtTable {
+		// Other tables may share the PID, but they're of no interest
+		return nil
+	}
+	pmt, err := parsePMT(section)
+	if err != nil || !currentSection(section) {
+		return err
 	}
-	offset++
 
-	// Skip table id
-	offset++
+	for _, stream := range pmt.streams {
+		pid := packetID(stream.PID)
+		if stream.Type == tsPrivateType && dec.privateTables[pid] == nil {
+			dec.privateTables[pid] = make(map[packetID]bool)
+		}
+	}
+	dec.mappedIDs[pmtID] = true
+	if len(dec.privateTables) != 0 {
+		return nil
+	}
+	for id := range dec.pmtIDs {
+		if !dec.mappedIDs[id] {
+			return nil
+		}
+	}
+	return corruptf("failed to locate PID of private data")
+}
 
-	// Grab table length
-	length := joinShort(payload[offset:offset+2]) & 0x0fff
-	offset += 2
+// patProgram is a program listed in a program association table
+type patProgram struct {
+	number uint16
+	pmtID  packetID
+}
 
-	// Skip program id (uint16), flags (byte), section number/last section number info (2x uint8),
-	// PCR PID (uint16), and Program info length (uint16)
-	offset += 9
+// parsePAT returns the programs listed in a PAT section.  Program 0, which maps
+// the network information PID rather than a program map, is skipped.
+func parsePAT(section []byte) ([]patProgram, error) {
+	if section[0] != tsPatTable {
+		return nil, corruptf("bogus PAT table id: 0x%02x", section[0])
+	}
+	if len(section) < tsSectionHeaderLength+tsCRCLength {
+		return nil, corruptf("bogus PAT length: %d", len(section))
+	}
 
-	// What's remaining should be tuples of [type (byte), pid (uint16), ES info len (uint16)]
-	// offset < length only holds because there's 4 bytes prior to the table start (not included in length)
-	// and 4 bytes of CRC we want to skip (more correct would be offset - 4 < length - 4)
-	for uint16(offset) < length {
-		streamType := payload[offset]
-		if streamType == tsPrivateType {
-			dec.privateID = extractPacketID(payload[offset+1 : offset+3])
-			return nil
+	// What's remaining are tuples of [program number (uint16), packet id of program map (uint16)]
+	var programs []patProgram
+	for offset := tsSectionHeaderLength; offset+4 <= len(section)-tsCRCLength; offset += 4 {
+		number := joinShort(section[offset : offset+2])
+		if number == 0 {
+			continue
 		}
-		offset += 5
+		programs = append(programs, patProgram{number: number, pmtID: extractPacketID(section[offset+2 : offset+4])})
+	}
+	return programs, nil
+}
+
+// programMap is the content of a program map table section
+type programMap struct {
+	number  uint16
+	pcrID   packetID
+	streams []ESInfo
+}
+
+// parsePMT parses a program map table section.  The caller checks the table id,
+// as other tables may share the PID.
+func parsePMT(section []byte) (programMap, error) {
+	var pmt programMap
+	if len(section) < tsSectionHeaderLength+4+tsCRCLength {
+		return pmt, corruptf("bogus PMT length: %d", len(section))
 	}
-	return fmt.Errorf("Failed to locate PID of private data")
+	pmt.number = joinShort(section[3:5])
+
+	// PCR PID (uint16) followed by program info descriptors
+	offset := tsSectionHeaderLength
+	pmt.pcrID = extractPacketID(section[offset : offset+2])
+	offset += 2
+	infoLength := int(joinShort(section[offset:offset+2]) & 0x0fff)
+	offset += 2 + infoLength
+
+	// What's remaining are tuples of [type (byte), pid (uint16), ES info len (uint16)], each followed
+	// by ES info descriptors
+	for offset+5 <= len(section)-tsCRCLength {
+		pmt.streams = append(pmt.streams, ESInfo{PID: int(extractPacketID(section[offset+1 : offset+3])), Type: section[offset]})
+		esInfoLength := int(joinShort(section[offset+3:offset+5]) & 0x0fff)
+		offset += 5 + esInfoLength
+	}
+	return pmt, nil
 }
 
+// processPrivate reassembles the TiVo private data table and updates the ciphers
+// for the PIDs it lists.  Damaged tables are discarded and counted, leaving the
+// ciphers from the previous table in place.  Scrambled packets fail only if no
+// table has provided their cipher.
 func (dec *tsDecryptor) processPrivate(p *tsPacket) error {
+	pid := p.id()
 	payload := p.payload()
-	offset := 0
+	data := dec.privateData[pid]
+	if p.payloadStart() {
+		data = append(data[:0], payload...)
+	} else if len(data) != 0 {
+		data = append(data, payload...)
+	} else {
+		// Continuation of a table we've already processed or never saw the start of
+		return nil
+	}
+	dec.privateData[pid] = data
 
-	if string(payload[offset:4]) != "TiVo" {
-		return fmt.Errorf("bogus private data packet -- missing 'TiVo' magic bytes")
+	offset := 0
+	if len(data) < 4 {
+		return nil
+	}
+	if string(data[offset:4]) != "TiVo" {
+		// Missing 'TiVo' magic bytes
+		dec.privateData[pid] = data[:0]
+		dec.badTables++
+		return nil
 	}
 	offset += 4
 
@@ -183,89 +369,405 @@ func (dec *tsDecryptor) processPrivate(p *tsPacket) error {
 	offset += 5
 
 	// Grab length of confounder table
-	tableLength := payload[offset]
+	if len(data) < offset+1 {
+		return nil
+	}
+	tableLength := data[offset]
 	if tableLength%tsPrivateLength != 0 {
-		return fmt.Errorf("bogus private table length: %d", tableLength)
+		dec.privateData[pid] = data[:0]
+		dec.badTables++
+		return nil
 	}
 	offset++
 
+	// Wait for the remainder of the table if it spans multiple packets
+	if len(data) < offset+int(tableLength) {
+		return nil
+	}
+	dec.privateData[pid] = data[:0]
+
+	// Replace the ciphers from the previous table on this PID with those from the current table
+	table := dec.privateTables[pid]
+	for id := range table {
+		delete(dec.ciphers, id)
+		delete(table, id)
+	}
+
 	// Extract confounders from table and construct the appropriate cipher
-	dec.ciphers = make(map[packetID]*turing.Cipher)
 	for i := 0; i < int(tableLength/tsPrivateLength); i++ {
-		pid := extractPacketID(payload[offset : offset+2])
-		streamID := payload[offset+2]
-		cipher := dec.pool.getCipher(streamID, confounder(payload[offset+5:offset+9]))
-		dec.ciphers[pid] = cipher
+		id := extractPacketID(data[offset : offset+2])
+		streamID := data[offset+2]
+		handle := cipherHandle{id: streamID, confounder: confounder(data[offset+5 : offset+9])}
+		if dec.keys != nil {
+			dec.keys.assign(int(id), handle)
+		}
+		cipher := dec.pool.getCipher(handle.id, handle.confounder)
+		dec.ciphers[id] = cipher
+		table[id] = true
 		offset += tsPrivateLength
 	}
 
 	return nil
 }
 
-func (dec *tsDecryptor) decryptPacket(p *tsPacket) error {
-	pid := p.id()
-	c, present := dec.ciphers[pid]
-	if !present {
-		return fmt.Errorf("cipher missing for scrambled packet with id 0x%04x", pid)
-	}
+// cryptTSPacket XORs the scrambled portion of the packet payload with the keystream
+// from c and toggles the scrambling control bits.  The operation is symmetric, so
+// it decrypts scrambled packets and encrypts plain packets.  The packet must have
+// been validated with scrambledPayload.
+func cryptTSPacket(c *turing.Cipher, p *tsPacket) {
+	payload, _ := p.scrambledPayload()
+	c.XORKeyStream(payload, payload)
+	p.clearScramble()
+}
 
-	payload := p.payload()
-	if p.payloadStart() && (joinWord(payload[0:4])>>8) == psPrefix {
-		offset := 0
+// tsEncryptor scrambles the elementary streams of a plain mpeg-ts stream.  Program
+// map tables lacking a TiVo private data stream have one added, with a confounder
+// table following each occurrence of the program map table.
+type tsEncryptor struct {
+	state       *tsDecryptor // Tracks tables and ciphers exactly as decryption will
+	src         *sourceReader
+	random      io.Reader
+	privateIDs  map[packetID]packetID // Program map PID -> added private data PID
+	confounders map[packetID][]byte   // Elementary stream PID -> confounder bytes for added tables
+	counters    map[packetID]uint8    // Continuity counters for added private data PIDs
+	seenIDs     map[packetID]bool     // PIDs present in the input or its tables
+	packet      tsPacket              // Reused for every packet read
+	count       int64                 // Packets read
+}
 
-		// Skip PES start code, length, and flags
-		offset += 8
+func newTSEncryptor(mak string, iv []byte, src *sourceReader, random io.Reader) *tsEncryptor {
+	return &tsEncryptor{
+		state:       newTSDecryptor(mak, iv, nil),
+		src:         src,
+		random:      random,
+		privateIDs:  make(map[packetID]packetID),
+		confounders: make(map[packetID][]byte),
+		counters:    make(map[packetID]uint8),
+		seenIDs:     map[packetID]bool{tsPatID: true},
+	}
+}
 
-		// Skip past remaining header length
-		hdrlen := payload[offset]
-		offset++
-		offset += int(hdrlen)
+// encrypt scrambles packets from src and writes them to dst until src is exhausted
+func (enc *tsEncryptor) encrypt(dst io.Writer) error {
+	for {
+		enc.count++
+		start := enc.src.offset()
+		_, err := enc.src.Peek(1)
+		if err == io.EOF {
+			if len(enc.state.privateTables) == 0 {
+				return unsupportedf("mpeg-ts input lacks a program map table")
+			}
+			return nil
+		}
 
-		// Skip sequence headers/extensions
-		for joinWord(payload[offset:offset+4]) == psCode(psSequenceHeader) {
-			intrabyte := payload[offset+11]
-			offset += 12
+		pid := -1
+		var tables []tsPacket
+		packet := &enc.packet
+		if err == nil {
+			err = readTSPacket(enc.src, packet)
+		}
+		if err == nil {
+			pid = int(packet.id())
+			tables, err = enc.processPacket(packet)
+		}
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return &PacketError{Stream: StreamTS, Packet: enc.count, Offset: start, PID: pid, Err: err}
+		}
 
-			// Skip Q matrices
-			if intrabyte&(1<<1) != 0 {
-				offset += 64
-			}
-			if intrabyte&(1<<0) != 0 {
-				offset += 64
+		_, err = dst.Write(packet.content[:])
+		if err != nil {
+			return err
+		}
+		for i := range tables {
+			_, err = dst.Write(tables[i].content[:])
+			if err != nil {
+				return err
 			}
+		}
+	}
+}
+
+// processPacket scrambles packet in place.  Program map tables are given a private
+// data stream if needed, in which case the packets of the confounder table to
+// follow packet are returned.
+func (enc *tsEncryptor) processPacket(packet *tsPacket) (tables []tsPacket, err error) {
+	pid := packet.id()
+	enc.seenIDs[pid] = true
+	if packet.scramble() != 0 {
+		return nil, unsupportedf("packet is already scrambled")
+	}
+
+	if enc.state.pmtIDs[pid] && packet.payloadStart() {
+		tables, err = enc.addPrivateStream(packet)
+		if err != nil {
+			return nil, err
+		}
+	}
+	_, err = enc.state.processPacket(packet)
+	if err != nil {
+		return nil, err
+	}
+	for id := range enc.state.pmtIDs {
+		enc.seenIDs[id] = true
+	}
+	for i := range tables {
+		_, err = enc.state.processPacket(&tables[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	c := enc.state.ciphers[pid]
+	if c != nil && packet.hasPayload() {
+		if _, perr := packet.scrambledPayload(); perr == nil {
+			cryptTSPacket(c, packet)
+		}
+	}
+	return tables, nil
+}
 
-			// Skip sequence extension
-			if joinWord(payload[offset:offset+4]) == psCode(psSequenceExtension) {
-				offset += 10
+// addPrivateStream adds a TiVo private data stream to the program map table in
+// packet if it lacks one, returning the packets of a confounder table for the
+// elementary streams of the program.  Only tables that fit in a single packet
+// are supported.
+func (enc *tsEncryptor) addPrivateStream(packet *tsPacket) ([]tsPacket, error) {
+	payload := packet.payload()
+	if len(payload) == 0 || 1+int(payload[0])+3 > len(payload) {
+		return nil, nil
+	}
+	start := 1 + int(payload[0])
+	section := payload[start:]
+	if section[0] != tsPmtTable {
+		return nil, nil
+	}
+	length := 3 + int(joinShort(section[1:3])&0x0fff)
+	complete := length <= len(section)
+	if complete && (length < tsSectionHeaderLength+4+tsCRCLength || !currentSection(section[:length])) {
+		return nil, nil
+	}
+	end := length - tsCRCLength
+	if !complete {
+		end = len(section)
+	}
+
+	// Collect the elementary streams, stopping if a private data stream is present
+	var streams []packetID
+	streamIDs := make(map[packetID]uint8)
+	offset := tsSectionHeaderLength + 2
+	if offset+2 <= end {
+		offset += 2 + int(joinShort(section[offset:offset+2])&0x0fff)
+	}
+	for offset+5 <= end {
+		streamType := section[offset]
+		id := extractPacketID(section[offset+1 : offset+3])
+		if streamType == tsPrivateType {
+			return nil, nil
+		}
+		enc.seenIDs[id] = true
+		streams = append(streams, id)
+		streamIDs[id] = pesStreamID(streamType)
+		offset += 5 + int(joinShort(section[offset+3:offset+5])&0x0fff)
+	}
+	if !complete {
+		return nil, unsupportedf("program map tables spanning multiple packets are not supported")
+	}
+	if len(streams)*tsPrivateLength > 0xff {
+		return nil, unsupportedf("too many elementary streams to scramble: %d", len(streams))
+	}
+	for _, b := range section[length:] {
+		if b != 0xff {
+			return nil, unsupportedf("program map tables sharing a packet with other sections are not supported")
+		}
+	}
+	if len(section)-length < 5 {
+		return nil, unsupportedf("program map table is too long to add a private data stream")
+	}
+
+	// Add the private data stream and recompute the CRC
+	pmtID := packet.id()
+	privateID, present := enc.privateIDs[pmtID]
+	if !present {
+		privateID = enc.unusedID()
+		enc.privateIDs[pmtID] = privateID
+		enc.seenIDs[privateID] = true
+	}
+	updated := make([]byte, 0, length+5)
+	updated = append(updated, section[:length-tsCRCLength]...)
+	updated = append(updated, tsPrivateType, 0xe0|byte(privateID>>8), byte(privateID), 0xf0, 0x00)
+	sectionLength := joinShort(updated[1:3])&0xf000 | uint16(len(updated)+tsCRCLength-3)
+	updated[1], updated[2] = byte(sectionLength>>8), byte(sectionLength)
+	crc := crc32MPEG(updated)
+	updated = append(updated, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+	copy(section, updated)
+
+	// Build the confounder table
+	data := []byte{'T', 'i', 'V', 'o', 0, 0, 0, 0, 0, byte(len(streams) * tsPrivateLength)}
+	for _, id := range streams {
+		confounder := enc.confounders[id]
+		if confounder == nil {
+			confounder = make([]byte, 4)
+			_, err := io.ReadFull(enc.random, confounder)
+			if err != nil {
+				return nil, err
 			}
+			enc.confounders[id] = confounder
 		}
+		entry := make([]byte, tsPrivateLength)
+		entry[0], entry[1], entry[2] = 0xe0|byte(id>>8), byte(id), streamIDs[id]
+		copy(entry[5:9], confounder)
+		data = append(data, entry...)
+	}
+	return enc.packetize(privateID, data), nil
+}
 
-		// Skip group header
-		if joinWord(payload[offset:offset+4]) == psCode(psGroupHeader) {
-			offset += 8
+// packetize splits data into packets for pid, padding the final packet with stuffing
+func (enc *tsEncryptor) packetize(pid packetID, data []byte) []tsPacket {
+	var packets []tsPacket
+	for first := true; first || len(data) != 0; first = false {
+		var p tsPacket
+		p.content[0] = tsSync
+		p.content[1], p.content[2] = byte(pid>>8), byte(pid)
+		if first {
+			p.content[1] |= 1 << 6
 		}
+		p.content[3] = 0x10 | enc.counters[pid] // Payload only
+		enc.counters[pid] = (enc.counters[pid] + 1) & 0x0f
 
-		payload = payload[offset:]
+		n := copy(p.content[4:], data)
+		data = data[n:]
+		for i := 4 + n; i < tsPacketSize; i++ {
+			p.content[i] = 0xff
+		}
+		packets = append(packets, p)
 	}
+	return packets
+}
 
-	c.XORKeyStream(payload, payload)
-	p.clearScramble()
-	return nil
+// unusedID returns a PID that hasn't been seen in the input, preferring high PIDs
+// as those are the least likely to be used by tables that follow
+func (enc *tsEncryptor) unusedID() packetID {
+	id := packetID(tsIDMask - 1)
+	for enc.seenIDs[id] {
+		id--
+	}
+	return id
+}
+
+// pesStreamID returns a representative PES stream ID for an mpeg-ts stream type
+func pesStreamID(streamType uint8) uint8 {
+	switch streamType {
+	case 0x01, 0x02, 0x10, 0x1b, 0x24: // mpeg-1/2 video, mpeg-4 video, h.264, h.265
+		return psVideoStreamMin
+	case 0x81: // ac-3
+		return psPrivateStream1
+	default:
+		return psAudioStream
+	}
+}
+
+// sectionAssembler reassembles PSI sections that span multiple packets.  Sections
+// are buffered by PID, starting from the pointer field of packets with the payload
+// unit start indicator set.
+type sectionAssembler struct {
+	pending map[packetID][]byte
+}
+
+func newSectionAssembler() *sectionAssembler {
+	return &sectionAssembler{pending: make(map[packetID][]byte)}
+}
+
+// push adds the payload of p to the assembler, returning the sections completed
+// by the packet.  Sections with a bad CRC are discarded and counted in damaged.
+// The returned sections are only valid until the following call to push.
+func (a *sectionAssembler) push(p *tsPacket) (sections [][]byte, damaged int, err error) {
+	pid := p.id()
+	payload := p.payload()
+	pending, started := a.pending[pid]
+	if p.payloadStart() {
+		if len(payload) == 0 || 1+int(payload[0]) > len(payload) {
+			delete(a.pending, pid)
+			return nil, 0, corruptf("bogus PSI pointer field")
+		}
+
+		// Bytes prior to the pointer complete the previous section
+		pointer := int(payload[0])
+		if started {
+			sections, _, damaged, err = splitSections(append(pending, payload[1:1+pointer]...))
+			if err != nil {
+				delete(a.pending, pid)
+				return nil, damaged, err
+			}
+		}
+		pending = append([]byte(nil), payload[1+pointer:]...)
+	} else if started {
+		pending = append(pending, payload...)
+	} else {
+		// Continuation of a section we never saw the start of
+		return nil, 0, nil
+	}
+
+	complete, rest, bad, err := splitSections(pending)
+	damaged += bad
+	if err != nil {
+		delete(a.pending, pid)
+		return nil, damaged, err
+	}
+	sections = append(sections, complete...)
+	if rest == nil {
+		delete(a.pending, pid)
+	} else {
+		a.pending[pid] = rest
+	}
+	return sections, damaged, nil
+}
+
+// splitSections returns the complete sections at the start of buf along with the
+// remaining partial section, if any.  Sections with a bad CRC are skipped and
+// counted in damaged.
+func splitSections(buf []byte) (sections [][]byte, rest []byte, damaged int, err error) {
+	for len(buf) != 0 {
+		if buf[0] == 0xff {
+			// Stuffing follows the final section
+			return sections, nil, damaged, nil
+		}
+		if len(buf) < 3 {
+			return sections, buf, damaged, nil
+		}
+		length := 3 + int(joinShort(buf[1:3])&0x0fff)
+		if length > tsMaxSectionLength {
+			return nil, nil, damaged, corruptf("bogus PSI section length: %d", length)
+		}
+		if len(buf) < length {
+			return sections, buf, damaged, nil
+		}
+		section := buf[:length]
+		buf = buf[length:]
+		syntax := section[1]&0x80 != 0
+		if syntax && (length < tsSectionHeaderLength+tsCRCLength || crc32MPEG(section) != 0) {
+			damaged++
+			continue
+		}
+		sections = append(sections, section)
+	}
+	return sections, nil, damaged, nil
 }
 
 type tsPacket struct {
-	content [188]byte
+	content [tsPacketSize]byte
 }
 
-func readTSPacket(src io.Reader) (packet *tsPacket, err error) {
-	packet = &tsPacket{}
+// readTSPacket reads the next packet from src into packet
+func readTSPacket(src io.Reader, packet *tsPacket) (err error) {
 	_, err = io.ReadFull(src, packet.content[:])
 	if err != nil {
 		return
 	}
 
 	if packet.content[0] != tsSync {
-		err = fmt.Errorf("expected sync byte, got 0x%02x instead", packet.content[0])
+		err = corruptf("expected sync byte, got 0x%02x instead", packet.content[0])
 	}
 	return
 }
@@ -303,16 +805,88 @@ func (p *tsPacket) counter() uint8 {
 	return p.content[3] & 0x0f
 }
 
+// payload returns the packet payload, which is empty if the adaptation field
+// length is out of range
 func (p *tsPacket) payload() []byte {
-	var offset uint8
+	offset := 4
 	if p.hasAdaptation() {
-		offset = 5 + p.content[4]
-	} else {
-		offset = 4
+		offset += 1 + int(p.content[4])
+	}
+	if offset > tsPacketSize {
+		offset = tsPacketSize
 	}
 	return p.content[offset:]
 }
 
+// scrambledPayload returns the portion of the payload that is scrambled.  PES and
+// video sequence headers at the start of the payload are left as-is, as they
+// aren't scrambled.
+func (p *tsPacket) scrambledPayload() ([]byte, error) {
+	payload := p.payload()
+	if !p.payloadStart() || !hasStartCode(payload, 0) {
+		return payload, nil
+	}
+
+	// Skip PES start code, length, and flags, then the remaining header length
+	if len(payload) < 9 {
+		return nil, corruptf("truncated PES header")
+	}
+	offset := 9 + int(payload[8])
+
+	// Skip sequence headers/extensions
+	for hasStartCode(payload, offset) && payload[offset+3] == psSequenceHeader {
+		if len(payload) < offset+12 {
+			return nil, corruptf("truncated sequence header")
+		}
+		intrabyte := payload[offset+11]
+		offset += 12
+
+		// Skip Q matrices
+		if intrabyte&(1<<1) != 0 {
+			offset += 64
+		}
+		if intrabyte&(1<<0) != 0 {
+			offset += 64
+		}
+
+		// Skip sequence extension
+		if hasStartCode(payload, offset) && payload[offset+3] == psSequenceExtension {
+			offset += 10
+		}
+	}
+
+	// Skip group header
+	if hasStartCode(payload, offset) && payload[offset+3] == psGroupHeader {
+		offset += 8
+	}
+
+	if offset > len(payload) {
+		return nil, corruptf("PES headers overrun packet payload")
+	}
+	return payload[offset:], nil
+}
+
+// pts returns the presentation timestamp of a PES header starting in the packet, or -1 if absent
+func (p *tsPacket) pts() int64 {
+	if !p.payloadStart() {
+		return -1
+	}
+	payload := p.payload()
+	if len(payload) < 14 || (joinWord(payload[0:4])>>8) != psPrefix || payload[7]&0x80 == 0 {
+		return -1
+	}
+	return parsePTS(payload[9:14])
+}
+
+// currentSection reports whether the section's current/next indicator is set
+func currentSection(section []byte) bool {
+	return section[5]&0x01 != 0
+}
+
+func sectionVersion(section []byte) uint8 {
+	return (section[5] >> 1) & 0x1f
+}
+
 func extractPacketID(b []byte) packetID {
 	return packetID(joinShort(b) & tsIDMask)
 }
@@ -0,0 +1,208 @@
+// Copyright (c) 2016 Bob Ziuchkovski
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package devo
+
+import (
+	"github.com/bobziuchkovski/turing"
+	"sync"
+)
+
+// tsBatchSize is the number of packets handed to the workers at a time
+const tsBatchSize = 512
+
+// stopper is implemented by decryptors that run background goroutines
+type stopper interface {
+	// stop releases the goroutines.  next must not be called afterwards.
+	stop()
+}
+
+// tsBatch is a run of consecutive packets read by the producer goroutine.
+// Packets are decrypted in place by the workers.
+type tsBatch struct {
+	packets [tsBatchSize]tsPacket
+	infos   [tsBatchSize]packetInfo
+	ciphers [tsBatchSize]*turing.Cipher
+	count   int
+	keys    []*turing.Cipher // Distinct ciphers used in the batch
+	err     error            // Error that terminated the batch, if any
+	errInfo packetInfo       // Info accompanying err
+	wg      sync.WaitGroup
+}
+
+// tsJob asks a worker to decrypt the packets of a batch that use cipher
+type tsJob struct {
+	batch  *tsBatch
+	cipher *turing.Cipher
+}
+
+// parallelTSDecryptor wraps a tsDecryptor, reading and processing tables on a
+// producer goroutine while scrambled payloads are decrypted by a set of workers.
+// Each keystream is sequential, so every packet using a given cipher is decrypted
+// by the same worker, in order.  Work is divided by cipher rather than by PID, as
+// streams with the same stream ID and confounder share a cipher.  Packets are
+// returned in their original order.
+type parallelTSDecryptor struct {
+	dec     *tsDecryptor
+	workers []chan tsJob
+	assign  map[*turing.Cipher]int // Worker index by cipher
+	batches chan *tsBatch          // Batches in stream order
+	free    chan *tsBatch          // Batches available for reuse
+	done    chan struct{}
+	once    sync.Once
+
+	current *tsBatch
+	pos     int
+	err     error
+	errInfo packetInfo
+}
+
+func newParallelTSDecryptor(dec *tsDecryptor, workers int) *parallelTSDecryptor {
+	p := &parallelTSDecryptor{
+		dec:     dec,
+		workers: make([]chan tsJob, workers),
+		assign:  make(map[*turing.Cipher]int),
+		batches: make(chan *tsBatch, workers),
+		free:    make(chan *tsBatch, workers+2),
+		done:    make(chan struct{}),
+	}
+	for i := 0; i < cap(p.free); i++ {
+		p.free <- &tsBatch{}
+	}
+	for i := range p.workers {
+		p.workers[i] = make(chan tsJob, workers)
+		go p.work(p.workers[i])
+	}
+	go p.produce()
+	return p
+}
+
+// next returns the next decrypted packet, waiting on the workers if needed
+func (p *parallelTSDecryptor) next() ([]byte, packetInfo, error) {
+	for p.current == nil || p.pos == p.current.count {
+		if p.err != nil {
+			// Only report dropped bytes once
+			info := p.errInfo
+			p.errInfo = packetInfo{pts: -1}
+			return nil, info, p.err
+		}
+		if p.current != nil {
+			p.free <- p.current
+		}
+		p.current = <-p.batches
+		p.current.wg.Wait()
+		p.pos = 0
+		if p.current.err != nil {
+			p.err, p.errInfo = p.current.err, p.current.errInfo
+		}
+	}
+	packet, info := &p.current.packets[p.pos], p.current.infos[p.pos]
+	p.pos++
+	return packet.content[:], info, nil
+}
+
+func (p *parallelTSDecryptor) stop() {
+	p.once.Do(func() {
+		close(p.done)
+	})
+}
+
+// produce reads batches from the underlying decryptor and dispatches them to
+// the workers until the stream ends or the decryptor is stopped
+func (p *parallelTSDecryptor) produce() {
+	for {
+		var batch *tsBatch
+		select {
+		case batch = <-p.free:
+		case <-p.done:
+			return
+		}
+		p.fill(batch)
+
+		batch.wg.Add(len(batch.keys))
+		for _, cipher := range batch.keys {
+			worker, present := p.assign[cipher]
+			if !present {
+				worker = len(p.assign) % len(p.workers)
+				p.assign[cipher] = worker
+			}
+			select {
+			case p.workers[worker] <- tsJob{batch: batch, cipher: cipher}:
+			case <-p.done:
+				return
+			}
+		}
+		select {
+		case p.batches <- batch:
+		case <-p.done:
+			return
+		}
+		if batch.err != nil {
+			return
+		}
+	}
+}
+
+// fill reads packets into batch until it's full or an error is encountered
+func (p *parallelTSDecryptor) fill(batch *tsBatch) {
+	batch.count, batch.keys, batch.err = 0, batch.keys[:0], nil
+	for batch.count < tsBatchSize {
+		packet, info, cipher, err := p.dec.read()
+		if err != nil {
+			batch.err, batch.errInfo = err, info
+			return
+		}
+		i := batch.count
+		batch.packets[i] = *packet
+		batch.infos[i] = info
+		batch.ciphers[i] = cipher
+		batch.count++
+
+		if cipher != nil {
+			batch.addCipher(cipher)
+		}
+	}
+}
+
+func (batch *tsBatch) addCipher(cipher *turing.Cipher) {
+	for _, existing := range batch.keys {
+		if existing == cipher {
+			return
+		}
+	}
+	batch.keys = append(batch.keys, cipher)
+}
+
+func (p *parallelTSDecryptor) work(jobs <-chan tsJob) {
+	for {
+		select {
+		case job := <-jobs:
+			batch := job.batch
+			for i := 0; i < batch.count; i++ {
+				if batch.ciphers[i] == job.cipher {
+					cryptTSPacket(job.cipher, &batch.packets[i])
+				}
+			}
+			batch.wg.Done()
+		case <-p.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,264 @@
+// Copyright (c) 2016 Bob Ziuchkovski
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package devo
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// rangeLookbehind is the initial distance ahead of a range at which DecryptRange
+// starts decrypting, so that ciphers are in position by the start of the range.
+// The distance grows until they are.
+const rangeLookbehind = 4 << 20
+
+// errConfounderReused is returned by decryptRange when a stream switches back to
+// a confounder it used earlier, before any output is written
+var errConfounderReused = errors.New("devo: confounder reused")
+
+// DecryptRange decrypts the video content of the TiVo file read from src using
+// the specified media access key (mak), writing bytes start through end-1 of the
+// decrypted video to dst.  If end is negative, the rest of the video is written.
+// The output is identical to the same range of Decrypt output, which is the same
+// size as the encrypted video content, so a partial output may be resumed by
+// passing its size as start.  ErrBadAccessKey is returned prior to writing any
+// content if mak fails to decrypt the file metadata.
+//
+// Each cipher's keystream advances with every packet it decrypts, so decryption
+// can't simply begin mid-stream.  Instead, DecryptRange seeks to a point shortly
+// ahead of start and resynchronizes there: at a packet boundary for mpeg-ts,
+// with ciphers taken from the TiVo private data tables that follow, and at the
+// next packet boundary for mpeg-ps, with ciphers taken from the PES private data
+// of each packet.  A cipher's keystream is only known to be in position when its
+// confounder first appears, so the starting point is moved further ahead of
+// start until each stream has changed confounders by the start of the range.
+// TiVo recordings change confounders frequently, but in the worst case the video
+// is decrypted from the beginning.
+//
+// A confounder's keystream is assumed to start from the beginning when it first
+// appears after the starting point, which only holds if confounders aren't
+// reused.  If a stream is seen switching back to an earlier confounder ahead of
+// the range, the video is decrypted from the beginning instead.  If that happens
+// within the range, output already written may be invalid, and an error wrapping
+// ErrUnsupported is returned.
+func DecryptRange(dst io.Writer, src io.ReadSeeker, mak string, start, end int64) error {
+	if start < 0 || (end >= 0 && end < start) {
+		return fmt.Errorf("devo: invalid range %d-%d", start, end)
+	}
+	_, err := src.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	header, meta, err := readFileMetadata(src)
+	if err != nil {
+		return err
+	}
+	err = checkAccessKey(mak, meta)
+	if err != nil {
+		return err
+	}
+
+	dstbuf := bufio.NewWriter(dst)
+	for lookbehind := int64(rangeLookbehind); ; lookbehind *= 4 {
+		from := start - lookbehind
+		if from < 0 {
+			from = 0
+		}
+		if header.Flags&tsType != 0 {
+			// Transport packets are fixed size, so start on a packet boundary
+			from -= from % tsPacketSize
+		}
+		synced, err := decryptRange(dstbuf, src, mak, header, meta[0].Content, from, start, end)
+		if err == errConfounderReused {
+			// Keystream positions can't be inferred, so start from the beginning
+			synced, err = decryptRange(dstbuf, src, mak, header, meta[0].Content, 0, start, end)
+		}
+		if err != nil {
+			return err
+		}
+		if synced {
+			return dstbuf.Flush()
+		}
+	}
+}
+
+// decryptRange decrypts from offset from of the video content, writing output
+// once the range from start to end is reached.  If the ciphers aren't all in
+// position by start, nothing is written and synced is false.  If a confounder is
+// reused before start, nothing is written and errConfounderReused is returned.
+func decryptRange(dst io.Writer, src io.ReadSeeker, mak string, header fileHeader, iv []byte, from, start, end int64) (synced bool, err error) {
+	videoOffset := int64(header.VideoOffset)
+	_, err = src.Seek(videoOffset+from, io.SeekStart)
+	if err != nil {
+		return false, err
+	}
+	srcbuf := newSourceReader(src, videoOffset+from)
+
+	// Starting at the beginning of the video, every cipher is in position
+	var keys *keyTracker
+	if from > 0 {
+		keys = newKeyTracker()
+	}
+	var (
+		dec    decryptor
+		resync func() (int64, error)
+	)
+	if header.Flags&tsType != 0 {
+		ts := newTSDecryptor(mak, iv, srcbuf)
+		ts.keys = keys
+		dec, resync = ts, ts.resync
+	} else {
+		ps := newPSDecryptor(mak, iv, srcbuf)
+		ps.keys = keys
+		dec, resync = ps, ps.resync
+	}
+	if keys != nil {
+		_, err = resync()
+		if err == io.EOF {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+
+	for {
+		packet, _, err := dec.next()
+		if err == io.EOF {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		length := int64(len(packet))
+		offset := srcbuf.offset() - length - videoOffset
+		if offset+length <= start {
+			continue
+		}
+		if end >= 0 && offset >= end {
+			return true, nil
+		}
+		if keys != nil && keys.reused {
+			if !keys.settled {
+				return false, errConfounderReused
+			}
+			return false, unsupportedf("devo: confounder reused within range starting at offset %d", start)
+		}
+		if keys != nil && !keys.settled {
+			if !keys.synced() {
+				return false, nil
+			}
+			keys.settled = true
+		}
+
+		lo, hi := int64(0), length
+		if offset < start {
+			lo = start - offset
+		}
+		if end >= 0 && offset+hi > end {
+			hi = end - offset
+		}
+		_, err = dst.Write(packet[lo:hi])
+		if err != nil {
+			return false, err
+		}
+	}
+}
+
+// keyTracker tracks whether ciphers are in position when decryption starts partway
+// through a stream.  Each stream's first cipher may have been in use before the
+// starting point, leaving its keystream position unknown.  Ciphers for later
+// confounders are assumed to start from the beginning of their keystream, which
+// holds as long as confounders aren't reused, so a cipher coming back into use
+// after being replaced is flagged.  Streams are identified by PES stream ID for
+// mpeg-ps or PID for mpeg-ts.
+type keyTracker struct {
+	current map[int]cipherHandle // Stream -> cipher in use
+	seen    map[cipherHandle]bool
+	suspect map[cipherHandle]bool  // Ciphers with an unknown keystream position
+	retired map[cipherHandle]bool  // Ciphers replaced on every stream that used them
+	used    map[cipherHandle]int64 // Keystream consumed by each cipher since tracking began
+	settled bool                   // Ciphers for streams first seen once settled are trusted
+	reused  bool                   // A retired cipher came back into use
+}
+
+func newKeyTracker() *keyTracker {
+	return &keyTracker{
+		current: make(map[int]cipherHandle),
+		seen:    make(map[cipherHandle]bool),
+		suspect: make(map[cipherHandle]bool),
+		retired: make(map[cipherHandle]bool),
+		used:    make(map[cipherHandle]int64),
+	}
+}
+
+// assign records that stream is decrypted using the cipher for handle
+func (t *keyTracker) assign(stream int, handle cipherHandle) {
+	previous, known := t.current[stream]
+	if known && previous == handle {
+		return
+	}
+	if t.retired[handle] {
+		delete(t.retired, handle)
+		t.reused = true
+	}
+	if !t.seen[handle] {
+		t.seen[handle] = true
+		if !known && !t.settled {
+			t.suspect[handle] = true
+		}
+	}
+	t.current[stream] = handle
+	if known && !t.inUse(previous) {
+		t.retired[previous] = true
+	}
+}
+
+// inUse reports whether any stream is decrypted using the cipher for handle
+func (t *keyTracker) inUse(handle cipherHandle) bool {
+	for _, h := range t.current {
+		if h == handle {
+			return true
+		}
+	}
+	return false
+}
+
+// consume records that n bytes of keystream were used to decrypt stream
+func (t *keyTracker) consume(stream int, n int) {
+	t.used[t.current[stream]] += int64(n)
+}
+
+// synced reports whether any streams have been seen and the cipher for each is
+// in position
+func (t *keyTracker) synced() bool {
+	if len(t.current) == 0 {
+		return false
+	}
+	for _, handle := range t.current {
+		if t.suspect[handle] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,65 @@
+// Copyright (c) 2016 Bob Ziuchkovski
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package devo
+
+import (
+	"errors"
+	"io"
+)
+
+var errClosed = errors.New("devo: read from closed reader")
+
+type reader struct {
+	dec     decryptor
+	pending []byte
+	err     error
+}
+
+// NewReader returns a reader that decrypts the TiVo file read from src using
+// the specified media access key (mak).  The file metadata is read and mak is
+// verified before NewReader returns, so ErrBadAccessKey is returned up front.
+// Video content is decrypted on demand as the returned reader is read.
+// Closing the returned reader does not close src.
+func NewReader(src io.Reader, mak string) (io.ReadCloser, error) {
+	_, dec, err := newDecryptor(src, mak, &Options{})
+	if err != nil {
+		return nil, err
+	}
+	return &reader{dec: dec}, nil
+}
+
+func (r *reader) Read(p []byte) (n int, err error) {
+	for len(r.pending) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.pending, _, r.err = r.dec.next()
+	}
+	n = copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+func (r *reader) Close() error {
+	r.pending = nil
+	r.err = errClosed
+	return nil
+}
@@ -0,0 +1,265 @@
+// Copyright (c) 2016 Bob Ziuchkovski
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package devo
+
+import (
+	"crypto/md5"
+	"errors"
+	"io"
+)
+
+// seekSkipLimit is the furthest a Seeker decrypts ahead to reach a position
+// rather than resuming from an index point
+const seekSkipLimit = indexInterval
+
+// SeekerOptions controls optional Seeker behavior.  A nil *SeekerOptions is
+// equivalent to the zero value.
+type SeekerOptions struct {
+	// Index, if non-nil, is used rather than building an index on the first
+	// seek, e.g. a .devoidx sidecar read with LoadIndex.  It's ignored if it
+	// wasn't built from the same file.
+	Index *Index
+
+	// IndexPath, if non-empty, is where the index built on the first seek is
+	// cached in the .devoidx format.  A cached index is reused if it matches the
+	// file, and rebuilt otherwise.  Failure to write the cache is not an error.
+	IndexPath string
+
+	// IndexFunc, if non-nil, is called on the first seek that needs the index.
+	// It's passed a function that loads or builds the index as described above,
+	// and may wrap it to share indexes between Seekers, e.g. by holding them in
+	// memory and building each only once.  An index that wasn't built from the
+	// same file is ignored.
+	IndexFunc func(load func() (*Index, error)) (*Index, error)
+}
+
+// Seeker is a seekable view of the decrypted video content of a TiVo file.
+// Sequential reads decrypt as they go, like NewReader.  The first seek away
+// from the current position decrypts the entire file to build an Index, unless
+// one is supplied in SeekerOptions, and later reads resume from its points.
+// Seekers are suitable for http.ServeContent.  A Seeker isn't safe for
+// concurrent use.
+type Seeker struct {
+	src    io.ReadSeeker
+	mak    string
+	header fileHeader
+	iv     []byte
+	fp     [md5.Size]byte
+	size   int64 // Size of the TiVo file
+	opts   SeekerOptions
+
+	index *Index // nil until the index is built or loaded
+
+	dec     decryptor // nil until the first read
+	decPos  int64     // Decrypted offset of pending[0]
+	pending []byte    // Remainder of the most recently decrypted packet
+	pos     int64
+	err     error // Sticky decryption error
+}
+
+// NewSeeker returns a Seeker for the TiVo file read from src using the specified
+// media access key (mak).  ErrBadAccessKey is returned if mak fails to decrypt
+// the file metadata.  Opts may be nil.
+func NewSeeker(src io.ReadSeeker, mak string, opts *SeekerOptions) (*Seeker, error) {
+	if opts == nil {
+		opts = &SeekerOptions{}
+	}
+	size, err := src.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	_, err = src.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	header, meta, err := readFileMetadata(src)
+	if err != nil {
+		return nil, err
+	}
+	err = checkAccessKey(mak, meta)
+	if err != nil {
+		return nil, err
+	}
+	if int64(header.VideoOffset) > size {
+		return nil, &FormatError{Offset: 0, Err: corruptf("video offset 0x%08x is past the end of the file", header.VideoOffset)}
+	}
+	return &Seeker{
+		src:    src,
+		mak:    mak,
+		header: header,
+		iv:     meta[0].Content,
+		fp:     fingerprint(meta),
+		size:   size,
+		opts:   *opts,
+	}, nil
+}
+
+// Stream returns the container format of the video.
+func (s *Seeker) Stream() StreamType {
+	if s.header.Flags&tsType != 0 {
+		return StreamTS
+	}
+	return StreamPS
+}
+
+// Size returns the size of the decrypted video, which is the size of the
+// encrypted video content.
+func (s *Seeker) Size() int64 {
+	return s.size - int64(s.header.VideoOffset)
+}
+
+// Seek sets the offset for the next Read, interpreted according to whence as
+// with io.Seeker.  Offsets are relative to the decrypted video.
+func (s *Seeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += s.pos
+	case io.SeekEnd:
+		offset += s.Size()
+	default:
+		return 0, errors.New("devo: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("devo: negative position")
+	}
+	s.pos = offset
+	return offset, nil
+}
+
+// Read reads decrypted video from the current offset.
+func (s *Seeker) Read(p []byte) (n int, err error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+	if s.pos >= s.Size() {
+		return 0, io.EOF
+	}
+	if s.dec == nil || s.pos < s.decPos || s.pos-s.decPos > seekSkipLimit {
+		err = s.resume()
+		if err != nil {
+			s.err = err
+			return 0, err
+		}
+	}
+
+	// Decrypt ahead to the current offset, then fill p
+	for n < len(p) {
+		if len(s.pending) == 0 {
+			s.pending, _, err = s.dec.next()
+			if err != nil {
+				s.pending, s.dec = nil, nil
+				if err != io.EOF {
+					s.err = err
+				}
+				if n != 0 {
+					err = nil
+				}
+				return n, err
+			}
+		}
+		if skip := s.pos - s.decPos; skip > 0 {
+			if skip > int64(len(s.pending)) {
+				skip = int64(len(s.pending))
+			}
+			s.pending = s.pending[skip:]
+			s.decPos += skip
+			continue
+		}
+		copied := copy(p[n:], s.pending)
+		s.pending = s.pending[copied:]
+		s.decPos += int64(copied)
+		s.pos += int64(copied)
+		n += copied
+	}
+	return n, nil
+}
+
+// resume restarts decryption from the last index point at or before the current
+// offset, building the index if needed
+func (s *Seeker) resume() error {
+	var point IndexPoint
+	if s.pos >= indexInterval {
+		err := s.loadIndex()
+		if err != nil {
+			return err
+		}
+		point = s.index.Before(s.pos)
+	}
+	_, err := s.src.Seek(int64(s.header.VideoOffset)+point.Offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	s.dec = restore(point, s.header, s.iv, s.mak, s.src)
+	s.decPos, s.pending = point.Offset, nil
+	return nil
+}
+
+// loadIndex sets the index, through IndexFunc if there is one
+func (s *Seeker) loadIndex() error {
+	if s.index != nil {
+		return nil
+	}
+	var (
+		idx *Index
+		err error
+	)
+	if s.opts.IndexFunc != nil {
+		idx, err = s.opts.IndexFunc(s.findIndex)
+		if err == nil && (idx == nil || !idx.matches(s.Stream(), s.Size(), s.fp)) {
+			idx, err = s.findIndex()
+		}
+	} else {
+		idx, err = s.findIndex()
+	}
+	if err != nil {
+		return err
+	}
+	s.index = idx
+	return nil
+}
+
+// findIndex returns the supplied or cached index, or builds the index if
+// neither is usable
+func (s *Seeker) findIndex() (*Index, error) {
+	if idx := s.opts.Index; idx != nil && idx.matches(s.Stream(), s.Size(), s.fp) {
+		return idx, nil
+	}
+	if s.opts.IndexPath != "" {
+		idx, err := LoadIndex(s.opts.IndexPath)
+		if err == nil && idx.matches(s.Stream(), s.Size(), s.fp) {
+			return idx, nil
+		}
+	}
+
+	_, err := s.src.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	idx, err := BuildIndex(s.src, s.mak)
+	if err != nil {
+		return nil, err
+	}
+	if s.opts.IndexPath != "" {
+		writeIndexFile(s.opts.IndexPath, idx)
+	}
+	return idx, nil
+}
@@ -0,0 +1,137 @@
+// Copyright (c) 2016 Bob Ziuchkovski
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package tivo
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// challenge is a parsed WWW-Authenticate digest challenge (RFC 2617).  Only the
+// MD5 algorithm is supported, as that's all TiVos use.
+type challenge struct {
+	realm  string
+	nonce  string
+	opaque string
+	qop    string // "auth" or empty
+	count  uint32 // Nonce count, incremented for each authorization
+}
+
+func parseChallenge(header string) (*challenge, error) {
+	if !strings.HasPrefix(strings.ToLower(header), "digest ") {
+		return nil, fmt.Errorf("tivo: unsupported authentication challenge %q", header)
+	}
+	params := parseParams(header[len("digest "):])
+	if algorithm := params["algorithm"]; algorithm != "" && !strings.EqualFold(algorithm, "MD5") {
+		return nil, fmt.Errorf("tivo: unsupported digest algorithm %q", algorithm)
+	}
+	ch := &challenge{realm: params["realm"], nonce: params["nonce"], opaque: params["opaque"]}
+	for _, qop := range strings.Split(params["qop"], ",") {
+		if strings.TrimSpace(qop) == "auth" {
+			ch.qop = "auth"
+		}
+	}
+	if ch.nonce == "" {
+		return nil, fmt.Errorf("tivo: digest challenge is missing a nonce")
+	}
+	return ch, nil
+}
+
+// parseParams parses the comma-separated key=value pairs of a challenge.
+// Values may be quoted.
+func parseParams(s string) map[string]string {
+	params := make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			return params
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = strings.TrimLeft(s[eq+1:], " \t")
+
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			var b strings.Builder
+			i := 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				b.WriteByte(s[i])
+			}
+			if i < len(s) {
+				i++ // Closing quote
+			}
+			value, s = b.String(), s[i:]
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end < 0 {
+				end = len(s)
+			}
+			value, s = strings.TrimSpace(s[:end]), s[end:]
+		}
+		params[key] = value
+	}
+}
+
+// authorize returns the Authorization header answering the challenge for req
+func (ch *challenge) authorize(req *http.Request, username, password string) string {
+	uri := req.URL.RequestURI()
+	ha1 := md5hex(username + ":" + ch.realm + ":" + password)
+	ha2 := md5hex(req.Method + ":" + uri)
+
+	fields := []string{
+		fmt.Sprintf("username=%q", username),
+		fmt.Sprintf("realm=%q", ch.realm),
+		fmt.Sprintf("nonce=%q", ch.nonce),
+		fmt.Sprintf("uri=%q", uri),
+		"algorithm=MD5",
+	}
+	if ch.qop == "" {
+		fields = append(fields, fmt.Sprintf("response=%q", md5hex(ha1+":"+ch.nonce+":"+ha2)))
+	} else {
+		nc := fmt.Sprintf("%08x", atomic.AddUint32(&ch.count, 1))
+		cnonce := newCnonce()
+		response := md5hex(ha1 + ":" + ch.nonce + ":" + nc + ":" + cnonce + ":" + ch.qop + ":" + ha2)
+		fields = append(fields, fmt.Sprintf("response=%q", response), "qop="+ch.qop, "nc="+nc, fmt.Sprintf("cnonce=%q", cnonce))
+	}
+	if ch.opaque != "" {
+		fields = append(fields, fmt.Sprintf("opaque=%q", ch.opaque))
+	}
+	return "Digest " + strings.Join(fields, ", ")
+}
+
+func newCnonce() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func md5hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
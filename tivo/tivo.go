@@ -0,0 +1,252 @@
+// Copyright (c) 2016 Bob Ziuchkovski
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package tivo is a client for the TiVoConnect interface that TiVo DVRs use
+// to list and transfer recordings (TiVo To Go).  Requests are authenticated
+// with HTTP digest authentication as the "tivo" user, using the media access
+// key (MAK) as the password.
+package tivo
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pageSize is the number of recordings requested per NowPlaying query
+const pageSize = 50
+
+// Recording describes a recording listed in the NowPlaying container.
+type Recording struct {
+	ID            string // Identifier from the download url
+	Title         string
+	EpisodeTitle  string
+	Description   string
+	Channel       string
+	Station       string
+	Captured      time.Time
+	Duration      time.Duration
+	Size          int64 // Approximate size of the download, in bytes
+	InProgress    bool  // The recording hasn't finished yet
+	CopyProtected bool  // The recording can't be downloaded
+	URL           string
+}
+
+// Client talks to the TiVoConnect interface of a single TiVo.  Cookies are
+// retained between requests, as TiVos require the session cookie set by the
+// first request for subsequent downloads.  It's safe for concurrent use.
+type Client struct {
+	// Base is the TiVo's base url, e.g. "https://192.168.1.20"
+	Base string
+
+	// MAK is the TiVo's media access key, used as the digest password
+	MAK string
+
+	// HTTPClient sends requests.  It should have a cookie jar.
+	HTTPClient *http.Client
+
+	// TransportStream requests downloads in mpeg-ts rather than mpeg-ps format.
+	// Only newer TiVos support mpeg-ts transfers.
+	TransportStream bool
+
+	mu        sync.Mutex
+	challenge *challenge // Most recent digest challenge, reused to authenticate preemptively
+}
+
+// NewClient returns a client for the TiVo at addr, which is either a host name
+// or a base url.  Host names are contacted over https.  TiVos use self-signed
+// certificates, so certificates aren't verified.
+func NewClient(addr, mak string) *Client {
+	if !strings.Contains(addr, "://") {
+		addr = "https://" + addr
+	}
+	jar, _ := cookiejar.New(nil)
+	transport := &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+	return &Client{
+		Base:       strings.TrimSuffix(addr, "/"),
+		MAK:        mak,
+		HTTPClient: &http.Client{Jar: jar, Transport: transport},
+	}
+}
+
+// NowPlaying lists the recordings on the TiVo, most recent first.
+func (c *Client) NowPlaying(ctx context.Context) ([]Recording, error) {
+	var recordings []Recording
+	for offset := 0; ; {
+		query := url.Values{
+			"Command":      {"QueryContainer"},
+			"Container":    {"/NowPlaying"},
+			"Recurse":      {"Yes"},
+			"SortOrder":    {"!CaptureDate"},
+			"ItemCount":    {strconv.Itoa(pageSize)},
+			"AnchorOffset": {strconv.Itoa(offset)},
+		}
+		resp, err := c.get(ctx, c.Base+"/TiVoConnect?"+query.Encode())
+		if err != nil {
+			return nil, err
+		}
+		var container tivoContainer
+		err = xml.NewDecoder(resp.Body).Decode(&container)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("tivo: invalid NowPlaying response: %s", err)
+		}
+
+		for _, item := range container.Items {
+			if strings.HasPrefix(item.Details.ContentType, "x-tivo-container/") {
+				continue
+			}
+			recordings = append(recordings, item.recording())
+		}
+		offset += len(container.Items)
+		if len(container.Items) == 0 || offset >= container.Details.TotalItems {
+			return recordings, nil
+		}
+	}
+}
+
+// Download starts downloading the recording at rawurl, typically the URL of a
+// Recording.  The caller must close the returned body.  The download is a TiVo
+// file, which can be decrypted with devo.Decrypt.
+func (c *Client) Download(ctx context.Context, rawurl string) (io.ReadCloser, error) {
+	if c.TransportStream {
+		u, err := url.Parse(rawurl)
+		if err != nil {
+			return nil, err
+		}
+		query := u.Query()
+		query.Set("Format", "video/x-tivo-mpeg-ts")
+		u.RawQuery = query.Encode()
+		rawurl = u.String()
+	}
+	resp, err := c.get(ctx, rawurl)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// get sends a GET request, authenticating with the digest challenge from the
+// previous request if there is one, and otherwise answering the challenge in
+// the response.  Responses other than 200 OK are returned as errors.
+func (c *Client) get(ctx context.Context, rawurl string) (*http.Response, error) {
+	c.mu.Lock()
+	ch := c.challenge
+	c.mu.Unlock()
+
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(http.MethodGet, rawurl, nil)
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+		if ch != nil {
+			req.Header.Set("Authorization", ch.authorize(req, "tivo", c.MAK))
+		}
+		resp, err := c.HTTPClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusOK {
+			return resp, nil
+		}
+		resp.Body.Close()
+
+		// A stale nonce or missing credentials yield a fresh challenge.  A
+		// second rejection in a row means the mak is wrong.
+		if resp.StatusCode == http.StatusUnauthorized && attempt == 0 {
+			ch, err = parseChallenge(resp.Header.Get("WWW-Authenticate"))
+			if err != nil {
+				return nil, err
+			}
+			c.mu.Lock()
+			c.challenge = ch
+			c.mu.Unlock()
+			continue
+		}
+		if resp.StatusCode == http.StatusUnauthorized {
+			return nil, fmt.Errorf("tivo: authentication failed; check the media access key")
+		}
+		return nil, fmt.Errorf("tivo: %s returned %s", req.URL.Path, resp.Status)
+	}
+}
+
+type tivoContainer struct {
+	Details struct {
+		TotalItems int
+	}
+	Items []tivoItem `xml:"Item"`
+}
+
+type tivoItem struct {
+	Details struct {
+		ContentType   string
+		Title         string
+		EpisodeTitle  string
+		Description   string
+		SourceChannel string
+		SourceStation string
+		CaptureDate   string // Hex unix time, e.g. "0x4f2b0d26"
+		Duration      int64  // Milliseconds
+		SourceSize    int64
+		InProgress    string
+		CopyProtected string
+	}
+	Links struct {
+		Content struct {
+			URL string `xml:"Url"`
+		}
+	}
+}
+
+func (item tivoItem) recording() Recording {
+	details := item.Details
+	rec := Recording{
+		Title:         details.Title,
+		EpisodeTitle:  details.EpisodeTitle,
+		Description:   details.Description,
+		Channel:       details.SourceChannel,
+		Station:       details.SourceStation,
+		Duration:      time.Duration(details.Duration) * time.Millisecond,
+		Size:          details.SourceSize,
+		InProgress:    details.InProgress == "Yes",
+		CopyProtected: details.CopyProtected == "Yes",
+		URL:           item.Links.Content.URL,
+	}
+	if captured, err := strconv.ParseInt(details.CaptureDate, 0, 64); err == nil {
+		rec.Captured = time.Unix(captured, 0).UTC()
+	}
+	if u, err := url.Parse(rec.URL); err == nil {
+		rec.ID = u.Query().Get("id")
+	}
+	return rec
+}
@@ -0,0 +1,210 @@
+// Copyright (c) 2016 Bob Ziuchkovski
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package tivo
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/bobziuchkovski/devo"
+	"github.com/bobziuchkovski/devo/devotest"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testRealm      = "TiVo DVR"
+	testNonce      = "5f3c2a9e"
+	testSession    = "0123ABCD"
+	testRecordings = 60
+)
+
+// fakeTiVo is an httptest stand-in for the TiVoConnect interface.  It demands
+// digest authentication and the session cookie set by its first response.
+type fakeTiVo struct {
+	*httptest.Server
+	ps, ts []byte // Scrambled downloads
+}
+
+func newFakeTiVo(t *testing.T) *fakeTiVo {
+	ps, err := devotest.Scramble(devotest.PS(devotest.Options{}), devotest.MAK)
+	if err != nil {
+		t.Fatalf("Encountered unexpected error scrambling mpeg-ps stream.  Error: %s", err)
+	}
+	ts, err := devotest.Scramble(devotest.TS(devotest.Options{}), devotest.MAK)
+	if err != nil {
+		t.Fatalf("Encountered unexpected error scrambling mpeg-ts stream.  Error: %s", err)
+	}
+	f := &fakeTiVo{ps: ps, ts: ts}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+func (f *fakeTiVo) serve(w http.ResponseWriter, r *http.Request) {
+	if !f.authorized(r) {
+		http.SetCookie(w, &http.Cookie{Name: "sid", Value: testSession})
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Digest realm="%s", nonce="%s", qop="auth"`, testRealm, testNonce))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if cookie, err := r.Cookie("sid"); err != nil || cookie.Value != testSession {
+		http.Error(w, "missing session", http.StatusForbidden)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/TiVoConnect":
+		f.nowPlaying(w, r)
+	case "/download/Show.TiVo":
+		if r.URL.Query().Get("Format") == "video/x-tivo-mpeg-ts" {
+			w.Write(f.ts)
+		} else {
+			w.Write(f.ps)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeTiVo) authorized(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Digest ") {
+		return false
+	}
+	params := parseParams(auth[len("Digest "):])
+	ha1 := md5hex("tivo:" + testRealm + ":" + devotest.MAK)
+	ha2 := md5hex(r.Method + ":" + r.URL.RequestURI())
+	expected := md5hex(strings.Join([]string{ha1, testNonce, params["nc"], params["cnonce"], "auth", ha2}, ":"))
+	return params["username"] == "tivo" && params["uri"] == r.URL.RequestURI() && params["response"] == expected
+}
+
+func (f *fakeTiVo) nowPlaying(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	offset, _ := strconv.Atoi(query.Get("AnchorOffset"))
+	count, _ := strconv.Atoi(query.Get("ItemCount"))
+
+	// A folder is listed first, as real TiVos do for suggestions
+	total := testRecordings + 1
+	fmt.Fprintf(w, "<?xml version=\"1.0\" encoding=\"utf-8\"?>\n<TiVoContainer><Details><TotalItems>%d</TotalItems></Details>", total)
+	for i := offset; i < total && i < offset+count; i++ {
+		if i == 0 {
+			fmt.Fprintf(w, "<Item><Details><ContentType>x-tivo-container/tivo-videos</ContentType><Title>Suggestions</Title></Details></Item>")
+			continue
+		}
+		fmt.Fprintf(w, "<Item><Details><ContentType>video/x-tivo-raw-tts</ContentType><Title>Show %d</Title><EpisodeTitle>Episode</EpisodeTitle>"+
+			"<SourceChannel>702</SourceChannel><SourceStation>KQED</SourceStation><CaptureDate>0x%x</CaptureDate><Duration>1800000</Duration>"+
+			"<SourceSize>%d</SourceSize><InProgress>%s</InProgress></Details><Links><Content><Url>%s/download/Show.TiVo?Container=%%2FNowPlaying&amp;id=%d</Url></Content></Links></Item>",
+			i, 1500000000+i, len(f.ps), map[bool]string{true: "Yes"}[i == 1], f.URL, 1000+i)
+	}
+	fmt.Fprintf(w, "</TiVoContainer>")
+}
+
+func TestNowPlaying(t *testing.T) {
+	f := newFakeTiVo(t)
+	defer f.Close()
+
+	recordings, err := NewClient(f.URL, devotest.MAK).NowPlaying(context.Background())
+	if err != nil {
+		t.Fatalf("Encountered unexpected error listing recordings.  Error: %s", err)
+	}
+	if len(recordings) != testRecordings {
+		t.Fatalf("Recording count is incorrect.  Expected: %d, Actual: %d", testRecordings, len(recordings))
+	}
+	expected := Recording{
+		ID:           "1001",
+		Title:        "Show 1",
+		EpisodeTitle: "Episode",
+		Channel:      "702",
+		Station:      "KQED",
+		Captured:     time.Unix(1500000001, 0).UTC(),
+		Duration:     30 * time.Minute,
+		Size:         int64(len(f.ps)),
+		InProgress:   true,
+		URL:          f.URL + "/download/Show.TiVo?Container=%2FNowPlaying&id=1001",
+	}
+	if recordings[0] != expected {
+		t.Errorf("Recording is incorrect.  Expected: %+v, Actual: %+v", expected, recordings[0])
+	}
+	last := recordings[len(recordings)-1]
+	if last.ID != strconv.Itoa(1000+testRecordings) || last.InProgress {
+		t.Errorf("Last recording is incorrect.  Actual: %+v", last)
+	}
+}
+
+func TestDownload(t *testing.T) {
+	f := newFakeTiVo(t)
+	defer f.Close()
+
+	for _, ts := range []bool{false, true} {
+		client := NewClient(f.URL, devotest.MAK)
+		client.TransportStream = ts
+		body, err := client.Download(context.Background(), f.URL+"/download/Show.TiVo?Container=%2FNowPlaying&id=1001")
+		if err != nil {
+			t.Fatalf("Encountered unexpected error downloading recording.  TransportStream: %t, Error: %s", ts, err)
+		}
+		var decrypted bytes.Buffer
+		err = devo.Decrypt(&decrypted, body, devotest.MAK)
+		body.Close()
+		if err != nil {
+			t.Fatalf("Encountered unexpected error decrypting download.  TransportStream: %t, Error: %s", ts, err)
+		}
+		plain := devotest.PS(devotest.Options{})
+		if ts {
+			plain = devotest.TS(devotest.Options{})
+		}
+		if !bytes.Equal(decrypted.Bytes(), plain) {
+			t.Errorf("Decrypted download is invalid.  TransportStream: %t", ts)
+		}
+	}
+}
+
+func TestBadMAK(t *testing.T) {
+	f := newFakeTiVo(t)
+	defer f.Close()
+
+	_, err := NewClient(f.URL, "0000000000").NowPlaying(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "authentication failed") {
+		t.Errorf("Expected authentication failure.  Error: %v", err)
+	}
+	_, err = NewClient(f.URL, devotest.MAK).Download(context.Background(), f.URL+"/download/Missing.TiVo")
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("Expected not found error.  Error: %v", err)
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	ch, err := parseChallenge(`Digest realm="TiVo DVR", nonce="a\"b", qop="auth,auth-int", opaque=xyz`)
+	if err != nil {
+		t.Fatalf("Encountered unexpected error parsing challenge.  Error: %s", err)
+	}
+	if ch.realm != "TiVo DVR" || ch.nonce != `a"b` || ch.qop != "auth" || ch.opaque != "xyz" {
+		t.Errorf("Challenge is incorrect.  Actual: %+v", ch)
+	}
+	for _, header := range []string{"Basic realm=\"TiVo\"", "Digest realm=\"TiVo\"", "Digest nonce=1, algorithm=SHA-256"} {
+		if _, err := parseChallenge(header); err == nil {
+			t.Errorf("Expected error parsing challenge.  Header: %s", header)
+		}
+	}
+}
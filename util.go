@@ -20,6 +20,43 @@
 
 package devo
 
+import (
+	"bufio"
+	"io"
+)
+
+// sourceReader buffers reads from an underlying reader while tracking the file
+// offset of the next unread byte.
+type sourceReader struct {
+	*bufio.Reader
+	counter *countingReader
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+// sourceBufferSize allows peeking past the largest mpeg-ps packet to the start
+// code that follows it
+const sourceBufferSize = 128 << 10
+
+func newSourceReader(r io.Reader, offset int64) *sourceReader {
+	counter := &countingReader{r: r, n: offset}
+	return &sourceReader{Reader: bufio.NewReaderSize(counter, sourceBufferSize), counter: counter}
+}
+
+// offset returns the file offset of the next unread byte
+func (s *sourceReader) offset() int64 {
+	return s.counter.n - int64(s.Buffered())
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
 func confounder(scrambled []byte) (confounder [3]byte) {
 	if len(scrambled) < 4 {
 		panic("expected at least 4 bytes")
@@ -32,6 +69,12 @@ func confounder(scrambled []byte) (confounder [3]byte) {
 	return
 }
 
+// hasStartCode reports whether an mpeg start code prefix (0x000001) is at b[offset:]
+// with a stream/start code octet following it
+func hasStartCode(b []byte, offset int) bool {
+	return offset+4 <= len(b) && joinWord(b[offset:offset+4])>>8 == psPrefix
+}
+
 func joinShort(octets []byte) uint16 {
 	if len(octets) != 2 {
 		panic("expected 2 bytes")
@@ -49,3 +92,37 @@ func joinWord(octets []byte) uint32 {
 func wordOctet(word uint32, n uint) byte {
 	return byte((word >> (24 - n*8)) & 0xff)
 }
+
+// parsePTS decodes a 33-bit PES timestamp from its 5-byte marker-bit encoding
+func parsePTS(b []byte) int64 {
+	if len(b) != 5 {
+		panic("expected 5 bytes")
+	}
+	return int64(b[0]>>1&0x07)<<30 | int64(b[1])<<22 | int64(b[2]>>1)<<15 | int64(b[3])<<7 | int64(b[4]>>1)
+}
+
+// MPEG-2 CRC32 (polynomial 0x04c11db7, unreflected) lookup table
+var crcTable = func() (table [256]uint32) {
+	for i := range table {
+		crc := uint32(i) << 24
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x80000000 != 0 {
+				crc = (crc << 1) ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return
+}()
+
+// crc32MPEG computes the CRC used by mpeg-ts PSI sections.  The CRC of a
+// section including its trailing CRC field is zero when the section is intact.
+func crc32MPEG(b []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, octet := range b {
+		crc = (crc << 8) ^ crcTable[byte(crc>>24)^octet]
+	}
+	return crc
+}